@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// sourceLocation is where a Terraform diagnostic points to in the
+// configuration
+type sourceLocation struct {
+	file string
+	line int
+}
+
+// runError is an error diagnostic found in the logs of an errored run
+type runError struct {
+	summary  string
+	detail   string
+	location *sourceLocation
+}
+
+var (
+	// rawErrorSummary and rawErrorLocation match the diagnostics of
+	// unstructured logs, e.g. "Error: Unsupported argument" followed by
+	// "on main.tf line 12, in resource ..."
+	rawErrorSummary  = regexp.MustCompile(`^\s*(?:│\s*)?Error: (.+)$`)
+	rawErrorLocation = regexp.MustCompile(`^\s*(?:│\s*)?on (\S+) line (\d+)`)
+)
+
+// parseRunErrors extracts the error diagnostics from plan or apply logs, in
+// the structured format or falling back to raw logs
+func parseRunErrors(r io.Reader) ([]runError, error) {
+	var errs []runError
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if l, ok := parseLogLine(line); ok {
+			if l.Level == "error" && l.Diagnostic != nil {
+				e := runError{summary: l.Diagnostic.Summary, detail: l.Diagnostic.Detail}
+				if rng := l.Diagnostic.Range; rng != nil && rng.Filename != "" {
+					e.location = &sourceLocation{file: rng.Filename, line: rng.Start.Line}
+				}
+				errs = append(errs, e)
+			}
+			continue
+		}
+		line = ansiEscape.ReplaceAllString(line, "")
+		if m := rawErrorSummary.FindStringSubmatch(line); m != nil {
+			errs = append(errs, runError{summary: strings.TrimSpace(m[1])})
+		} else if m := rawErrorLocation.FindStringSubmatch(line); m != nil && len(errs) > 0 && errs[len(errs)-1].location == nil {
+			n, _ := strconv.Atoi(m[2])
+			errs[len(errs)-1].location = &sourceLocation{file: m[1], line: n}
+		}
+	}
+	return errs, sc.Err()
+}
+
+// escapeAnnotation escapes a workflow command value, properties also need
+// their separators escaped
+func escapeAnnotation(s string, property bool) string {
+	r := strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	s = r.Replace(s)
+	if property {
+		s = strings.NewReplacer(":", "%3A", ",", "%2C").Replace(s)
+	}
+	return s
+}
+
+// annotation renders a runError as a GitHub error annotation. Files are
+// relative to root, the directory of the configuration in the repository
+func (e runError) annotation(root string) string {
+	message := e.summary
+	if e.detail != "" {
+		message += ": " + e.detail
+	}
+	if e.location == nil {
+		return fmt.Sprintf("::error::%s", escapeAnnotation(message, false))
+	}
+	detail := e.detail
+	if detail == "" {
+		detail = e.summary
+	}
+	return fmt.Sprintf("::error file=%s,line=%d,title=%s::%s",
+		escapeAnnotation(path.Join(root, e.location.file), true), e.location.line,
+		escapeAnnotation(e.summary, true), escapeAnnotation(detail, false))
+}
+
+// annotateRunErrors emits a GitHub error annotation for every error
+// diagnostic of the errored phase of the run, or a plain one when the logs
+// hold none. Annotations are a best effort, failures are only logged
+func annotateRunErrors(ctx context.Context, client *tfe.Client, r *tfe.Run, root string) {
+	logs, err := erroredPhaseLogs(ctx, client, r)
+	var errs []runError
+	if err == nil {
+		errs, err = parseRunErrors(logs)
+	}
+	if err != nil {
+		logWarn("could not read the logs of run %q for annotations: %v", r.ID, err)
+	}
+	if len(errs) == 0 {
+		errs = []runError{{summary: fmt.Sprintf("Terraform run %s encountered an error", r.ID)}}
+	}
+	for _, e := range errs {
+		// Workflow commands must reach stdout whatever the log level
+		fmt.Fprintln(logOutput, e.annotation(root))
+	}
+}
+
+// erroredPhaseLogs returns the logs of the plan, or of the apply when the
+// plan succeeded
+func erroredPhaseLogs(ctx context.Context, client *tfe.Client, r *tfe.Run) (io.Reader, error) {
+	if r.Plan == nil {
+		return nil, fmt.Errorf("run has no plan")
+	}
+	plan, err := client.Plans.Read(ctx, r.Plan.ID)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Status != tfe.PlanErrored && r.Apply != nil && r.Apply.ID != "" {
+		return client.Applies.Logs(ctx, r.Apply.ID)
+	}
+	return client.Plans.Logs(ctx, r.Plan.ID)
+}
+
+// annotationRoot returns the repository directory the configuration paths
+// of diagnostics are relative to: directory when set, else the workspace's
+// working directory
+func annotationRoot(w *tfe.Workspace) string {
+	if directory != "" {
+		return directory
+	}
+	return w.WorkingDirectory
+}
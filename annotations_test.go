@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRunErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string
+		want []string
+	}{
+		{
+			name: "structured",
+			log: `{"@level":"info","@message":"Terraform 1.6.0","type":"version"}
+{"@level":"error","@message":"Error: Unsupported argument","type":"diagnostic","diagnostic":{"severity":"error","summary":"Unsupported argument","detail":"An argument named \"foo\" is not expected here.","range":{"filename":"main.tf","start":{"line":12}}}}
+{"@level":"error","@message":"Error: No valid credential sources found","type":"diagnostic","diagnostic":{"severity":"error","summary":"No valid credential sources found","detail":""}}
+{"@level":"warn","@message":"Warning: Deprecated","type":"diagnostic","diagnostic":{"severity":"warning","summary":"Deprecated"}}`,
+			want: []string{
+				`::error file=infra/main.tf,line=12,title=Unsupported argument::An argument named "foo" is not expected here.`,
+				`::error::No valid credential sources found`,
+			},
+		},
+		{
+			name: "raw",
+			log: "\x1b[31m╷\x1b[0m\n" +
+				"\x1b[31m│\x1b[0m \x1b[1m\x1b[31mError: \x1b[0m\x1b[0m\x1b[1mUnsupported argument\x1b[0m\n" +
+				"\x1b[31m│\x1b[0m\n" +
+				"\x1b[31m│\x1b[0m \x1b[0m  on main.tf line 12, in resource \"null_resource\" \"x\":\n" +
+				"\x1b[31m│\x1b[0m \x1b[0m  12:   foo = 1\n" +
+				"Error: Invalid provider configuration\n",
+			want: []string{
+				`::error file=infra/main.tf,line=12,title=Unsupported argument::Unsupported argument`,
+				`::error::Invalid provider configuration`,
+			},
+		},
+		{
+			name: "escaped properties",
+			log:  `{"@level":"error","@message":"Error: x","type":"diagnostic","diagnostic":{"summary":"Bad: a, b","detail":"line one\nline two","range":{"filename":"modules/a,b/main.tf","start":{"line":3}}}}`,
+			want: []string{`::error file=infra/modules/a%2Cb/main.tf,line=3,title=Bad%3A a%2C b::line one%0Aline two`},
+		},
+		{
+			name: "no errors",
+			log:  "Plan: 1 to add, 0 to change, 0 to destroy.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, err := parseRunErrors(strings.NewReader(tt.log))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, e := range errs {
+				got = append(got, e.annotation("infra"))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("annotations =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
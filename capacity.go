@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// runCapacity is the run-capacity output: the organization's runs currently
+// using and waiting for its concurrency, and the entitlements relevant to
+// running them
+type runCapacity struct {
+	Running        int  `json:"running"`
+	Pending        int  `json:"pending"`
+	Operations     bool `json:"operations"`
+	Agents         bool `json:"agents"`
+	Sentinel       bool `json:"sentinel"`
+	CostEstimation bool `json:"cost_estimation"`
+}
+
+// readRunCapacity reads the organization's run capacity and entitlements
+func readRunCapacity(ctx context.Context, client *tfe.Client) (*runCapacity, error) {
+	capacity, err := client.Organizations.ReadCapacity(ctx, organization)
+	if err != nil {
+		return nil, err
+	}
+	entitlements, err := client.Organizations.ReadEntitlements(ctx, organization)
+	if err != nil {
+		return nil, err
+	}
+	return &runCapacity{
+		Running:        capacity.Running,
+		Pending:        capacity.Pending,
+		Operations:     entitlements.Operations,
+		Agents:         entitlements.Agents,
+		Sentinel:       entitlements.Sentinel,
+		CostEstimation: entitlements.CostEstimation,
+	}, nil
+}
+
+// checkRunCapacity logs the organization's run capacity and writes the
+// run-capacity output. The API does not expose the concurrency limit itself,
+// but pending runs mean every slot is taken and a new run will queue, which
+// is warned about. Failures only warn, capacity is informational
+func checkRunCapacity(ctx context.Context, client *tfe.Client) {
+	c, err := readRunCapacity(ctx, client)
+	if err != nil {
+		logWarn("could not read the run capacity of organization %q: %v", organization, err)
+		return
+	}
+	logInfo("Organization %q runs: %d running, %d pending", organization, c.Running, c.Pending)
+	if c.Pending > 0 {
+		logWarn("organization %q has %d runs waiting for capacity, the run may be queued", organization, c.Pending)
+	}
+	if !c.Operations {
+		logWarn("organization %q is not entitled to remote operations", organization)
+	}
+	if outputFile := outputPath(); outputFile != "" {
+		data, _ := json.Marshal(c)
+		appendToFile(outputFile, "run-capacity", string(data))
+	}
+}
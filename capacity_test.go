@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCheckRunCapacity(t *testing.T) {
+	const entitlements = `{"data":{"id":"org","type":"entitlement-sets","attributes":{"operations":%t,"agents":true,"sentinel":false,"cost-estimation":true}}}`
+
+	tests := []struct {
+		name        string
+		pending     int
+		operations  bool
+		wantOutput  string
+		wantWarning string
+	}{
+		{
+			name:       "capacity available",
+			operations: true,
+			wantOutput: `{"running":2,"pending":0,"operations":true,"agents":true,"sentinel":false,"cost_estimation":true}`,
+		},
+		{
+			name:        "runs waiting for capacity",
+			pending:     3,
+			operations:  true,
+			wantOutput:  `{"running":2,"pending":3,"operations":true,"agents":true,"sentinel":false,"cost_estimation":true}`,
+			wantWarning: `has 3 runs waiting for capacity`,
+		},
+		{
+			name:        "no remote operations",
+			wantOutput:  `{"running":2,"pending":0,"operations":false,"agents":true,"sentinel":false,"cost_estimation":true}`,
+			wantWarning: `is not entitled to remote operations`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("GET", "/api/v2/organizations/org/capacity", http.StatusOK, fmt.Sprintf(
+				`{"data":{"id":"org","type":"organization-capacity","attributes":{"running":2,"pending":%d}}}`, tt.pending))
+			stub.reply("GET", "/api/v2/organizations/org/entitlement-set", http.StatusOK, fmt.Sprintf(entitlements, tt.operations))
+			outputs := captureOutputs(t)
+			setInput(t, &organization, "org")
+
+			log := captureStdout(t, func() {
+				checkRunCapacity(context.Background(), client)
+			})
+
+			if got := outputs()["run-capacity"]; got != tt.wantOutput {
+				t.Errorf("run-capacity = %s, want %s", got, tt.wantOutput)
+			}
+			warned := strings.Contains(log, "Warning:")
+			if warned != (tt.wantWarning != "") || !strings.Contains(log, tt.wantWarning) {
+				t.Errorf("log = %q, want warning %q", log, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestCheckRunCapacityOnlyWarns(t *testing.T) {
+	stub, client := newTFEStub(t)
+	stub.reply("GET", "/api/v2/organizations/org/capacity", http.StatusForbidden, `{"errors":[{"status":"403"}]}`)
+	outputs := captureOutputs(t)
+	setInput(t, &organization, "org")
+
+	log := captureStdout(t, func() {
+		checkRunCapacity(context.Background(), client)
+	})
+
+	if !strings.Contains(log, `could not read the run capacity of organization "org"`) {
+		t.Errorf("log = %q, want the read failure warned about", log)
+	}
+	if got, written := outputs()["run-capacity"]; written {
+		t.Errorf("run-capacity = %s, want it not written", got)
+	}
+}
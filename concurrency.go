@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultConcurrency bounds the variable requests in flight when concurrency
+// is unset
+const defaultConcurrency = 4
+
+// rateLimitedCalls counts the API responses that were rate limited, which
+// is how adaptive concurrency notices it should slow down
+var rateLimitedCalls atomic.Int64
+
+// concurrencyLimit bounds the variable operations in flight. Adaptive limits
+// halve whenever a request was rate limited since the last operation
+// finished and grow back by one after as many operations in a row went
+// through without, staying within min and max
+type concurrencyLimit struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	limit, min, max int
+	active, streak  int
+	// seen is rateLimitedCalls as of the last adjustment
+	seen int64
+}
+
+// newConcurrencyLimit reads the concurrency, adaptive-concurrency and
+// min-concurrency inputs
+func newConcurrencyLimit() (*concurrencyLimit, error) {
+	upper, err := parsePositive("concurrency", concurrency, defaultConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	lower := upper
+	if adaptiveConc == "true" {
+		lower, err = parsePositive("min-concurrency", minConc, 1)
+		if err != nil {
+			return nil, err
+		}
+		if lower > upper {
+			return nil, fmt.Errorf("min-concurrency %d exceeds concurrency %d", lower, upper)
+		}
+	}
+	l := &concurrencyLimit{limit: upper, min: lower, max: upper, seen: rateLimitedCalls.Load()}
+	l.cond = sync.NewCond(&l.mu)
+	return l, nil
+}
+
+func parsePositive(name, value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive integer", name, value)
+	}
+	return n, nil
+}
+
+// acquire blocks until one more operation may start
+func (l *concurrencyLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		l.cond.Wait()
+	}
+	l.active++
+}
+
+// release records that an operation finished and adjusts the limit
+func (l *concurrencyLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if limited := rateLimitedCalls.Load(); limited > l.seen {
+		l.seen = limited
+		l.streak = 0
+		if l.limit > l.min {
+			l.limit = max(l.min, l.limit/2)
+			logDebug("Rate limited, lowering concurrency to %d", l.limit)
+		}
+	} else if l.limit < l.max {
+		l.streak++
+		if l.streak >= l.limit {
+			l.streak = 0
+			l.limit++
+			logDebug("Raising concurrency to %d", l.limit)
+		}
+	}
+	l.cond.Broadcast()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestNewConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     string
+		adaptive  string
+		min       string
+		wantLimit int
+		wantMin   int
+		wantErr   string
+	}{
+		{name: "default", wantLimit: defaultConcurrency, wantMin: defaultConcurrency},
+		{name: "fixed ignores min-concurrency", limit: "6", min: "9", wantLimit: 6, wantMin: 6},
+		{name: "adaptive", limit: "6", adaptive: "true", min: "2", wantLimit: 6, wantMin: 2},
+		{name: "adaptive defaults to a minimum of one", limit: "6", adaptive: "true", wantLimit: 6, wantMin: 1},
+		{name: "zero", limit: "0", wantErr: `invalid concurrency "0"`},
+		{name: "not a number", limit: "many", wantErr: `invalid concurrency "many"`},
+		{name: "min above max", limit: "2", adaptive: "true", min: "3", wantErr: "min-concurrency 3 exceeds concurrency 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &concurrency, tt.limit)
+			setInput(t, &adaptiveConc, tt.adaptive)
+			setInput(t, &minConc, tt.min)
+
+			l, err := newConcurrencyLimit()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if l.limit != tt.wantLimit || l.min != tt.wantMin {
+				t.Errorf("limit, min = %d, %d, want %d, %d", l.limit, l.min, tt.wantLimit, tt.wantMin)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimitAdapts(t *testing.T) {
+	tests := []struct {
+		name     string
+		adaptive string
+		// limited tells for each operation whether it was rate limited
+		limited []bool
+		want    []int
+	}{
+		{
+			name:     "halves down to the minimum and recovers",
+			adaptive: "true",
+			limited:  []bool{true, true, true, false, false, false, false, false, false, false},
+			want:     []int{4, 2, 2, 2, 3, 3, 3, 4, 4, 4},
+		},
+		{
+			name:     "rate limited again while recovering",
+			adaptive: "true",
+			limited:  []bool{true, true, false, false, true},
+			want:     []int{4, 2, 2, 3, 2},
+		},
+		{
+			name:    "fixed",
+			limited: []bool{true, true, false},
+			want:    []int{8, 8, 8},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &concurrency, "8")
+			setInput(t, &adaptiveConc, tt.adaptive)
+			setInput(t, &minConc, "2")
+			l, err := newConcurrencyLimit()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []int
+			for _, limited := range tt.limited {
+				l.acquire()
+				if limited {
+					rateLimitedCalls.Add(1)
+				}
+				l.release()
+				got = append(got, l.limit)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("limits = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncVariablesThrottlesOnRateLimits(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	setInput(t, &url, stub.URL)
+	setInput(t, &tfeToken, "test-token")
+	setInput(t, &concurrency, "4")
+	setInput(t, &adaptiveConc, "true")
+	setInput(t, &minConc, "1")
+	store := stub.serveVariables("ws-1")
+
+	// The first creates are rate limited, the rest go through
+	var mu sync.Mutex
+	posts := 0
+	var flight inFlight
+	stub.handle("POST", "/api/v2/workspaces/ws-1/vars", flight.wrap(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		posts++
+		limited := posts <= 4
+		mu.Unlock()
+		if limited {
+			writeJSONAPI(w, http.StatusTooManyRequests, `{"errors":[{"status":"429"}]}`)
+			return
+		}
+		store.create(w, r)
+	}))
+
+	client, err := newClient(newActionMetrics(), nil, 0)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	before := rateLimitedCalls.Load()
+
+	var vars []workspaceVar
+	for i := 0; i < 12; i++ {
+		vars = append(vars, workspaceVar{Key: fmt.Sprintf("v%d", i), Value: "x"})
+	}
+	result, err := syncVariables(context.Background(), client, newVariableCache(client), &tfe.Workspace{ID: "ws-1"}, vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.created != 12 || len(store.snapshot()) != 12 {
+		t.Errorf("created = %d, stored = %d, want 12", result.created, len(store.snapshot()))
+	}
+	if n := rateLimitedCalls.Load() - before; n != 4 {
+		t.Errorf("rate limited calls = %d, want 4", n)
+	}
+}
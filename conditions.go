@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// filterVarsByCondition drops the json-vars entries whose when condition
+// does not hold
+func filterVarsByCondition(vars []workspaceVar) ([]workspaceVar, error) {
+	ret := vars[:0]
+	for _, v := range vars {
+		if v.When != nil {
+			ok, err := evalCondition(*v.When, os.Getenv)
+			if err != nil {
+				return nil, fmt.Errorf("invalid when condition of variable %q: %w", v.Key, err)
+			}
+			if !ok {
+				logVariable("Skipping variable %q, its when condition is false", v.Key)
+				continue
+			}
+		}
+		ret = append(ret, v)
+	}
+	return ret, nil
+}
+
+// evalCondition evaluates a when condition such as
+// `env.ENVIRONMENT == "prod" && env.REGION != "eu"`. Operands are env.NAME
+// references and double quoted strings, compared with == and != and
+// combined with !, && and ||, where && binds tighter. A bare operand holds
+// when it is not empty
+func evalCondition(expr string, getenv func(string) string) (bool, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return false, err
+	}
+	p := &conditionParser{tokens: tokens, getenv: getenv}
+	ok, err := p.or()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		return false, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return ok, nil
+}
+
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!=") ||
+			strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case c == '!':
+			tokens = append(tokens, "!")
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(expr) && expr[end] != '"' {
+				if expr[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(expr) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, expr[i:end+1])
+			i = end + 1
+		case c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			end := i
+			for end < len(expr) && (expr[end] == '_' || expr[end] == '.' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+				end++
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+type conditionParser struct {
+	tokens []string
+	pos    int
+	getenv func(string) string
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) or() (bool, error) {
+	ok, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.pos++
+		var right bool
+		right, err = p.and()
+		ok = ok || right
+	}
+	return ok, err
+}
+
+func (p *conditionParser) and() (bool, error) {
+	ok, err := p.comparison()
+	for err == nil && p.peek() == "&&" {
+		p.pos++
+		var right bool
+		right, err = p.comparison()
+		ok = ok && right
+	}
+	return ok, err
+}
+
+func (p *conditionParser) comparison() (bool, error) {
+	if p.peek() == "!" {
+		p.pos++
+		ok, err := p.comparison()
+		return !ok, err
+	}
+	left, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+	op := p.peek()
+	if op != "==" && op != "!=" {
+		return left != "", nil
+	}
+	p.pos++
+	right, err := p.operand()
+	if err != nil {
+		return false, err
+	}
+	return (left == right) == (op == "=="), nil
+}
+
+func (p *conditionParser) operand() (string, error) {
+	tok := p.peek()
+	if tok == "" {
+		return "", fmt.Errorf("unexpected end of condition")
+	}
+	p.pos++
+	switch {
+	case strings.HasPrefix(tok, `"`):
+		return strconv.Unquote(tok)
+	case strings.HasPrefix(tok, "env.") && len(tok) > len("env."):
+		return p.getenv(strings.TrimPrefix(tok, "env.")), nil
+	default:
+		return "", fmt.Errorf("unexpected %q, expected env.NAME or a quoted string", tok)
+	}
+}
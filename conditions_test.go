@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvalCondition(t *testing.T) {
+	env := map[string]string{"ENVIRONMENT": "prod", "REGION": "eu", "EMPTY": ""}
+	getenv := func(name string) string { return env[name] }
+
+	tests := []struct {
+		expr    string
+		want    bool
+		wantErr string
+	}{
+		{expr: `env.ENVIRONMENT == "prod"`, want: true},
+		{expr: `env.ENVIRONMENT != "prod"`, want: false},
+		{expr: `env.ENVIRONMENT == "prod" && env.REGION != "eu"`, want: false},
+		{expr: `env.ENVIRONMENT == "dev" || env.REGION == "eu"`, want: true},
+		{expr: `env.REGION == "us" && env.ENVIRONMENT == "dev" || env.ENVIRONMENT == "prod"`, want: true},
+		{expr: `env.ENVIRONMENT == "prod" || env.REGION == "us" && env.ENVIRONMENT == "dev"`, want: true},
+		{expr: `!env.EMPTY`, want: true},
+		{expr: `env.ENVIRONMENT`, want: true},
+		{expr: `env.UNSET`, want: false},
+		{expr: `!(env.ENVIRONMENT)`, wantErr: "unexpected character '('"},
+		{expr: `"a \"quoted\" value" == "a \"quoted\" value"`, want: true},
+		{expr: `env.ENVIRONMENT == "prod`, wantErr: "unterminated string"},
+		{expr: `env.ENVIRONMENT ==`, wantErr: "unexpected end of condition"},
+		{expr: `ENVIRONMENT == "prod"`, wantErr: `unexpected "ENVIRONMENT"`},
+		{expr: `env.ENVIRONMENT == "prod" "dev"`, wantErr: `unexpected "\"dev\""`},
+		{expr: `env.A = "b"`, wantErr: "unexpected character '='"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := evalCondition(tt.expr, getenv)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("evalCondition(%q) = %t, want %t", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterVarsByCondition(t *testing.T) {
+	t.Setenv("ENVIRONMENT", "prod")
+	prod, dev, broken := `env.ENVIRONMENT == "prod"`, `env.ENVIRONMENT == "dev"`, `env.ENVIRONMENT ==`
+	vars := []workspaceVar{{Key: "always"}, {Key: "prod", When: &prod}, {Key: "dev", When: &dev}}
+
+	filtered, err := filterVarsByCondition(vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var keys []string
+	for _, v := range filtered {
+		keys = append(keys, v.Key)
+	}
+	if got := strings.Join(keys, " "); got != "always prod" {
+		t.Errorf("kept %q, want %q", got, "always prod")
+	}
+
+	_, err = filterVarsByCondition([]workspaceVar{{Key: "x", When: &broken}})
+	if err == nil || !strings.Contains(err.Error(), `invalid when condition of variable "x"`) {
+		t.Errorf("error = %v, want the invalid condition reported", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// uploadConfiguration creates a configuration version for the workspace from
+// the directory and waits until it has been processed. Runs are never queued
+// automatically, the caller decides whether to create one
+func uploadConfiguration(ctx context.Context, client *tfe.Client, workspaceID, dir string) (*tfe.ConfigurationVersion, error) {
+	cv, err := client.ConfigurationVersions.Create(ctx, workspaceID, tfe.ConfigurationVersionCreateOptions{
+		AutoQueueRuns: tfe.Bool(false),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create configuration version: %w", err)
+	}
+
+	if err := client.ConfigurationVersions.Upload(ctx, cv.UploadURL, dir); err != nil {
+		return nil, fmt.Errorf("unable to upload configuration from %q: %w", dir, err)
+	}
+	logInfo("Uploaded configuration from %q as %s", dir, cv.ID)
+
+	timeout := time.After(maximumTimeout)
+	for {
+		cv, err = client.ConfigurationVersions.Read(ctx, cv.ID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read configuration version: %w", err)
+		}
+		switch cv.Status {
+		case tfe.ConfigurationUploaded:
+			return cv, nil
+		case tfe.ConfigurationErrored:
+			return nil, fmt.Errorf("configuration version %s errored: %s", cv.ID, cv.ErrorMessage)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, fmt.Errorf("timed out waiting for configuration version %s to be processed", cv.ID)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// currentRunConfiguration returns the workspace's current run and the
+// configuration version it was created from, for the rerun command
+func currentRunConfiguration(ctx context.Context, client *tfe.Client, w *tfe.Workspace) (*tfe.Run, *tfe.ConfigurationVersion, error) {
+	if w.CurrentRun == nil {
+		return nil, nil, fmt.Errorf("workspace %q has no current run to rerun", w.Name)
+	}
+	previous, err := client.Runs.Read(ctx, w.CurrentRun.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read current run %q: %w", w.CurrentRun.ID, err)
+	}
+	if previous.ConfigurationVersion == nil {
+		return nil, nil, fmt.Errorf("current run %q has no configuration version", previous.ID)
+	}
+	return previous, previous.ConfigurationVersion, nil
+}
+
+// minCommitPrefix is the shortest commit SHA prefix configuration-ref matches
+const minCommitPrefix = 7
+
+// findConfigurationByRef returns the most recent configuration version of
+// the workspace whose VCS provenance matches ref, either its commit SHA, a
+// prefix of it, or its tag
+func findConfigurationByRef(ctx context.Context, client *tfe.Client, workspaceID, ref string) (*tfe.ConfigurationVersion, error) {
+	opts := &tfe.ConfigurationVersionListOptions{
+		ListOptions: tfe.ListOptions{PageSize: 100},
+		Include:     []tfe.ConfigVerIncludeOpt{tfe.ConfigVerIngressAttributes},
+	}
+	for {
+		page, err := client.ConfigurationVersions.List(ctx, workspaceID, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list configuration versions: %w", err)
+		}
+		for _, cv := range page.Items {
+			if matchesRef(cv.IngressAttributes, ref) {
+				return cv, nil
+			}
+		}
+		if page.Pagination == nil || page.Pagination.NextPage == 0 {
+			return nil, fmt.Errorf("no configuration version of the workspace matches configuration-ref %q", ref)
+		}
+		opts.PageNumber = page.Pagination.NextPage
+	}
+}
+
+func matchesRef(ia *tfe.IngressAttributes, ref string) bool {
+	if ia == nil {
+		return false
+	}
+	if ia.Tag != "" && ia.Tag == ref {
+		return true
+	}
+	return len(ref) >= minCommitPrefix && strings.HasPrefix(ia.CommitSHA, ref)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// uploadedFiles lists the files of the configuration uploaded to the stub
+func uploadedFiles(t *testing.T, stub *tfeStub) []string {
+	t.Helper()
+	bodies := stub.requestBodies("PUT", "/upload/cv-2")
+	if len(bodies) != 1 {
+		t.Fatalf("uploads = %d, want 1", len(bodies))
+	}
+	zr, err := gzip.NewReader(strings.NewReader(bodies[0]))
+	if err != nil {
+		t.Fatalf("the upload is not gzipped: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("the upload is not a tarball: %v", err)
+		}
+		names = append(names, h.Name)
+	}
+}
+
+func TestRunUploadConfig(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.serveUpload()
+	outputs := captureOutputs(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte(`resource "null_resource" "a" {}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setInput(t, &directory, dir)
+
+	if err := run(context.Background(), []string{"upload-config"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := uploadedFiles(t, stub); len(got) != 1 || got[0] != "main.tf" {
+		t.Errorf("uploaded files = %v, want main.tf", got)
+	}
+	if body := stub.requestBodies("POST", "/api/v2/workspaces/ws-1/configuration-versions"); !strings.Contains(body[0], `"auto-queue-runs":false`) {
+		t.Errorf("configuration version created with %s, want auto-queue-runs false", body[0])
+	}
+	if got := outputs()["configuration-version-id"]; got != "cv-2" {
+		t.Errorf("configuration-version-id = %q, want cv-2", got)
+	}
+	if n := stub.count("POST", "/api/v2/runs"); n != 0 {
+		t.Errorf("runs created = %d, want none", n)
+	}
+}
+
+func TestRunUploadConfigRequiresDirectory(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	setInput(t, &directory, "")
+
+	err := run(context.Background(), []string{"upload-config"})
+	if err == nil || !strings.Contains(err.Error(), "upload-config requires the directory input") {
+		t.Fatalf("error = %v, want the missing directory", err)
+	}
+}
+
+func TestRunRerun(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusOK,
+		`{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws"},"relationships":{"current-run":{"data":{"id":"run-0","type":"runs"}}}}}`)
+	stub.reply("GET", "/api/v2/runs/run-0", http.StatusOK,
+		`{"data":{"id":"run-0","type":"runs","attributes":{"status":"errored"},"relationships":{"configuration-version":{"data":{"id":"cv-0","type":"configuration-versions"}}}}}`)
+	store := stub.serveVariables("ws-1", fakeVariable{ID: "var-1", Key: "region", Value: "eu-west-1", Category: "terraform"})
+	outputs := captureOutputs(t)
+	setInput(t, &jsonVars, `[{"key":"region","value":"eu-central-1"}]`)
+
+	if err := run(context.Background(), []string{"rerun"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := store.snapshot()[0].Value; got != "eu-central-1" {
+		t.Errorf("region = %q, want the updated value", got)
+	}
+	body := stub.requestBodies("POST", "/api/v2/runs")
+	if len(body) != 1 || !strings.Contains(body[0], `"configuration-version":{"data":{"type":"configuration-versions","id":"cv-0"}}`) {
+		t.Errorf("run created with %v, want configuration version cv-0", body)
+	}
+	if n := stub.count("GET", "/api/v2/workspaces/ws-1/configuration-versions"); n != 0 {
+		t.Errorf("configuration versions listed %d times, want none", n)
+	}
+	got := outputs()
+	if got["previous-run-id"] != "run-0" || got["run-id"] != "run-1" {
+		t.Errorf("previous-run-id, run-id = %q, %q, want run-0, run-1", got["previous-run-id"], got["run-id"])
+	}
+}
+
+func TestRunRerunRequiresCurrentRun(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+
+	err := run(context.Background(), []string{"rerun"})
+	if err == nil || !strings.Contains(err.Error(), `workspace "ws" has no current run to rerun`) {
+		t.Fatalf("error = %v, want the missing current run", err)
+	}
+	if n := stub.count("POST", "/api/v2/runs"); n != 0 {
+		t.Errorf("runs created = %d, want none", n)
+	}
+}
+
+func TestFindConfigurationByRef(t *testing.T) {
+	cvDoc := func(id, sha, tag string) (string, string) {
+		return fmt.Sprintf(`{"id":%q,"type":"configuration-versions","attributes":{"status":"uploaded"},"relationships":{"ingress-attributes":{"data":{"id":"ia-%[1]s","type":"ingress-attributes"}}}}`, id),
+			fmt.Sprintf(`{"id":"ia-%s","type":"ingress-attributes","attributes":{"commit-sha":%q,"tag":%q}}`, id, sha, tag)
+	}
+	page := func(number, total int, cvs ...[2]string) string {
+		var data, included []string
+		for _, cv := range cvs {
+			data = append(data, cv[0])
+			included = append(included, cv[1])
+		}
+		next := "null"
+		if number < total {
+			next = fmt.Sprint(number + 1)
+		}
+		return fmt.Sprintf(`{"data":[%s],"included":[%s],"meta":{"pagination":{"current-page":%d,"next-page":%s,"total-pages":%d}}}`,
+			strings.Join(data, ","), strings.Join(included, ","), number, next, total)
+	}
+	pair := func(id, sha, tag string) [2]string {
+		d, i := cvDoc(id, sha, tag)
+		return [2]string{d, i}
+	}
+	first := page(1, 2, pair("cv-3", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", ""), pair("cv-2", "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "v1.2.0"))
+	second := page(2, 2, pair("cv-1", "cccc1234cccccccccccccccccccccccccccccccc", ""))
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{name: "full commit SHA on a later page", ref: "cccc1234cccccccccccccccccccccccccccccccc", want: "cv-1"},
+		{name: "commit SHA prefix", ref: "bbbbbbb", want: "cv-2"},
+		{name: "tag", ref: "v1.2.0", want: "cv-2"},
+		{name: "prefix too short", ref: "cccc12", wantErr: `no configuration version of the workspace matches configuration-ref "cccc12"`},
+		{name: "no match", ref: "dddddddd", wantErr: `no configuration version of the workspace matches configuration-ref "dddddddd"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.handle("GET", "/api/v2/workspaces/ws-1/configuration-versions", func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("include") != "ingress_attributes" {
+					t.Errorf("listing includes %q, want ingress_attributes", r.URL.Query().Get("include"))
+				}
+				if r.URL.Query().Get("page[number]") == "2" {
+					writeJSONAPI(w, http.StatusOK, second)
+					return
+				}
+				writeJSONAPI(w, http.StatusOK, first)
+			})
+
+			cv, err := findConfigurationByRef(context.Background(), client, "ws-1", tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cv.ID != tt.want {
+				t.Errorf("configuration version = %s, want %s", cv.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunUploadsFirstConfiguration(t *testing.T) {
+	tests := []struct {
+		name    string
+		dir     bool
+		wantErr string
+	}{
+		{name: "uploaded from directory", dir: true},
+		{name: "no directory", wantErr: `workspace "ws" has no configuration version`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.reply("GET", "/api/v2/workspaces/ws-1/configuration-versions", http.StatusOK, listDoc())
+			stub.serveUpload()
+			outputs := captureOutputs(t)
+			dir := ""
+			if tt.dir {
+				dir = t.TempDir()
+				if err := os.WriteFile(filepath.Join(dir, "main.tf"), []byte(`resource "null_resource" "a" {}`), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setInput(t, &directory, dir)
+
+			err := run(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if n := stub.count("POST", "/api/v2/runs"); n != 0 {
+					t.Errorf("runs created = %d, want none", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got := uploadedFiles(t, stub); len(got) != 1 || got[0] != "main.tf" {
+				t.Errorf("uploaded files = %v, want main.tf", got)
+			}
+			stub.mu.Lock()
+			calls := slices.Clone(stub.calls)
+			stub.mu.Unlock()
+			upload, created := slices.Index(calls, "PUT /upload/cv-2"), slices.Index(calls, "POST /api/v2/runs")
+			if upload < 0 || created < upload {
+				t.Errorf("calls = %v, want the configuration uploaded before the run is created", calls)
+			}
+			if body := stub.requestBodies("POST", "/api/v2/runs"); !strings.Contains(body[0], `"configuration-version":{"data":{"type":"configuration-versions","id":"cv-2"}}`) {
+				t.Errorf("run created with %s, want configuration version cv-2", body[0])
+			}
+			if got := outputs()["configuration-version-id"]; got != "cv-2" {
+				t.Errorf("configuration-version-id = %q, want cv-2", got)
+			}
+		})
+	}
+}
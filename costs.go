@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// readCostEstimate returns the finished cost estimate of the run, or nil
+// when the run has none, as happens when the organization does not enable
+// cost estimation
+func readCostEstimate(ctx context.Context, client *tfe.Client, runID string) (*tfe.CostEstimate, error) {
+	r, err := client.Runs.ReadWithOptions(ctx, runID, &tfe.RunReadOptions{
+		Include: []tfe.RunIncludeOpt{tfe.RunCostEstimate},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cost estimate of run %q: %w", runID, err)
+	}
+	if r.CostEstimate == nil || r.CostEstimate.ID == "" {
+		return nil, nil
+	}
+	if r.CostEstimate.Status != tfe.CostEstimateFinished {
+		logWarn("cost estimate of run %q is %s: %s", runID, r.CostEstimate.Status, r.CostEstimate.ErrorMessage)
+		return nil, nil
+	}
+	return r.CostEstimate, nil
+}
+
+// checkCostEstimation warns when the organization does not run cost
+// estimates, which the API only allows to enable organization-wide
+func checkCostEstimation(ctx context.Context, client *tfe.Client) {
+	org, err := client.Organizations.Read(ctx, organization)
+	if err != nil {
+		logWarn("could not check whether cost estimation is enabled: %v", err)
+		return
+	}
+	if !org.CostEstimationEnabled {
+		logWarn("cost estimation is not enabled for organization %q, no estimate will be available", organization)
+	}
+}
+
+// writeCostEstimate writes the cost estimate outputs of the run
+func writeCostEstimate(ctx context.Context, client *tfe.Client, runID string) error {
+	estimate, err := readCostEstimate(ctx, client, runID)
+	if err != nil {
+		return err
+	}
+	if estimate == nil {
+		logInfo("No cost estimate available for run %q", runID)
+		return nil
+	}
+	logInfo("Estimated monthly cost: %s (delta %s)", estimate.ProposedMonthlyCost, estimate.DeltaMonthlyCost)
+
+	outputFile := outputPath()
+	if outputFile == "" {
+		return nil
+	}
+	for key, value := range map[string]string{
+		"cost-estimate-proposed": estimate.ProposedMonthlyCost,
+		"cost-estimate-prior":    estimate.PriorMonthlyCost,
+		"cost-estimate-delta":    estimate.DeltaMonthlyCost,
+	} {
+		appendToFile(outputFile, key, value)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestWriteCostEstimate(t *testing.T) {
+	const estimated = `{
+		"data":{"id":"run-1","type":"runs","relationships":{"cost-estimate":{"data":{"id":"ce-1","type":"cost-estimates"}}}},
+		"included":[{"id":"ce-1","type":"cost-estimates","attributes":{"status":"%s",
+			"proposed-monthly-cost":"120.50","prior-monthly-cost":"100.00","delta-monthly-cost":"20.50"}}]}`
+
+	tests := []struct {
+		name string
+		doc  string
+		want map[string]string
+	}{
+		{
+			name: "finished estimate",
+			doc:  fmt.Sprintf(estimated, tfe.CostEstimateFinished),
+			want: map[string]string{"cost-estimate-proposed": "120.50", "cost-estimate-prior": "100.00", "cost-estimate-delta": "20.50"},
+		},
+		{name: "errored estimate", doc: fmt.Sprintf(estimated, tfe.CostEstimateErrored), want: map[string]string{}},
+		{name: "cost estimation disabled", doc: `{"data":{"id":"run-1","type":"runs"}}`, want: map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK, tt.doc)
+			outputs := captureOutputs(t)
+
+			if err := writeCostEstimate(context.Background(), client, "run-1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := outputs()
+			if len(got) != len(tt.want) {
+				t.Errorf("outputs = %v, want %v", got, tt.want)
+			}
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s = %q, want %q", key, got[key], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// diagnosticsLogLines is how many trailing log lines are kept per phase
+const diagnosticsLogLines = 50
+
+type diagnosticsVar struct {
+	Key       string `json:"key"`
+	Category  string `json:"category"`
+	Value     string `json:"value,omitempty"`
+	HCL       bool   `json:"hcl"`
+	Sensitive bool   `json:"sensitive"`
+}
+
+type diagnostics struct {
+	Error      string           `json:"error"`
+	Time       time.Time        `json:"time"`
+	Workspace  string           `json:"workspace"`
+	RunID      string           `json:"run_id,omitempty"`
+	RunStatus  string           `json:"run_status,omitempty"`
+	PlanLogs   []string         `json:"plan_logs,omitempty"`
+	ApplyLogs  []string         `json:"apply_logs,omitempty"`
+	Variables  []diagnosticsVar `json:"variables,omitempty"`
+	Collection []string         `json:"collection_errors,omitempty"`
+}
+
+// tailLines scans to the end, keeping its last n lines. Structured log lines
+// are reduced to their message
+func tailLines(sc *bufio.Scanner, n int) ([]string, error) {
+	var lines []string
+	for sc.Scan() {
+		lines = append(lines, logMessage(sc.Text()))
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	return lines, sc.Err()
+}
+
+// writeDiagnostics collects the run status, the last log lines and the
+// current variable state into diagnostics-file for post-mortem analysis.
+// Collection is best-effort: whatever can be read is written, and the action
+// error is always returned unchanged by the caller
+func writeDiagnostics(ctx context.Context, client *tfe.Client, w *tfe.Workspace, runID string, runErr error, timeout time.Duration) {
+	// The action context may already be canceled, which is one of the
+	// failures worth diagnosing
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	d := diagnostics{
+		Error:     runErr.Error(),
+		Time:      time.Now().UTC(),
+		Workspace: w.Name,
+		RunID:     runID,
+	}
+	collectionErr := func(what string, err error) {
+		d.Collection = append(d.Collection, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	if runID != "" {
+		r, err := client.Runs.ReadWithOptions(ctx, runID, &tfe.RunReadOptions{
+			Include: []tfe.RunIncludeOpt{tfe.RunPlan, tfe.RunApply},
+		})
+		if err != nil {
+			collectionErr("run", err)
+		} else {
+			d.RunStatus = string(r.Status)
+			if r.Plan != nil {
+				if logs, err := client.Plans.Logs(ctx, r.Plan.ID); err != nil {
+					collectionErr("plan logs", err)
+				} else if d.PlanLogs, err = tailLines(bufio.NewScanner(logs), diagnosticsLogLines); err != nil {
+					collectionErr("plan logs", err)
+				}
+			}
+			if r.Apply != nil && r.Apply.ID != "" {
+				if logs, err := client.Applies.Logs(ctx, r.Apply.ID); err != nil {
+					collectionErr("apply logs", err)
+				} else if d.ApplyLogs, err = tailLines(bufio.NewScanner(logs), diagnosticsLogLines); err != nil {
+					collectionErr("apply logs", err)
+				}
+			}
+		}
+	}
+
+	vars, err := listVariables(ctx, client, w.ID)
+	if err != nil {
+		collectionErr("variables", err)
+	}
+	for _, v := range vars {
+		dv := diagnosticsVar{Key: v.Key, Category: string(v.Category), HCL: v.HCL, Sensitive: v.Sensitive}
+		// Sensitive values are never returned by the API
+		if !v.Sensitive {
+			dv.Value = v.Value
+		}
+		d.Variables = append(d.Variables, dv)
+	}
+
+	content, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		logWarn("could not encode diagnostics: %v", err)
+		return
+	}
+	if err := os.WriteFile(diagFile, append(content, '\n'), 0644); err != nil {
+		logWarn("could not write diagnostics file: %v", err)
+		return
+	}
+	logInfo("Diagnostics written to %s", diagFile)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestRunWritesDiagnosticsOnTimeout(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	// The run never finishes planning
+	stub.serveRun(tfe.RunPlanning)
+	stub.serveVariables("ws-1",
+		fakeVariable{ID: "var-1", Key: "region", Value: "eu-west-1", Category: "terraform"},
+		fakeVariable{ID: "var-2", Key: "token", Value: "s3cret", Category: "env", Sensitive: true},
+	)
+	file := filepath.Join(t.TempDir(), "diagnostics.json")
+	setInput(t, &diagFile, file)
+	setInput(t, &wait, "true")
+	setInput(t, &jsonVars, `[{"key":"region","value":"eu-west-1"}]`)
+	prev := maximumTimeout
+	maximumTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { maximumTimeout = prev })
+
+	err := run(context.Background(), nil)
+	if !errors.Is(err, errRunTimedOut) {
+		t.Fatalf("error = %v, want %v", err, errRunTimedOut)
+	}
+
+	data, readErr := os.ReadFile(file)
+	if readErr != nil {
+		t.Fatalf("diagnostics file not written: %v", readErr)
+	}
+	var d diagnostics
+	if err := json.Unmarshal(data, &d); err != nil {
+		t.Fatalf("invalid diagnostics: %v", err)
+	}
+	if !strings.Contains(d.Error, "run timed out") || d.RunID != "run-1" || d.RunStatus != "planning" || d.Workspace != "ws" {
+		t.Errorf("diagnostics = %+v, want the timed out run-1 still planning", d)
+	}
+	want := []diagnosticsVar{
+		{Key: "region", Category: "terraform", Value: "eu-west-1"},
+		{Key: "token", Category: "env", Sensitive: true},
+	}
+	if !slices.Equal(d.Variables, want) {
+		t.Errorf("variables = %+v, want %+v", d.Variables, want)
+	}
+}
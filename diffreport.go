@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// variableDiff renders the changes json-vars makes to the workspace
+// variables as a unified-diff-style report, one hunk per variable. Sensitive
+// values are redacted, unchanged variables are left out
+func variableDiff(ctx context.Context, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) (string, error) {
+	existingVars, err := cache.list(ctx, w.ID)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- %s (current)\n+++ %s (json-vars)\n", w.Name, w.Name)
+	hunk := func(category tfe.CategoryType, key string, before, after *string) {
+		fmt.Fprintf(&b, "@@ %s/%s @@\n", category, key)
+		if before != nil {
+			fmt.Fprintf(&b, "-%s = %s\n", key, *before)
+		}
+		if after != nil {
+			fmt.Fprintf(&b, "+%s = %s\n", key, *after)
+		}
+	}
+
+	ignored := ignoredUpdates()
+	for _, v := range vars {
+		ev := findVariable(existingVars, v)
+		if ev != nil && ignored[v.Key] {
+			continue
+		}
+		if descOnly == "true" {
+			if ev != nil && v.Description != nil && *v.Description != ev.Description {
+				before, after := fmt.Sprintf("description %q", ev.Description), fmt.Sprintf("description %q", *v.Description)
+				hunk(ev.Category, v.Key, &before, &after)
+			}
+			continue
+		}
+
+		after := varValue(v)
+		if isSensitive(v) {
+			after = redactedValue
+		}
+		if ev == nil {
+			hunk(varCategory(v), v.Key, nil, &after)
+			continue
+		}
+		before := ev.Value
+		if ev.Sensitive {
+			before = redactedValue
+		}
+		// A sensitive value cannot be compared, it is always shown as changed
+		if before == after && !ev.Sensitive {
+			continue
+		}
+		hunk(ev.Category, v.Key, &before, &after)
+	}
+
+	if prune == "true" {
+		stale, _ := staleVariables(existingVars, vars)
+		for _, ev := range stale {
+			before := ev.Value
+			if ev.Sensitive {
+				before = redactedValue
+			}
+			hunk(ev.Category, ev.Key, &before, nil)
+		}
+	}
+	return b.String(), nil
+}
+
+// writeVariableDiff writes the report produced by variableDiff to diff-file
+func writeVariableDiff(filename, report string) error {
+	if err := os.WriteFile(filename, []byte(report), 0644); err != nil {
+		return fmt.Errorf("could not write diff-file: %w", err)
+	}
+	return nil
+}
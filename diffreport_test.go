@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunWritesDiffFile(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.serveVariables("ws-1",
+		fakeVariable{ID: "var-1", Key: "same", Value: "1", Category: "terraform"},
+		fakeVariable{ID: "var-2", Key: "changed", Value: "old", Category: "terraform"},
+		fakeVariable{ID: "var-3", Key: "secret", Value: "plain", Category: "terraform"},
+		fakeVariable{ID: "var-4", Key: "stale", Value: "gone", Category: "terraform"},
+	)
+	filename := filepath.Join(t.TempDir(), "vars.diff")
+	setInput(t, &diffFile, filename)
+	setInput(t, &prune, "true")
+	setInput(t, &jsonVars, `[
+		{"key":"same","value":"1"},
+		{"key":"changed","value":"new"},
+		{"key":"secret","value":"hunter2","sensitive":true},
+		{"key":"added","value":"2"}
+	]`)
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	report, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("could not read diff-file: %v", err)
+	}
+	const want = `--- ws (current)
++++ ws (json-vars)
+@@ terraform/changed @@
+-changed = old
++changed = new
+@@ terraform/secret @@
+-secret = plain
++secret = (sensitive)
+@@ terraform/added @@
++added = 2
+@@ terraform/stale @@
+-stale = gone
+`
+	if string(report) != want {
+		t.Errorf("diff-file =\n%s\nwant\n%s", report, want)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// driftedResources lists the addresses of the resources Terraform found
+// changed outside of Terraform while planning. They are reported under
+// resource_drift of the plan JSON, apart from the planned resource_changes.
+// Drift that leaves the resource untouched is not listed
+func driftedResources(ctx context.Context, client *tfe.Client, planID string) ([]string, error) {
+	planJSON, err := client.Plans.ReadJSONOutput(ctx, planID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read plan JSON of %q: %w", planID, err)
+	}
+	var doc struct {
+		ResourceDrift []struct {
+			Address string `json:"address"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_drift"`
+	}
+	if err := json.Unmarshal(planJSON, &doc); err != nil {
+		return nil, fmt.Errorf("unable to decode plan JSON of %q: %w", planID, err)
+	}
+	addresses := []string{}
+	for _, rd := range doc.ResourceDrift {
+		if len(rd.Change.Actions) == 1 && rd.Change.Actions[0] == "no-op" {
+			continue
+		}
+		addresses = append(addresses, rd.Address)
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// writeDriftResources writes the drift-resources output of the plan
+func writeDriftResources(ctx context.Context, client *tfe.Client, planID string) error {
+	addresses, err := driftedResources(ctx, client, planID)
+	if err != nil {
+		return err
+	}
+	if len(addresses) > 0 {
+		logInfo("Resources changed outside of Terraform: %d", len(addresses))
+	}
+	if outputFile := outputPath(); outputFile != "" {
+		data, _ := json.Marshal(addresses)
+		appendMultilineToFile(outputFile, "drift-resources", string(data))
+	}
+	return nil
+}
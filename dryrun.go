@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// previewDryRun logs and outputs the variable changes a dry-run would make
+func previewDryRun(ctx context.Context, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) error {
+	changes, err := previewVariables(ctx, cache, w, vars)
+	if err != nil {
+		return err
+	}
+	for _, key := range changes.Create {
+		logVariable("Would create variable %q", key)
+	}
+	for _, key := range changes.Update {
+		logVariable("Would update variable %q", key)
+	}
+	for _, key := range changes.Delete {
+		logVariable("Would delete variable %q", key)
+	}
+	logInfo("Dry run, variables are left unchanged: %d to create, %d to update, %d to delete", len(changes.Create), len(changes.Update), len(changes.Delete))
+
+	if outputFile := outputPath(); outputFile != "" {
+		data, _ := json.Marshal(changes)
+		appendMultilineToFile(outputFile, "variable-changes", string(data))
+	}
+	return nil
+}
+
+// dryRunVariables passes the terraform variables of json-vars to the
+// speculative plan as run variables, so that the plan reflects them although
+// the workspace is not updated. Environment and sensitive variables cannot
+// be passed this way and the plan uses their current workspace values.
+// Entries overridden by run-vars are left out
+func dryRunVariables(vars []workspaceVar, runVars []runVar) []*tfe.RunVariable {
+	overridden := map[string]bool{}
+	for _, v := range runVars {
+		overridden[v.Key] = true
+	}
+
+	var ret []*tfe.RunVariable
+	var skipped []string
+	for _, v := range vars {
+		if overridden[v.Key] {
+			continue
+		}
+		if varCategory(v) != tfe.CategoryTerraform || isSensitive(v) {
+			skipped = append(skipped, v.Key)
+			continue
+		}
+		// Run variables are HCL expressions: the value the sync would store
+		// is passed as is when stored as HCL, as a string literal otherwise
+		value := varValue(v)
+		if !isHCL(v) {
+			value = quoteHCL(value)
+		}
+		ret = append(ret, &tfe.RunVariable{Key: v.Key, Value: value})
+	}
+	if len(skipped) > 0 {
+		logWarn("the speculative plan uses the current workspace values of environment and sensitive variables %q", skipped)
+	}
+	return ret
+}
+
+// writePlanSummary writes the resource counts of the plan of the run
+func writePlanSummary(ctx context.Context, client *tfe.Client, r *tfe.Run) error {
+	if r.Plan == nil {
+		return nil
+	}
+	plan, err := client.Plans.Read(ctx, r.Plan.ID)
+	if err != nil {
+		return fmt.Errorf("unable to read plan %q: %w", r.Plan.ID, err)
+	}
+	counts := changeCounts{plan.ResourceAdditions, plan.ResourceChanges, plan.ResourceDestructions}
+	if plan.HasChanges && counts == (changeCounts{}) {
+		// The counts are missing, read them from the plan logs instead
+		logs, err := client.Plans.Logs(ctx, plan.ID)
+		if err != nil {
+			return fmt.Errorf("unable to read logs of plan %q: %w", plan.ID, err)
+		}
+		if parsed, ok, err := parseChangeCounts(bufio.NewScanner(logs)); err != nil {
+			return fmt.Errorf("unable to read logs of plan %q: %w", plan.ID, err)
+		} else if ok {
+			counts = parsed
+		}
+	}
+	logInfo("Plan: %d to add, %d to change, %d to destroy", counts.add, counts.change, counts.destroy)
+
+	outputFile := outputPath()
+	if outputFile == "" {
+		return nil
+	}
+	for _, o := range []struct {
+		key   string
+		count int
+	}{
+		{"plan-additions", counts.add},
+		{"plan-changes", counts.change},
+		{"plan-destructions", counts.destroy},
+	} {
+		appendToFile(outputFile, o.key, fmt.Sprintf("%d", o.count))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestDryRunVariables(t *testing.T) {
+	decode := func(s string) interface{} {
+		dec := json.NewDecoder(strings.NewReader(s))
+		dec.UseNumber()
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			t.Fatalf("could not decode %s: %v", s, err)
+		}
+		return v
+	}
+	yes, no := true, false
+	raw := "raw"
+	env := "env"
+
+	tests := []struct {
+		name  string
+		style string
+		v     workspaceVar
+		want  string
+	}{
+		{name: "string", v: workspaceVar{Key: "k", Value: "web"}, want: `"web"`},
+		{name: "literal template sequence", v: workspaceVar{Key: "k", Value: "${var.x}", HCL: &no}, want: `"$${var.x}"`},
+		{name: "string detected as HCL", v: workspaceVar{Key: "k", Value: "[1,2]"}, want: `[1,2]`},
+		{name: "HCL string", v: workspaceVar{Key: "k", Value: `{ a = 1 }`, HCL: &yes}, want: `{ a = 1 }`},
+		{name: "hcl false keeps the brackets literal", v: workspaceVar{Key: "k", Value: "[1,2]", HCL: &no}, want: `"[1,2]"`},
+		{name: "number", v: workspaceVar{Key: "k", Value: decode(`3`)}, want: `"3"`},
+		{name: "map", v: workspaceVar{Key: "k", Value: decode(`{"a":"b"}`)}, want: `{ a = "b" }`},
+		{name: "map with json style", style: "json", v: workspaceVar{Key: "k", Value: decode(`{"a":"b"}`)}, want: `{"a":"b"}`},
+		{name: "raw map is a JSON string", v: workspaceVar{Key: "k", Value: decode(`{"a":"b"}`), Format: &raw}, want: `"{\"a\":\"b\"}"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &hclMapStyle, tt.style)
+			got := dryRunVariables([]workspaceVar{tt.v}, nil)
+			if len(got) != 1 {
+				t.Fatalf("got %d run variables, want 1", len(got))
+			}
+			if got[0].Value != tt.want {
+				t.Errorf("value = %s, want %s", got[0].Value, tt.want)
+			}
+		})
+	}
+
+	t.Run("skipped", func(t *testing.T) {
+		vars := []workspaceVar{
+			{Key: "ENV", Value: "x", Category: &env},
+			{Key: "secret", Value: "x", Sensitive: &yes},
+			{Key: "overridden", Value: "x"},
+		}
+		if got := dryRunVariables(vars, []runVar{{Key: "overridden", Value: "y"}}); len(got) != 0 {
+			t.Errorf("got %d run variables, want none", len(got))
+		}
+	})
+}
+
+func TestRunDryRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		wait      string
+		wantPlans map[string]string
+	}{
+		{name: "without waiting", wantPlans: map[string]string{}},
+		{
+			name:      "waiting for the plan",
+			wait:      "true",
+			wantPlans: map[string]string{"plan-additions": "2", "plan-changes": "1", "plan-destructions": "0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveRun(tfe.RunPlannedAndFinished)
+			stub.reply("GET", "/api/v2/plans/plan-1", http.StatusOK,
+				`{"data":{"id":"plan-1","type":"plans","attributes":{"has-changes":true,"resource-additions":2,"resource-changes":1,"resource-destructions":0}}}`)
+			store := stub.serveVariables("ws-1",
+				fakeVariable{ID: "var-1", Key: "region", Value: "us-east-1", Category: "terraform"},
+				fakeVariable{ID: "var-2", Key: "legacy", Value: "x", Category: "terraform"},
+			)
+			outputs := captureOutputs(t)
+			setInput(t, &dryRun, "true")
+			setInput(t, &prune, "true")
+			setInput(t, &wait, tt.wait)
+			setInput(t, &jsonVars, `[{"key":"region","value":"eu-west-1"},{"key":"replicas","value":"3"}]`)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			for _, call := range []string{"POST", "PATCH", "DELETE"} {
+				for _, v := range store.snapshot() {
+					if n := stub.count(call, "/api/v2/workspaces/ws-1/vars/"+v.ID); n != 0 {
+						t.Errorf("%s %s = %d, want no variable writes", call, v.ID, n)
+					}
+				}
+			}
+			if n := stub.count("POST", "/api/v2/workspaces/ws-1/vars"); n != 0 {
+				t.Errorf("variables created = %d, want none", n)
+			}
+			body := createdRun(t, stub)
+			if body["plan-only"] != true {
+				t.Errorf("run created with plan-only %v, want a speculative plan only", body["plan-only"])
+			}
+			variables, _ := body["variables"].([]any)
+			if len(variables) != 2 {
+				t.Errorf("run variables = %v, want region and replicas", variables)
+			}
+
+			got := outputs()
+			if want := `{"create":["replicas"],"update":["region"],"delete":["legacy"]}`; got["variable-changes"] != want {
+				t.Errorf("variable-changes = %s, want %s", got["variable-changes"], want)
+			}
+			for _, key := range []string{"plan-additions", "plan-changes", "plan-destructions"} {
+				if value, written := got[key]; written != (tt.wantPlans[key] != "") || value != tt.wantPlans[key] {
+					t.Errorf("%s = %q (written %t), want %q", key, value, written, tt.wantPlans[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// Stages of the action recorded in error-file, in the order they are reached
+const (
+	stageInputs    = "inputs"
+	stageWorkspace = "workspace"
+	stageUpload    = "upload"
+	stageVariables = "variables"
+	stageRun       = "run"
+	stageWait      = "wait"
+	stageOutputs   = "outputs"
+)
+
+// failureReport is the content of error-file
+type failureReport struct {
+	// Type classifies the error: interrupted, timeout, unauthorized,
+	// not-found or error
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	RunID   string `json:"run_id,omitempty"`
+	Stage   string `json:"stage"`
+}
+
+// errorType classifies err for failureReport
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "interrupted"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errRunTimedOut):
+		return "timeout"
+	case errors.Is(err, tfe.ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, tfe.ErrResourceNotFound):
+		return "not-found"
+	}
+	return "error"
+}
+
+// writeErrorFile stores a failureReport of err in filename so orchestrators
+// can handle failures without parsing the logs
+func writeErrorFile(filename string, err error, stage, runID string) {
+	data, _ := json.MarshalIndent(failureReport{
+		Type:    errorType(err),
+		Message: err.Error(),
+		RunID:   runID,
+		Stage:   stage,
+	}, "", "  ")
+	if err := os.WriteFile(filename, append(data, '\n'), 0644); err != nil {
+		logWarn("could not write error file: %v", err)
+	}
+}
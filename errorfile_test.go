@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("%w waiting for %q to finish", errRunTimedOut, "run-1"), "timeout"},
+		{fmt.Errorf("%w waiting for %q to be queued", errRunTimedOut, "run-1"), "timeout"},
+		{fmt.Errorf("could not read run: %w", context.DeadlineExceeded), "timeout"},
+		{fmt.Errorf("could not read run: %w", context.Canceled), "interrupted"},
+		{fmt.Errorf("could not read workspace: %w", tfe.ErrUnauthorized), "unauthorized"},
+		{fmt.Errorf("could not read workspace: %w", tfe.ErrResourceNotFound), "not-found"},
+		{errors.New("run errored"), "error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := errorType(tt.err); got != tt.want {
+				t.Errorf("errorType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteErrorFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "error.json")
+	writeErrorFile(file, fmt.Errorf("%w waiting for %q to finish", errRunTimedOut, "run-1"), stageWait, "run-1")
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("could not read error file: %v", err)
+	}
+	var report map[string]string
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("invalid error file %s: %v", data, err)
+	}
+	want := map[string]string{
+		"type":    "timeout",
+		"message": `run timed out waiting for "run-1" to finish`,
+		"run_id":  "run-1",
+		"stage":   "wait",
+	}
+	for key, value := range want {
+		if report[key] != value {
+			t.Errorf("%s = %q, want %q", key, report[key], value)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// varsFingerprint hashes the variables declared in json-vars into a value
+// that only changes when they do: entries are sorted by category and key, so
+// the payload order does not matter. Sensitive variables only contribute
+// their key, their values never leave the runner, not even hashed. The
+// ignore-updates and provenance inputs are hashed along, as they change what
+// a sync of the same variables writes
+func varsFingerprint(vars []workspaceVar) string {
+	type entry struct {
+		Category    string  `json:"c"`
+		Key         string  `json:"k"`
+		Value       string  `json:"v,omitempty"`
+		Description *string `json:"d,omitempty"`
+		HCL         *bool   `json:"h,omitempty"`
+		Sensitive   bool    `json:"s,omitempty"`
+	}
+	entries := make([]entry, 0, len(vars))
+	for _, v := range vars {
+		e := entry{Category: string(varCategory(v)), Key: v.Key, Description: v.Description, HCL: v.HCL, Sensitive: isSensitive(v)}
+		if !e.Sensitive {
+			e.Value = varValue(v)
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Category != entries[j].Category {
+			return entries[i].Category < entries[j].Category
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	ignored := splitList(ignoredKeys)
+	sort.Strings(ignored)
+	data, _ := json.Marshal(struct {
+		Vars       []entry  `json:"vars"`
+		Ignored    []string `json:"ignored,omitempty"`
+		Provenance bool     `json:"provenance,omitempty"`
+	}{entries, ignored, provenance == "true"})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// skipBlocker returns why the sync must run even though the variables match
+// previous-fingerprint, or "" if it may be skipped. The fingerprint cannot
+// tell a changed sensitive value, and prune and descriptions-only change
+// what a sync does to the same variables
+func skipBlocker(vars []workspaceVar) string {
+	switch {
+	case prune == "true":
+		return "prune is set"
+	case descOnly == "true":
+		return "descriptions-only is set"
+	}
+	for _, v := range vars {
+		if isSensitive(v) {
+			return fmt.Sprintf("sensitive variable %q may have changed", v.Key)
+		}
+	}
+	return ""
+}
+
+// skipSync reports whether the variable sync is skipped because the
+// variables still have previous-fingerprint
+func skipSync(vars []workspaceVar, fingerprint string) bool {
+	if prevFP == "" || prevFP != fingerprint {
+		return false
+	}
+	if reason := skipBlocker(vars); reason != "" {
+		logInfo("Variables match previous-fingerprint, syncing them anyway as %s", reason)
+		return false
+	}
+	// Assumes nobody changed the variables on the workspace since
+	logInfo("Variables match previous-fingerprint, skipping the variable sync")
+	return true
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestVarsFingerprint(t *testing.T) {
+	yes := true
+	env := "env"
+	desc := "documented"
+	base := []workspaceVar{{Key: "a", Value: "1"}, {Key: "b", Value: "2", Category: &env}}
+
+	tests := []struct {
+		name     string
+		vars     []workspaceVar
+		ignored  string
+		wantSame bool
+	}{
+		{name: "same variables", vars: []workspaceVar{{Key: "a", Value: "1"}, {Key: "b", Value: "2", Category: &env}}, wantSame: true},
+		{name: "payload order", vars: []workspaceVar{{Key: "b", Value: "2", Category: &env}, {Key: "a", Value: "1"}}, wantSame: true},
+		{name: "value", vars: []workspaceVar{{Key: "a", Value: "changed"}, {Key: "b", Value: "2", Category: &env}}},
+		{name: "category", vars: []workspaceVar{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}},
+		{name: "description", vars: []workspaceVar{{Key: "a", Value: "1", Description: &desc}, {Key: "b", Value: "2", Category: &env}}},
+		{name: "hcl", vars: []workspaceVar{{Key: "a", Value: "1", HCL: &yes}, {Key: "b", Value: "2", Category: &env}}},
+		{name: "ignore-updates", vars: base, ignored: "a"},
+	}
+	want := varsFingerprint(base)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &ignoredKeys, tt.ignored)
+			if got := varsFingerprint(tt.vars); (got == want) != tt.wantSame {
+				t.Errorf("fingerprint %s, base %s, want same = %t", got, want, tt.wantSame)
+			}
+		})
+	}
+
+	t.Run("sensitive values are not hashed", func(t *testing.T) {
+		a := varsFingerprint([]workspaceVar{{Key: "a", Value: "secret", Sensitive: &yes}})
+		b := varsFingerprint([]workspaceVar{{Key: "a", Value: "other", Sensitive: &yes}})
+		if a != b {
+			t.Error("the fingerprint depends on a sensitive value")
+		}
+	})
+}
+
+func TestSkipSync(t *testing.T) {
+	yes := true
+	plain := []workspaceVar{{Key: "a", Value: "1"}}
+	secret := []workspaceVar{{Key: "a", Value: "1"}, {Key: "token", Value: "s3cr3t", Sensitive: &yes}}
+
+	tests := []struct {
+		name     string
+		vars     []workspaceVar
+		previous string
+		prune    string
+		descOnly string
+		want     bool
+	}{
+		{name: "matching fingerprint", vars: plain, previous: varsFingerprint(plain), want: true},
+		{name: "no previous fingerprint", vars: plain},
+		{name: "changed variables", vars: plain, previous: varsFingerprint(secret)},
+		{name: "sensitive variable", vars: secret, previous: varsFingerprint(secret)},
+		{name: "prune", vars: plain, previous: varsFingerprint(plain), prune: "true"},
+		{name: "descriptions-only", vars: plain, previous: varsFingerprint(plain), descOnly: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &prevFP, tt.previous)
+			setInput(t, &prune, tt.prune)
+			setInput(t, &descOnly, tt.descOnly)
+			if got := skipSync(tt.vars, varsFingerprint(tt.vars)); got != tt.want {
+				t.Errorf("skipSync() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
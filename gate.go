@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// parseMaxCostDelta reads the max-cost-delta input, returning +Inf when it
+// is unset so every estimate is within the limit
+func parseMaxCostDelta() (float64, error) {
+	if maxCostDelta == "" {
+		return math.Inf(1), nil
+	}
+	limit, err := strconv.ParseFloat(maxCostDelta, 64)
+	if err != nil || math.IsNaN(limit) {
+		return 0, fmt.Errorf("invalid max-cost-delta %q: must be a monthly amount such as 25.50", maxCostDelta)
+	}
+	return limit, nil
+}
+
+// policiesPassed reports whether every policy check of the run passed or
+// was overridden, naming the first one that did not
+func policiesPassed(ctx context.Context, client *tfe.Client, runID string) (bool, string, error) {
+	checks, err := client.PolicyChecks.List(ctx, runID, nil)
+	if err != nil {
+		return false, "", fmt.Errorf("unable to list policy checks of run %q: %w", runID, err)
+	}
+	for _, check := range checks.Items {
+		if check.Status != tfe.PolicyPasses && check.Status != tfe.PolicyOverridden {
+			return false, fmt.Sprintf("policy check %q is %s", check.ID, check.Status), nil
+		}
+	}
+	return true, "", nil
+}
+
+// shouldApply decides whether the finished plan of r is worth applying: it
+// must have changes, pass its policy checks and not raise the monthly cost by
+// more than limit. The reason explains a negative answer
+func shouldApply(ctx context.Context, client *tfe.Client, r *tfe.Run, limit float64) (bool, string, error) {
+	if !r.HasChanges {
+		return false, "the plan has no changes", nil
+	}
+
+	passed, reason, err := policiesPassed(ctx, client, r.ID)
+	if err != nil || !passed {
+		return false, reason, err
+	}
+
+	if !math.IsInf(limit, 1) {
+		estimate, err := readCostEstimate(ctx, client, r.ID)
+		if err != nil {
+			return false, "", err
+		}
+		// Without an estimate there is nothing to hold the plan back
+		if estimate != nil {
+			delta, err := strconv.ParseFloat(strings.TrimSpace(estimate.DeltaMonthlyCost), 64)
+			if err != nil {
+				return false, "", fmt.Errorf("invalid cost estimate delta %q of run %q", estimate.DeltaMonthlyCost, r.ID)
+			}
+			if delta > limit {
+				return false, fmt.Sprintf("the monthly cost delta %s exceeds max-cost-delta %s", estimate.DeltaMonthlyCost, maxCostDelta), nil
+			}
+		}
+	}
+
+	return true, "", nil
+}
+
+// writeShouldApply writes the should-apply and should-apply-reason outputs
+// for the finished plan. The plan itself succeeded, so a failure to evaluate
+// it only warns and answers false
+func writeShouldApply(ctx context.Context, client *tfe.Client, r *tfe.Run, limit float64) {
+	ok, reason, err := shouldApply(ctx, client, r, limit)
+	switch {
+	case err != nil:
+		logWarn("could not decide whether the plan should be applied: %v", err)
+		ok, reason = false, fmt.Sprintf("the plan could not be evaluated: %v", err)
+	case ok:
+		logInfo("The plan should be applied")
+	default:
+		logInfo("The plan does not need to be applied: %s", reason)
+	}
+	if outputFile := outputPath(); outputFile != "" {
+		appendToFile(outputFile, "should-apply", strconv.FormatBool(ok))
+		appendToFile(outputFile, "should-apply-reason", strings.ReplaceAll(reason, "\n", " "))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestWriteShouldApply(t *testing.T) {
+	policyChecks := func(statuses ...tfe.PolicyStatus) string {
+		var checks []string
+		for i, status := range statuses {
+			checks = append(checks, fmt.Sprintf(`{"id":"polchk-%d","type":"policy-checks","attributes":{"status":%q}}`, i+1, status))
+		}
+		return listDoc(checks...)
+	}
+	estimate := func(delta string) string {
+		return `{"data":{"id":"run-1","type":"runs","attributes":{"status":"planned_and_finished"},` +
+			`"relationships":{"cost-estimate":{"data":{"id":"ce-1","type":"cost-estimates"}}}},` +
+			`"included":[{"id":"ce-1","type":"cost-estimates","attributes":{"status":"finished","delta-monthly-cost":"` + delta + `"}}]}`
+	}
+
+	tests := []struct {
+		name       string
+		hasChanges bool
+		policies   string
+		policyCode int
+		estimate   string
+		limit      string
+		want       string
+		wantReason string
+	}{
+		{name: "no changes", policies: policyChecks(), want: "false", wantReason: "the plan has no changes"},
+		{name: "passed", hasChanges: true, policies: policyChecks(tfe.PolicyPasses, tfe.PolicyOverridden), want: "true"},
+		{name: "failed policy", hasChanges: true, policies: policyChecks(tfe.PolicyPasses, tfe.PolicyHardFailed), want: "false", wantReason: `policy check "polchk-2" is hard_failed`},
+		{name: "policy checks unreadable", hasChanges: true, policyCode: http.StatusInternalServerError, want: "false", wantReason: "the plan could not be evaluated"},
+		{name: "within cost limit", hasChanges: true, policies: policyChecks(), estimate: estimate("10.00"), limit: "25", want: "true"},
+		{name: "over cost limit", hasChanges: true, policies: policyChecks(), estimate: estimate("30.00"), limit: "25", want: "false", wantReason: "the monthly cost delta 30.00 exceeds max-cost-delta 25"},
+		{name: "invalid estimate", hasChanges: true, policies: policyChecks(), estimate: estimate("n/a"), limit: "25", want: "false", wantReason: "the plan could not be evaluated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			outputs := captureOutputs(t)
+			code := http.StatusOK
+			if tt.policyCode != 0 {
+				code = tt.policyCode
+			}
+			stub.reply("GET", "/api/v2/runs/run-1/policy-checks", code, tt.policies)
+			if tt.estimate != "" {
+				stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK, tt.estimate)
+			}
+			setInput(t, &maxCostDelta, tt.limit)
+			limit, err := parseMaxCostDelta()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.limit == "" && !math.IsInf(limit, 1) {
+				t.Fatalf("limit = %v, want +Inf", limit)
+			}
+
+			writeShouldApply(context.Background(), client, &tfe.Run{ID: "run-1", HasChanges: tt.hasChanges}, limit)
+
+			got := outputs()
+			if got["should-apply"] != tt.want {
+				t.Errorf("should-apply = %q, want %q", got["should-apply"], tt.want)
+			}
+			if !strings.HasPrefix(got["should-apply-reason"], tt.wantReason) || (tt.wantReason == "") != (got["should-apply-reason"] == "") {
+				t.Errorf("should-apply-reason = %q, want %q", got["should-apply-reason"], tt.wantReason)
+			}
+		})
+	}
+}
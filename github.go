@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// deploymentReview is an entry of the GitHub Actions run approvals API
+type deploymentReview struct {
+	State        string `json:"state"`
+	Comment      string `json:"comment"`
+	Environments []struct {
+		Name string `json:"name"`
+	} `json:"environments"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// githubAPIURL returns the GitHub API base URL, honoring GitHub Enterprise
+// Server runners
+func githubAPIURL() string {
+	if u := os.Getenv("GITHUB_API_URL"); u != "" {
+		return u
+	}
+	return "https://api.github.com"
+}
+
+// readDeploymentReviews lists the deployment reviews of the current workflow
+// run
+func readDeploymentReviews(ctx context.Context, timeout time.Duration) ([]deploymentReview, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("%s/repos/%s/actions/runs/%s/approvals", githubAPIURL(), os.Getenv("GITHUB_REPOSITORY"), os.Getenv("GITHUB_RUN_ID"))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+githubToken)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var reviews []deploymentReview
+	if err := json.NewDecoder(resp.Body).Decode(&reviews); err != nil {
+		return nil, fmt.Errorf("could not decode approvals: %w", err)
+	}
+	return reviews, nil
+}
+
+// waitForDeploymentApproval polls the GitHub deployment reviews of the current
+// workflow run until the environment is approved or rejected
+func waitForDeploymentApproval(ctx context.Context, environment string, timeout time.Duration) error {
+	if os.Getenv("GITHUB_REPOSITORY") == "" || os.Getenv("GITHUB_RUN_ID") == "" {
+		return fmt.Errorf("github-token requires GITHUB_REPOSITORY and GITHUB_RUN_ID to be set")
+	}
+
+	logInfo("Waiting for deployment approval of environment %q", environment)
+	deadline := time.After(maximumTimeout)
+	for {
+		reviews, err := readDeploymentReviews(ctx, timeout)
+		if err != nil {
+			return fmt.Errorf("could not read deployment reviews: %w", err)
+		}
+		for _, review := range reviews {
+			for _, env := range review.Environments {
+				if env.Name != environment {
+					continue
+				}
+				switch review.State {
+				case "approved":
+					logInfo("Deployment of %q approved by %s", environment, review.User.Login)
+					return nil
+				case "rejected":
+					return fmt.Errorf("deployment of %q rejected by %s: %s", environment, review.User.Login, review.Comment)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("timed out waiting for deployment approval of %q", environment)
+		case <-time.After(time.Second * 10):
+		}
+	}
+}
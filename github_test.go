@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForDeploymentApproval(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+		// pending reviews keep polling until the context ends
+		pending bool
+	}{
+		{name: "approved", status: http.StatusOK, body: `[{"state":"approved","environments":[{"name":"production"}],"user":{"login":"octocat"}}]`},
+		{
+			name:    "rejected",
+			status:  http.StatusOK,
+			body:    `[{"state":"rejected","comment":"not today","environments":[{"name":"production"}],"user":{"login":"octocat"}}]`,
+			wantErr: "deployment of \"production\" rejected by octocat: not today",
+		},
+		{name: "other environment approved", status: http.StatusOK, body: `[{"state":"approved","environments":[{"name":"staging"}]}]`, pending: true},
+		{name: "no review yet", status: http.StatusOK, body: `[]`, pending: true},
+		{name: "API error", status: http.StatusUnauthorized, body: `{}`, wantErr: "unexpected status 401"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotPath, gotAuth string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath, gotAuth = r.URL.Path, r.Header.Get("Authorization")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+			t.Setenv("GITHUB_API_URL", server.URL)
+			t.Setenv("GITHUB_REPOSITORY", "octo/repo")
+			t.Setenv("GITHUB_RUN_ID", "42")
+			setInput(t, &githubToken, "ghs_token")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			err := waitForDeploymentApproval(ctx, "production", time.Second)
+			switch {
+			case tt.pending:
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("error = %v, want to still be waiting", err)
+				}
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if gotPath != "/repos/octo/repo/actions/runs/42/approvals" {
+				t.Errorf("path = %q", gotPath)
+			}
+			if gotAuth != "Bearer ghs_token" {
+				t.Errorf("Authorization = %q", gotAuth)
+			}
+		})
+	}
+
+	t.Run("outside of GitHub Actions", func(t *testing.T) {
+		t.Setenv("GITHUB_REPOSITORY", "")
+		err := waitForDeploymentApproval(context.Background(), "production", time.Second)
+		if err == nil || !strings.Contains(err.Error(), "GITHUB_REPOSITORY and GITHUB_RUN_ID") {
+			t.Fatalf("error = %v, want the missing environment reported", err)
+		}
+	})
+}
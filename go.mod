@@ -2,7 +2,11 @@ module github.com/awasilyev/terraform-cloud-action
 
 go 1.24
 
-require github.com/hashicorp/go-tfe v1.91.1
+require (
+	github.com/hashicorp/go-tfe v1.91.1
+	github.com/hashicorp/go-version v1.7.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+)
 
 require (
 	github.com/google/go-cmp v0.6.0 // indirect
@@ -10,7 +14,6 @@ require (
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/hashicorp/go-retryablehttp v0.7.8 // indirect
 	github.com/hashicorp/go-slug v0.16.7 // indirect
-	github.com/hashicorp/go-version v1.7.0 // indirect
 	github.com/hashicorp/jsonapi v1.4.3-0.20250220162346-81a76b606f3e // indirect
 	golang.org/x/sync v0.16.0 // indirect
 	golang.org/x/sys v0.35.0 // indirect
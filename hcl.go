@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// hclIdentifier matches object keys HCL accepts unquoted
+var hclIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// encodeHCLValue serializes a map or list from json-vars as an HCL
+// expression, either in native HCL syntax or, with the json hcl-map-style,
+// as what jsonencode would produce. Both parse to the same value, template
+// sequences in strings are escaped either way
+func encodeHCLValue(value interface{}, style string) string {
+	if style == "json" {
+		b, _ := json.Marshal(value)
+		return escapeTemplates(jsonEscapesToHCL(string(b)))
+	}
+	var b strings.Builder
+	writeNativeHCL(&b, value)
+	return b.String()
+}
+
+// varValue serializes the value of a json-vars entry. Its format overrides
+// hcl-map-style for maps and lists, raw storing them as the plain JSON
+// document, for string variables decoded with jsondecode
+func varValue(v workspaceVar) string {
+	style := hclMapStyle
+	if v.Format != nil {
+		style = *v.Format
+	}
+	switch v.Value.(type) {
+	case map[string]interface{}, []interface{}:
+		if style == "raw" {
+			b, _ := json.Marshal(v.Value)
+			return string(b)
+		}
+		return encodeHCLValue(v.Value, style)
+	}
+	return convertValueToString(v.Value)
+}
+
+func writeNativeHCL(b *strings.Builder, value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("{")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			b.WriteString(" ")
+			if hclIdentifier.MatchString(k) {
+				b.WriteString(k)
+			} else {
+				b.WriteString(quoteHCL(k))
+			}
+			b.WriteString(" = ")
+			writeNativeHCL(b, v[k])
+		}
+		if len(keys) > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString("}")
+	case []interface{}:
+		b.WriteString("[")
+		for i, item := range v {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeNativeHCL(b, item)
+		}
+		b.WriteString("]")
+	case string:
+		b.WriteString(quoteHCL(v))
+	case json.Number:
+		b.WriteString(v.String())
+	case float64:
+		b.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case nil:
+		b.WriteString("null")
+	default:
+		fmt.Fprintf(b, "%v", v)
+	}
+}
+
+// quoteHCL quotes a string literal, escaping template sequences so that the
+// value is stored verbatim. Only the escapes HCL knows are used: strconv.Quote
+// would emit \a or \x00, which HCL rejects
+func quoteHCL(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return escapeTemplates(b.String())
+}
+
+// jsonEscapesToHCL rewrites the \b and \f escapes of encoding/json, which HCL
+// does not know, as \u escapes. The other JSON escapes are valid HCL
+func jsonEscapesToHCL(s string) string {
+	if !strings.Contains(s, `\b`) && !strings.Contains(s, `\f`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'b':
+			b.WriteString(`\u0008`)
+		case 'f':
+			b.WriteString(`\u000c`)
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func escapeTemplates(s string) string {
+	s = strings.ReplaceAll(s, "${", "$${")
+	return strings.ReplaceAll(s, "%{", "%%{")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// decodeJSON decodes a json-vars value the way parseVars does
+func decodeJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("could not decode %s: %v", s, err)
+	}
+	return v
+}
+
+func TestEncodeHCLValue(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		wantNative string
+		wantJSON   string
+	}{
+		{
+			name:       "map",
+			value:      `{"name":"web","port":8080,"tags":{"team":"infra"}}`,
+			wantNative: `{ name = "web", port = 8080, tags = { team = "infra" } }`,
+			wantJSON:   `{"name":"web","port":8080,"tags":{"team":"infra"}}`,
+		},
+		{
+			name:       "list",
+			value:      `["a", 1, true, null]`,
+			wantNative: `["a", 1, true, null]`,
+			wantJSON:   `["a",1,true,null]`,
+		},
+		{
+			name:       "keys that are not identifiers are quoted",
+			value:      `{"a.b":1,"1st":2,"ok-key":3}`,
+			wantNative: `{ "1st" = 2, "a.b" = 1, ok-key = 3 }`,
+			wantJSON:   `{"1st":2,"a.b":1,"ok-key":3}`,
+		},
+		{
+			name:       "template sequences are escaped",
+			value:      `{"greeting":"${var.name} %{if}"}`,
+			wantNative: `{ greeting = "$${var.name} %%{if}" }`,
+			wantJSON:   `{"greeting":"$${var.name} %%{if}"}`,
+		},
+		{
+			name:       "control characters use HCL escapes",
+			value:      `{"s":"a\tb\nc\r\"d\\e\u0000\u0007\b\f\u001b"}`,
+			wantNative: `{ s = "a\tb\nc\r\"d\\e\u0000\u0007\u0008\u000c\u001b" }`,
+			wantJSON:   `{"s":"a\tb\nc\r\"d\\e\u0000\u0007\u0008\u000c\u001b"}`,
+		},
+		{
+			name:       "empty map",
+			value:      `{}`,
+			wantNative: `{}`,
+			wantJSON:   `{}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value := decodeJSON(t, tt.value)
+			if got := encodeHCLValue(value, "native"); got != tt.wantNative {
+				t.Errorf("native = %s, want %s", got, tt.wantNative)
+			}
+			if got := encodeHCLValue(value, ""); got != tt.wantNative {
+				t.Errorf("default = %s, want the native %s", got, tt.wantNative)
+			}
+			if got := encodeHCLValue(value, "json"); got != tt.wantJSON {
+				t.Errorf("json = %s, want %s", got, tt.wantJSON)
+			}
+		})
+	}
+}
+
+func TestVarValueFormat(t *testing.T) {
+	native, asJSON, raw := "native", "json", "raw"
+	const value = `{"port":8080,"tags":["a","b"]}`
+
+	tests := []struct {
+		name    string
+		style   string
+		format  *string
+		value   string
+		want    string
+		wantHCL bool
+	}{
+		{name: "global native", value: value, want: `{ port = 8080, tags = ["a", "b"] }`, wantHCL: true},
+		{name: "global json", style: "json", value: value, want: `{"port":8080,"tags":["a","b"]}`, wantHCL: true},
+		{name: "native overrides json", style: "json", format: &native, value: value, want: `{ port = 8080, tags = ["a", "b"] }`, wantHCL: true},
+		{name: "json overrides native", style: "native", format: &asJSON, value: value, want: `{"port":8080,"tags":["a","b"]}`, wantHCL: true},
+		{name: "raw is a plain string", format: &raw, value: value, want: `{"port":8080,"tags":["a","b"]}`, wantHCL: false},
+		{name: "raw keeps template sequences", format: &raw, value: `{"a":"${x}"}`, want: `{"a":"${x}"}`, wantHCL: false},
+		{name: "format does not apply to scalars", format: &asJSON, value: `"web"`, want: "web", wantHCL: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &hclMapStyle, tt.style)
+			v := workspaceVar{Key: "k", Value: decodeJSON(t, tt.value), Format: tt.format}
+			if got := varValue(v); got != tt.want {
+				t.Errorf("varValue() = %s, want %s", got, tt.want)
+			}
+			if got := isHCL(v); got != tt.wantHCL {
+				t.Errorf("isHCL() = %t, want %t", got, tt.wantHCL)
+			}
+		})
+	}
+}
+
+func TestQuoteHCL(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "plain", want: `"plain"`},
+		{value: "tab\tnewline\ncr\r", want: `"tab\tnewline\ncr\r"`},
+		{value: `quote " backslash \`, want: `"quote \" backslash \\"`},
+		{value: "bell\a nul\x00 esc\x1b del\x7f", want: `"bell\u0007 nul\u0000 esc\u001b del\u007f"`},
+		{value: "unicode é ✓", want: `"unicode é ✓"`},
+		{value: "${var.x} %{if}", want: `"$${var.x} %%{if}"`},
+	}
+	for _, tt := range tests {
+		if got := quoteHCL(tt.value); got != tt.want {
+			t.Errorf("quoteHCL(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// redactedInputs are the inputs holding credentials, never logged. The
+// webhook-url of chat services embeds its token in the path
+var redactedInputs = map[string]bool{
+	"tfe-token":               true,
+	"github-token":            true,
+	"webhook-secret":          true,
+	"webhook-url":             true,
+	"json-vars-authorization": true,
+}
+
+// summarizedInputs may embed sensitive variable values, only their size is
+// logged
+var summarizedInputs = map[string]bool{
+	"json-vars": true,
+	"run-vars":  true,
+}
+
+// effectiveInputs lists the non-empty inputs the action received, defaults
+// of action.yml included, as name=value lines sorted by name
+func effectiveInputs() []string {
+	var lines []string
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, "INPUT_") || value == "" {
+			continue
+		}
+		input := strings.ToLower(strings.TrimPrefix(name, "INPUT_"))
+		switch {
+		case redactedInputs[input]:
+			value = redactedValue
+		case summarizedInputs[input] && !isRemoteVars(value):
+			value = fmt.Sprintf("(%d bytes)", len(value))
+		default:
+			value = stripURLCredentials(value)
+		}
+		lines = append(lines, input+"="+value)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// stripURLCredentials drops the userinfo, query and fragment of an http or
+// https URL, where credentials such as the signature of a presigned json-vars
+// address live. Any other value is returned as is
+func stripURLCredentials(value string) string {
+	u, err := neturl.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return value
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// logEffectiveInputs logs the inputs at the debug level, with credentials
+// redacted, to explain why the action behaves as it does
+func logEffectiveInputs() {
+	if logThreshold < levelDebug {
+		return
+	}
+	logDebug("Effective inputs:")
+	for _, line := range effectiveInputs() {
+		logDebug("  %s", line)
+	}
+}
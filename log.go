@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// logLevel orders progress messages by importance, lower is more important
+type logLevel int
+
+const (
+	levelError logLevel = iota
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+// logThreshold is the least important level that is printed. The error that
+// fails the action is always printed, whatever the level
+var logThreshold = levelInfo
+
+// logOutput receives the progress messages and workflow commands. The
+// plan-json command moves them to stderr, keeping stdout for the plan
+var logOutput io.Writer = os.Stdout
+
+// parseLogLevel parses the log-level input, defaulting to info
+func parseLogLevel(value string) (logLevel, error) {
+	switch value {
+	case "error":
+		return levelError, nil
+	case "warn":
+		return levelWarn, nil
+	case "", "info":
+		return levelInfo, nil
+	case "debug":
+		return levelDebug, nil
+	}
+	return 0, fmt.Errorf("invalid log-level %q, expected one of error, warn, info, debug", value)
+}
+
+func logf(level logLevel, format string, args ...interface{}) {
+	if level > logThreshold {
+		return
+	}
+	fmt.Fprintf(logOutput, format+"\n", args...)
+}
+
+func logWarn(format string, args ...interface{}) {
+	logf(levelWarn, "Warning: "+format, args...)
+}
+
+func logInfo(format string, args ...interface{}) {
+	logf(levelInfo, format, args...)
+}
+
+func logDebug(format string, args ...interface{}) {
+	logf(levelDebug, format, args...)
+}
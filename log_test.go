@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunLogLevel(t *testing.T) {
+	const (
+		debug = "Effective inputs:"
+		info  = "terraform-cloud-action "
+		warn  = `Warning: json-vars declares terraform variable "a" more than once`
+	)
+	tests := []struct {
+		level  string
+		want   []string
+		absent []string
+	}{
+		{level: "debug", want: []string{debug, info, warn}},
+		{level: "", want: []string{info, warn}, absent: []string{debug}},
+		{level: "warn", want: []string{warn}, absent: []string{debug, info}},
+		{level: "error", absent: []string{debug, info, warn}},
+	}
+	for _, tt := range tests {
+		t.Run("level "+tt.level, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveVariables("ws-1")
+			setInput(t, &jsonVars, `[{"key":"a","value":"1"},{"key":"a","value":"2"}]`)
+			setInput(t, &logLevelIn, tt.level)
+			prev := logThreshold
+			t.Cleanup(func() { logThreshold = prev })
+
+			var err error
+			stdout := captureStdout(t, func() { err = run(context.Background(), nil) })
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("log misses %q:\n%s", want, stdout)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(stdout, absent) {
+					t.Errorf("log contains %q:\n%s", absent, stdout)
+				}
+			}
+		})
+	}
+}
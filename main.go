@@ -3,13 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/hashicorp/go-tfe"
+	"github.com/hashicorp/go-version"
 )
 
 var (
@@ -20,9 +24,124 @@ var (
 	message      = os.Getenv("INPUT_MESSAGE")
 	url          = os.Getenv("INPUT_URL")
 	wait         = os.Getenv("INPUT_WAIT")
+	planOnly     = os.Getenv("INPUT_PLAN-ONLY")
+	savePlan     = os.Getenv("INPUT_SAVE-PLAN")
+	planName     = os.Getenv("INPUT_PLAN-NAME")
+	onExisting   = os.Getenv("INPUT_ON-EXISTING-RUN")
+	stateOutputs = os.Getenv("INPUT_STATE-OUTPUTS")
+	inclSecrets  = os.Getenv("INPUT_INCLUDE-SENSITIVE-OUTPUTS")
+	runVarsJSON  = os.Getenv("INPUT_RUN-VARS")
+	varsAuth     = os.Getenv("INPUT_JSON-VARS-AUTHORIZATION")
+	apiTimeout   = os.Getenv("INPUT_API-TIMEOUT")
+	httpTimeout  = os.Getenv("INPUT_HTTP-TIMEOUT")
+	secretsFile  = os.Getenv("INPUT_SECRETS-FILE")
+	varsSummary  = os.Getenv("INPUT_SUMMARIZE-VARS")
+	dryRun       = os.Getenv("INPUT_DRY-RUN")
+	outputsFrom  = os.Getenv("INPUT_OUTPUTS-FROM")
+	pollInterval = os.Getenv("INPUT_POLL-INTERVAL")
+	pollMax      = os.Getenv("INPUT_POLL-MAX-INTERVAL")
+	pollFactor   = os.Getenv("INPUT_POLL-BACKOFF")
+	preflight    = os.Getenv("INPUT_PREFLIGHT-PERMISSIONS")
+	maxVarsSize  = os.Getenv("INPUT_MAX-VARS-SIZE")
+	transaction  = os.Getenv("INPUT_TRANSACTIONAL")
+	waitStage    = os.Getenv("INPUT_WAIT-STAGE")
+	diffFile     = os.Getenv("INPUT_DIFF-FILE")
+	runTFVersion = os.Getenv("INPUT_RUN-TERRAFORM-VERSION")
+	annotate     = os.Getenv("INPUT_ANNOTATE-ERRORS")
+	requireVars  = os.Getenv("INPUT_REQUIRE-VARS")
+	cvRef        = os.Getenv("INPUT_CONFIGURATION-REF")
+	webhookURL   = os.Getenv("INPUT_WEBHOOK-URL")
+	webhookKey   = os.Getenv("INPUT_WEBHOOK-SECRET")
+	ignoredKeys  = os.Getenv("INPUT_IGNORE-UPDATES")
+	traceVars    = os.Getenv("INPUT_RUN-VARIABLES-OUTPUT")
+	planHashOut  = os.Getenv("INPUT_PLAN-HASH")
+	expectedHash = os.Getenv("INPUT_EXPECTED-PLAN-HASH")
+	skipNoOp     = os.Getenv("INPUT_SKIP-NO-OP")
+	hclMapStyle  = os.Getenv("INPUT_HCL-MAP-STYLE")
+	applyDelay   = os.Getenv("INPUT_APPLY-DELAY")
+	varSets      = os.Getenv("INPUT_VARIABLE-SETS")
+	varSetsExcl  = os.Getenv("INPUT_VARIABLE-SETS-EXCLUSIVE")
+	maxCostDelta = os.Getenv("INPUT_MAX-COST-DELTA")
+	urlTemplate  = os.Getenv("INPUT_URL-TEMPLATE")
+	concurrency  = os.Getenv("INPUT_CONCURRENCY")
+	adaptiveConc = os.Getenv("INPUT_ADAPTIVE-CONCURRENCY")
+	minConc      = os.Getenv("INPUT_MIN-CONCURRENCY")
+	deadline     = os.Getenv("INPUT_DEADLINE")
+	wsPrefix     = os.Getenv("INPUT_WORKSPACE-PREFIX")
+	wsSuffix     = os.Getenv("INPUT_WORKSPACE-SUFFIX")
+	errorFile    = os.Getenv("INPUT_ERROR-FILE")
+	requireRes   = os.Getenv("INPUT_REQUIRE-RESOURCE")
+	provenance   = os.Getenv("INPUT_PROVENANCE")
+	noSensHCL    = os.Getenv("INPUT_FORBID-SENSITIVE-HCL")
+	prevFP       = os.Getenv("INPUT_PREVIOUS-FINGERPRINT")
+	driftOut     = os.Getenv("INPUT_DRIFT-RESOURCES")
+	onApplyDeny  = os.Getenv("INPUT_ON-APPLY-DENIED")
+	dotenvFile   = os.Getenv("INPUT_DOTENV-FILE")
+	vcsRepo      = os.Getenv("INPUT_VCS-REPO")
+	vcsBranch    = os.Getenv("INPUT_VCS-BRANCH")
+	vcsOAuth     = os.Getenv("INPUT_VCS-OAUTH-TOKEN-ID")
+	queueGrace   = os.Getenv("INPUT_QUEUE-GRACE")
+	recreateSens = os.Getenv("INPUT_RECREATE-ON-SENSITIVITY-CHANGE")
+	minAPIVer    = os.Getenv("INPUT_MIN-API-VERSION")
+	retryLimit   = os.Getenv("INPUT_RETRY-BUDGET")
+	descOnly     = os.Getenv("INPUT_DESCRIPTIONS-ONLY")
+	prune        = os.Getenv("INPUT_PRUNE")
+	maxPrune     = os.Getenv("INPUT_MAX-PRUNE")
+	noPruneSens  = os.Getenv("INPUT_NEVER-PRUNE-SENSITIVE")
+	statusMsgs   = os.Getenv("INPUT_STATUS-MESSAGES")
+	genConfig    = os.Getenv("INPUT_GENERATE-CONFIG")
+	varsSchema   = os.Getenv("INPUT_VARS-SCHEMA")
+	inlinePlan   = os.Getenv("INPUT_PLAN-OUTPUT-INLINE")
+	diagFile     = os.Getenv("INPUT_DIAGNOSTICS-FILE")
+	sensOrder    = os.Getenv("INPUT_SENSITIVE-ORDER")
+	strictVars   = os.Getenv("INPUT_STRICT-VARS")
+	metricsFile  = os.Getenv("INPUT_METRICS-FILE")
+	onRunTask    = os.Getenv("INPUT_ON-RUN-TASK")
+	trimValues   = os.Getenv("INPUT_TRIM-VALUES")
+	verifyApply  = os.Getenv("INPUT_VERIFY-APPLY")
+	runCapIn     = os.Getenv("INPUT_RUN-CAPACITY")
+	onDupKey     = os.Getenv("INPUT_ON-DUPLICATE-KEY")
+	apiPrefix    = os.Getenv("INPUT_API-PATH-PREFIX")
+	logLevelIn   = os.Getenv("INPUT_LOG-LEVEL")
+	otherRuns    = os.Getenv("INPUT_OTHER-RUNS")
+	globalState  = os.Getenv("INPUT_GLOBAL-REMOTE-STATE")
+	consumers    = os.Getenv("INPUT_REMOTE-STATE-CONSUMERS")
+	sourceWS     = os.Getenv("INPUT_SOURCE-WORKSPACE")
+	autoApply    = os.Getenv("INPUT_AUTO-APPLY")
+	githubToken  = os.Getenv("INPUT_GITHUB-TOKEN")
+	githubEnv    = os.Getenv("INPUT_GITHUB-ENVIRONMENT")
+	createWS     = os.Getenv("INPUT_CREATE-WORKSPACE")
+	changedPaths = os.Getenv("INPUT_CHANGED-PATHS")
+	trigPaths    = os.Getenv("INPUT_TRIGGER-PATHS")
+	discardedOK  = os.Getenv("INPUT_DISCARDED-IS-SUCCESS")
+	validateKeys = os.Getenv("INPUT_VALIDATE-KEYS")
+	directory    = os.Getenv("INPUT_DIRECTORY")
+	costEstimate = os.Getenv("INPUT_COST-ESTIMATE")
 )
 
-const maximumTimeout = time.Minute * 60
+const defaultAPITimeout = time.Second * 30
+
+// maximumTimeout bounds every wait of the action. It is a variable so that
+// tests can shorten it
+var maximumTimeout = time.Minute * 60
+
+// existingRunPoll is how often on-existing-run wait reads the existing run
+var existingRunPoll = time.Second * 5
+
+// parseDuration parses a duration input, falling back to def when unset
+func parseDuration(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", name, value)
+	}
+	return d, nil
+}
 
 // isVariableNotFoundError checks if the error indicates a variable was not found
 func isVariableNotFoundError(err error) bool {
@@ -43,6 +162,8 @@ func convertValueToString(value interface{}) string {
 	switch v := value.(type) {
 	case string:
 		return v
+	case json.Number:
+		return v.String()
 	case bool:
 		return fmt.Sprintf("%t", v)
 	case int, int8, int16, int32, int64:
@@ -51,6 +172,8 @@ func convertValueToString(value interface{}) string {
 		return fmt.Sprintf("%d", v)
 	case float32, float64:
 		return fmt.Sprintf("%f", v)
+	case map[string]interface{}, []interface{}:
+		return encodeHCLValue(v, hclMapStyle)
 	default:
 		return fmt.Sprintf("%v", v)
 	}
@@ -67,19 +190,199 @@ func containsHCLSyntax(value string) bool {
 		strings.Contains(value, ",")
 }
 
-// appendToFile appends a key-value pair to the GITHUB_OUTPUT file
-func appendToFile(filename, key, value string) error {
-	// Use simple key=value format for single-line outputs
-	content := fmt.Sprintf("%s=%s\n", key, value)
+// isRunFinished reports whether a run has reached a terminal status
+func isRunFinished(status tfe.RunStatus) bool {
+	switch status {
+	case tfe.RunApplied, tfe.RunPlannedAndFinished, tfe.RunPlannedAndSaved,
+		tfe.RunCanceled, tfe.RunDiscarded, tfe.RunErrored:
+		return true
+	}
+	return false
+}
+
+// isRunTaskStatus reports whether a run is gated by run tasks
+func isRunTaskStatus(status tfe.RunStatus) bool {
+	switch status {
+	case tfe.RunPrePlanRunning, tfe.RunPostPlanRunning, tfe.RunPreApplyRunning, tfe.RunPostPlanAwaitingDecision:
+		return true
+	}
+	return false
+}
+
+// pendingRunTasks returns the names of the run tasks the run is waiting on
+func pendingRunTasks(ctx context.Context, client *tfe.Client, runID string) ([]string, error) {
+	stages, err := client.TaskStages.List(ctx, runID, &tfe.TaskStageListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list task stages of run %q: %w", runID, err)
+	}
+
+	var names []string
+	for _, stage := range stages.Items {
+		if stage.Status != tfe.TaskStageRunning && stage.Status != tfe.TaskStagePending && stage.Status != tfe.TaskStageAwaitingOverride {
+			continue
+		}
+		detail, err := client.TaskStages.Read(ctx, stage.ID, &tfe.TaskStageReadOptions{
+			Include: []tfe.TaskStageIncludeOpt{tfe.TaskStageTaskResults},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read task stage %q: %w", stage.ID, err)
+		}
+		for _, result := range detail.TaskResults {
+			// Failed mandatory tasks are what an override is awaited for
+			if result.Status == tfe.TaskPending || result.Status == tfe.TaskRunning ||
+				(stage.Status == tfe.TaskStageAwaitingOverride && result.Status == tfe.TaskFailed) {
+				names = append(names, result.TaskName)
+			}
+		}
+	}
+	return names, nil
+}
+
+// handleExistingRun applies the on-existing-run policy to the workspace's
+// current run, if it is still in progress
+func handleExistingRun(ctx context.Context, client *tfe.Client, w *tfe.Workspace) error {
+	if onExisting == "" || w.CurrentRun == nil {
+		return nil
+	}
+
+	current, err := client.Runs.Read(ctx, w.CurrentRun.ID)
+	if err != nil {
+		return fmt.Errorf("unable to read current run %q: %w", w.CurrentRun.ID, err)
+	}
+	if isRunFinished(current.Status) {
+		return nil
+	}
+
+	switch onExisting {
+	case "error":
+		return fmt.Errorf("workspace already has run %q in progress (status %s)", current.ID, current.Status)
+	case "cancel-existing":
+		// Only planning and applying runs can be canceled, a run that is
+		// pending or awaits confirmation has to be discarded instead
+		switch {
+		case current.Actions != nil && current.Actions.IsCancelable:
+			logInfo("Canceling existing run %q (status %s)", current.ID, current.Status)
+			err := client.Runs.Cancel(ctx, current.ID, tfe.RunCancelOptions{
+				Comment: tfe.String("Canceled by terraform-cloud-action"),
+			})
+			if err != nil {
+				return fmt.Errorf("unable to cancel existing run %q: %w", current.ID, err)
+			}
+		case current.Actions != nil && current.Actions.IsDiscardable:
+			logInfo("Discarding existing run %q (status %s)", current.ID, current.Status)
+			err := client.Runs.Discard(ctx, current.ID, tfe.RunDiscardOptions{
+				Comment: tfe.String("Discarded by terraform-cloud-action"),
+			})
+			if err != nil {
+				return fmt.Errorf("unable to discard existing run %q: %w", current.ID, err)
+			}
+		default:
+			return fmt.Errorf("existing run %q (status %s) can neither be canceled nor discarded", current.ID, current.Status)
+		}
+		return nil
+	case "wait":
+		runID := current.ID
+		logInfo("Waiting for existing run %q to complete", runID)
+		timeout := time.After(maximumTimeout)
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timeout:
+				return fmt.Errorf("timed out waiting for existing run %q", runID)
+			case <-time.After(existingRunPoll):
+				current, err := client.Runs.Read(ctx, runID)
+				if err != nil {
+					return fmt.Errorf("unable to read current run %q: %w", runID, err)
+				}
+				if isRunFinished(current.Status) {
+					logInfo("Existing run %q finished with status %s", runID, current.Status)
+					return nil
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("invalid on-existing-run value %q, expected one of error, wait, cancel-existing", onExisting)
+	}
+}
+
+// waitForOtherRuns waits for the runs of the workspace that were not created
+// by this action but were queued since ours, such as runs started by
+// upstream workspaces through run triggers
+func waitForOtherRuns(ctx context.Context, client *tfe.Client, workspaceID string, ours *tfe.Run, messages map[tfe.RunStatus]string) error {
+	runs, err := client.Runs.List(ctx, workspaceID, &tfe.RunListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list runs: %w", err)
+	}
+
+	for _, other := range runs.Items {
+		if other.ID == ours.ID || other.CreatedAt.Before(ours.CreatedAt) || isRunFinished(other.Status) {
+			continue
+		}
+		logInfo("Waiting for run %q not created by this action (%s)", other.ID, other.Source)
+		if _, err := waitForRun(ctx, client, other.ID, waitOptions{messages: messages}); err != nil {
+			return fmt.Errorf("run %q not created by this action: %w", other.ID, err)
+		}
+	}
+	return nil
+}
+
+// verifyReadRetries bounds the re-reads verifyCurrentRun makes while the
+// workspace still reports the run as applying
+const verifyReadRetries = 3
 
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// verifyCurrentRun double-checks that the run is still the workspace's
+// current run and reached applied, guarding against a newer run having
+// superseded it while we were waiting. The workspace can lag a moment behind
+// the run, so a run still applying is read again a few times within settle
+func verifyCurrentRun(ctx context.Context, client *tfe.Client, workspaceID, runID string, settle time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		w, err := client.Workspaces.ReadByIDWithOptions(ctx, workspaceID, &tfe.WorkspaceReadOptions{
+			Include: []tfe.WSIncludeOpt{tfe.WSCurrentRun},
+		})
+		if err != nil {
+			return fmt.Errorf("could not read workspace to verify apply: %w", err)
+		}
+		if w.CurrentRun == nil {
+			return fmt.Errorf("could not verify apply: workspace has no current run")
+		}
+		if w.CurrentRun.ID != runID {
+			return fmt.Errorf("run %q was superseded by run %q (status %s)", runID, w.CurrentRun.ID, w.CurrentRun.Status)
+		}
+		if w.CurrentRun.Status == tfe.RunApplied {
+			logInfo("Verified run %q is the workspace's current applied run", runID)
+			return nil
+		}
+		if !isApplyInProgress(w.CurrentRun.Status) || attempt == verifyReadRetries {
+			return fmt.Errorf("could not verify apply: current run %q has status %s", runID, w.CurrentRun.Status)
+		}
+		logDebug("Current run %q is still %s, reading it again", runID, w.CurrentRun.Status)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(settle / verifyReadRetries):
+		}
+	}
+}
+
+// checkAPIVersion verifies that the API version the server declared when the
+// client pinged it is at least minimum
+func checkAPIVersion(client *tfe.Client, minimum string) error {
+	want, err := version.NewVersion(minimum)
 	if err != nil {
-		return fmt.Errorf("failed to open output file: %w", err)
+		return fmt.Errorf("invalid min-api-version %q: %w", minimum, err)
 	}
-	defer file.Close()
 
-	if _, err := file.WriteString(content); err != nil {
-		return fmt.Errorf("failed to write to output file: %w", err)
+	remote := client.RemoteAPIVersion()
+	if remote == "" {
+		return fmt.Errorf("server at %s did not report an API version, %s or newer is required", url, minimum)
+	}
+	got, err := version.NewVersion(remote)
+	if err != nil {
+		return fmt.Errorf("server at %s reported an unparsable API version %q: %w", url, remote, err)
+	}
+	if got.LessThan(want) {
+		return fmt.Errorf("server at %s supports API version %s, %s or newer is required", url, remote, minimum)
 	}
 
 	return nil
@@ -92,10 +395,16 @@ type workspaceVar struct {
 	HCL         *bool       `json:"hcl"`
 	Sensitive   *bool       `json:"sensitive"`
 	Category    *string     `json:"category"`
+	When        *string     `json:"when"`
+	Format      *string     `json:"format"`
 }
 
+// actionVersion identifies the build, set with -ldflags "-X main.actionVersion=v1.2.3"
+var actionVersion = "dev"
+
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	// Runners stop container actions with SIGTERM, a terminal sends SIGINT
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	if err := run(ctx, os.Args[1:]); err != nil {
@@ -104,231 +413,1012 @@ func main() {
 	}
 }
 
-func parseVars() ([]workspaceVar, error) {
+func parseVars(payload string) ([]workspaceVar, error) {
 	ret := []workspaceVar{}
-	err := json.Unmarshal([]byte(jsonVars), &ret)
+	// An absent json-vars input means no variables, which vars-schema may
+	// still reject, e.g. with minItems
+	if strings.TrimSpace(payload) == "" {
+		if varsSchema != "" {
+			if err := validateVarsSchema("[]", varsSchema); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(payload))
+	// Numbers are kept as written, float64 would round large integers
+	dec.UseNumber()
+	if strictVars == "true" {
+		// Catches typos such as "sensative" that would otherwise be ignored
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&ret); err != nil {
+		return ret, err
+	}
+	if dec.More() {
+		return ret, fmt.Errorf("unexpected data after the list of variables")
+	}
+	if ret == nil {
+		ret = []workspaceVar{}
+	}
+	if varsSchema != "" {
+		if err := validateVarsSchema(payload, varsSchema); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// runVar is a terraform variable that only applies to the run being created
+type runVar struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	HCL   *bool       `json:"hcl"`
+}
+
+func parseRunVars() ([]runVar, error) {
+	ret := []runVar{}
+	if runVarsJSON == "" {
+		return ret, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(runVarsJSON))
+	dec.UseNumber()
+	err := dec.Decode(&ret)
 	return ret, err
 }
 
-func run(ctx context.Context, args []string) error {
-	vars, err := parseVars()
+// runVariableValue renders a run variable as the HCL expression expected by
+// the runs API. Values are encoded like json-vars maps and lists, strings
+// quoted with their template sequences escaped, unless marked as HCL
+func runVariableValue(v runVar) string {
+	if s, ok := v.Value.(string); ok && v.HCL != nil && *v.HCL {
+		return s
+	}
+	return encodeHCLValue(v.Value, hclMapStyle)
+}
+
+func run(ctx context.Context, args []string) (err error) {
+	defer flushOutputs()
+
+	// plan-json waits for a plan-only run and prints its plan JSON, which
+	// is all that reaches stdout so that it can be piped to other tools
+	planJSON := len(args) > 0 && args[0] == "plan-json"
+	if planJSON {
+		logOutput = os.Stderr
+		discardOutputs = true
+		planOnly, wait, waitStage = "true", "true", ""
+	}
+
+	logThreshold, err = parseLogLevel(logLevelIn)
+	if err != nil {
+		return err
+	}
+	logInfo("terraform-cloud-action %s", actionVersion)
+
+	if outputFile := outputPath(); outputFile != "" {
+		appendToFile(outputFile, "action-version", actionVersion)
+	}
+
+	metrics := newActionMetrics()
+	if metricsFile != "" {
+		defer func() { metrics.write(metricsFile, err) }()
+	}
+	defer func() {
+		if outputFile := outputPath(); outputFile != "" {
+			appendToFile(outputFile, "api-calls", fmt.Sprintf("%d", metrics.apiCalls.Load()))
+		}
+	}()
+
+	// runID is set once the run exists, stage as the action progresses
+	var runID string
+	stage := stageInputs
+	if errorFile != "" {
+		defer func() {
+			if err != nil {
+				writeErrorFile(errorFile, err, stage, runID)
+			}
+		}()
+	}
+
+	if deadline != "" {
+		// Named parseErr so that the defer below sees the returned err
+		at, parseErr := time.Parse(time.RFC3339, deadline)
+		if parseErr != nil {
+			return fmt.Errorf("invalid deadline %q: must be an RFC3339 time such as 2024-01-02T15:04:05Z", deadline)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, at)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("deadline %s reached: %w", deadline, err)
+			}
+		}()
+	}
+
+	timeout, err := parseDuration("api-timeout", apiTimeout, defaultAPITimeout)
+	if err != nil {
+		return err
+	}
+	httpTO, err := parseDuration("http-timeout", httpTimeout, 0)
+	if err != nil {
+		return err
+	}
+
+	// Naming conventions such as <service>-<env> are composed here, so
+	// every later use of workspace sees the full name
+	if wsPrefix != "" || wsSuffix != "" {
+		workspace = wsPrefix + workspace + wsSuffix
+		logInfo("Using workspace %q", workspace)
+	}
+	logEffectiveInputs()
+
+	sizeLimit, err := parseMaxVarsSize()
+	if err != nil {
+		return err
+	}
+	payload := jsonVars
+	if isRemoteVars(payload) {
+		payload, err = fetchRemoteVars(ctx, payload, timeout, sizeLimit)
+		if err != nil {
+			return err
+		}
+	} else if int64(len(payload)) > sizeLimit {
+		return fmt.Errorf("json-vars payload is %d bytes, exceeding the %d byte limit of max-vars-size", len(payload), sizeLimit)
+	}
+
+	var budget *retryBudget
+	if retryLimit != "" {
+		limit, err := parseDuration("retry-budget", retryLimit, 0)
+		if err != nil {
+			return err
+		}
+		budget = newRetryBudget(limit)
+	}
+
+	vars, err := parseVars(payload)
 	if err != nil {
 		return fmt.Errorf("could not decode json-vars. Make sure that this is a key-value dictionary of vars to be set: %w", err)
 	}
 
-	// Build client
-	cfg := tfe.DefaultConfig()
-	cfg.Address = url
-	cfg.Token = tfeToken
-	client, err := tfe.NewClient(cfg)
+	vars, err = filterVarsByCondition(vars)
+	if err != nil {
+		return err
+	}
+	if onDupKey != "" && onDupKey != "error" && onDupKey != "keep-last" {
+		return fmt.Errorf("invalid on-duplicate-key %q: must be error or keep-last", onDupKey)
+	}
+	vars, err = dedupeVars(vars, onDupKey)
+	if err != nil {
+		return err
+	}
+	if requireVars == "true" && len(vars) == 0 {
+		return fmt.Errorf("require-vars is set but json-vars holds no variables to apply")
+	}
+
+	if err := resolveSecretRefs(vars, secretsFile); err != nil {
+		return err
+	}
+
+	messages, err := parseStatusMessages()
+	if err != nil {
+		return fmt.Errorf("could not decode status-messages. Make sure that this is a map of run statuses to messages: %w", err)
+	}
+
+	poll, err := parsePollCurve()
+	if err != nil {
+		return err
+	}
+	delay, err := parseDuration("apply-delay", applyDelay, 0)
+	if err != nil {
+		return err
+	}
+	grace, err := parseDuration("queue-grace", queueGrace, 0)
+	if err != nil {
+		return err
+	}
+	// The API only accepts a per-run version for plan-only runs
+	if runTFVersion != "" && planOnly != "true" && dryRun != "true" {
+		return fmt.Errorf("run-terraform-version requires plan-only or dry-run")
+	}
+	if hclMapStyle != "" && hclMapStyle != "native" && hclMapStyle != "json" {
+		return fmt.Errorf("invalid hcl-map-style %q: must be native or json", hclMapStyle)
+	}
+	for _, v := range vars {
+		if v.Format != nil && *v.Format != "native" && *v.Format != "json" && *v.Format != "raw" {
+			return fmt.Errorf("invalid format %q of variable %q: must be native, json or raw", *v.Format, v.Key)
+		}
+	}
+	// The hash can only be enforced when the action confirms the run itself
+	if expectedHash != "" && autoApply != "true" {
+		return fmt.Errorf("expected-plan-hash requires auto-apply")
+	}
+	if requireRes != "" && autoApply != "true" {
+		return fmt.Errorf("require-resource requires auto-apply")
+	}
+	// Without an environment no deployment review could ever match
+	if githubToken != "" && githubEnv == "" {
+		return fmt.Errorf("github-token requires github-environment, the environment whose deployment review gates auto-apply")
+	}
+	// descriptions-only promises to leave everything but descriptions alone
+	if descOnly == "true" && prune == "true" {
+		return fmt.Errorf("prune cannot be combined with descriptions-only, which never deletes variables")
+	}
+	if onApplyDeny != "" && onApplyDeny != "fail" && onApplyDeny != "plan-only" {
+		return fmt.Errorf("invalid on-apply-denied %q: must be fail or plan-only", onApplyDeny)
+	}
+	if urlTemplate != "" && !strings.Contains(urlTemplate, "{run}") {
+		return fmt.Errorf("invalid url-template %q: must contain the {run} placeholder", urlTemplate)
+	}
+	if onRunTask != "" && onRunTask != "wait" && onRunTask != "fail" {
+		return fmt.Errorf("invalid on-run-task %q: must be wait or fail", onRunTask)
+	}
+	if otherRuns != "" && otherRuns != "ignore" && otherRuns != "include" {
+		return fmt.Errorf("invalid other-runs %q: must be ignore or include", otherRuns)
+	}
+	if waitStage != "" && waitStage != "completed" && waitStage != "queued" {
+		return fmt.Errorf("invalid wait-stage %q: must be queued or completed", waitStage)
+	}
+	costLimit, err := parseMaxCostDelta()
+	if err != nil {
+		return err
+	}
+
+	if validateKeys != "false" {
+		if err := validateVarKeys(vars); err != nil {
+			return err
+		}
+	}
+	if noSensHCL == "true" {
+		if err := checkSensitiveHCL(vars); err != nil {
+			return err
+		}
+	}
+
+	if trimValues == "true" {
+		trimVarValues(vars)
+	}
+
+	vars, err = orderVars(vars, sensOrder)
+	if err != nil {
+		return err
+	}
+
+	runVars, err := parseRunVars()
+	if err != nil {
+		return fmt.Errorf("could not decode run-vars. Make sure that this is a list of key-value objects: %w", err)
+	}
+
+	client, err := newClient(metrics, budget, httpTO)
 	if err != nil {
 		return fmt.Errorf("unable to create client: %w", err)
 	}
 
+	// The client pings the server on creation, which records its API version
+	if minAPIVer != "" {
+		if err := checkAPIVersion(client, minAPIVer); err != nil {
+			return err
+		}
+	}
+
+	stage = stageWorkspace
 	// Get the workspace
 	w, err := client.Workspaces.Read(ctx, organization, workspace)
+	created := false
+	if errors.Is(err, tfe.ErrResourceNotFound) && createWS == "true" {
+		w, err = createWorkspace(ctx, client)
+		created = err == nil
+	}
 	if err != nil {
 		return fmt.Errorf("could not read workspace: %w", err)
 	}
+	if outputFile := outputPath(); outputFile != "" {
+		appendToFile(outputFile, "workspace-created", fmt.Sprintf("%t", created))
+	}
 
-	// Update the workspace vars
-	for _, v := range vars {
-		// Check if variable exists by listing variables and searching for the key
-		existingVars, listErr := client.Variables.List(ctx, w.ID, &tfe.VariableListOptions{})
-		if listErr != nil {
-			return fmt.Errorf("could not list variables: %w", listErr)
-		}
-
-		// Search for existing variable with this key and category
-		var existingVar *tfe.Variable
-		for _, ev := range existingVars.Items {
-			if ev.Key == v.Key {
-				// If category is specified, also check category match
-				if v.Category != nil {
-					if ev.Category == tfe.CategoryType(*v.Category) {
-						existingVar = ev
-						break
-					}
-				} else {
-					// If no category specified, match any category
-					existingVar = ev
-					break
-				}
+	// Skip unaffected workspaces before anything is modified
+	if changedPaths != "" {
+		skipped := !isAffected(triggerPaths(w), splitList(changedPaths))
+		if outputFile := outputPath(); outputFile != "" {
+			appendToFile(outputFile, "skipped", fmt.Sprintf("%t", skipped))
+		}
+		if skipped {
+			logInfo("None of the changed paths affect workspace %q, skipping", workspace)
+			return nil
+		}
+	}
+
+	// From here on failures can be diagnosed against the workspace
+	if diagFile != "" {
+		defer func() {
+			if err != nil {
+				writeDiagnostics(ctx, client, w, runID, err, timeout)
 			}
+		}()
+	}
+
+	downgradeToPlanOnly(w)
+
+	if preflight != "false" {
+		command := ""
+		if len(args) > 0 {
+			command = args[0]
+		}
+		if err := checkPermissions(w, command, vars); err != nil {
+			return err
 		}
+	}
 
-		if existingVar == nil {
-			// Variable doesn't exist, create it
+	if costEstimate == "true" {
+		checkCostEstimation(ctx, client)
+	}
 
-			// Convert value to string for TFE
-			valueStr := convertValueToString(v.Value)
+	if runCapIn == "true" {
+		checkRunCapacity(ctx, client)
+	}
 
-			// Detect if this should be treated as HCL (complex values with brackets, braces, etc.)
-			isHCL := false
-			if v.HCL != nil {
-				isHCL = *v.HCL
-			} else {
-				// Auto-detect HCL for complex values
-				valueStr := convertValueToString(v.Value)
-				isHCL = containsHCLSyntax(valueStr)
-			}
+	if len(args) > 0 && args[0] == "upload-config" {
+		stage = stageUpload
+		return runUploadConfig(ctx, client, w)
+	}
 
-			// Set default values for all fields (matching the test pattern)
-			hcl := isHCL
-			sensitive := false
-			if v.Sensitive != nil {
-				sensitive = *v.Sensitive
-			}
+	// A dry-run only creates a speculative plan, which neither conflicts
+	// with other runs nor should change any workspace setting
+	if dryRun != "true" {
+		if err := handleExistingRun(ctx, client, w); err != nil {
+			return err
+		}
 
-			// Create variable with TFE helper functions
-			createOpts := tfe.VariableCreateOptions{
-				Key:       tfe.String(v.Key),
-				Value:     tfe.String(valueStr),
-				Category:  tfe.Category(tfe.CategoryTerraform), // Default to terraform category
-				HCL:       tfe.Bool(hcl),
-				Sensitive: tfe.Bool(sensitive),
-			}
+		if err := reconcileRemoteState(ctx, client, w); err != nil {
+			return err
+		}
 
-			// Override category if specified
-			if v.Category != nil {
-				createOpts.Category = tfe.Category(tfe.CategoryType(*v.Category))
-			}
+		if err := reconcileVCSRepo(ctx, client, w); err != nil {
+			return err
+		}
 
-			// Add description if provided
-			if v.Description != nil {
-				createOpts.Description = v.Description
-			}
+		if err := reconcileVariableSets(ctx, client, w); err != nil {
+			return err
+		}
+	}
+
+	stage = stageVariables
+	cache := newVariableCache(client)
+	if sourceWS != "" {
+		copied, err := sourceVariables(ctx, client, cache, sourceWS)
+		if err != nil {
+			return err
+		}
+		vars = mergeSourceVars(copied, vars)
+	}
+	fingerprint := varsFingerprint(vars)
+	if !skipSync(vars, fingerprint) {
+		if err := reconcileVariables(ctx, client, cache, w, vars); err != nil {
+			return err
+		}
+	}
+	if outputFile := outputPath(); outputFile != "" {
+		appendToFile(outputFile, "vars-fingerprint", fingerprint)
+	}
 
-			_, err = client.Variables.Create(ctx, w.ID, createOpts)
+	stage = stageRun
 
+	var latestCV *tfe.ConfigurationVersion
+	if len(args) > 0 && args[0] == "rerun" {
+		// Rerun the configuration of the current run with the updated variables
+		previous, prevCV, err := currentRunConfiguration(ctx, client, w)
+		if err != nil {
+			return err
+		}
+		latestCV = prevCV
+		logInfo("Rerunning run %s with configuration version: %s", previous.ID, latestCV.ID)
+		if outputFile := outputPath(); outputFile != "" {
+			appendToFile(outputFile, "previous-run-id", previous.ID)
+		}
+	} else if cvRef != "" {
+		latestCV, err = findConfigurationByRef(ctx, client, w.ID, cvRef)
+		if err != nil {
+			return err
+		}
+		logInfo("Using configuration version %s matching %q", latestCV.ID, cvRef)
+	} else {
+		// Use the latest configuration version instead of creating a new one
+		cv, err := client.ConfigurationVersions.List(ctx, w.ID, &tfe.ConfigurationVersionListOptions{})
+		if err != nil {
+			return fmt.Errorf("unable to list configuration versions: %w", err)
+		}
+		switch {
+		case len(cv.Items) > 0:
+			// Use the most recent configuration version
+			latestCV = cv.Items[0]
+			logInfo("Using existing configuration version: %s", latestCV.ID)
+		case directory != "":
+			// A first run uploads the configuration the later runs reuse
+			logInfo("Workspace %q has no configuration version, uploading %s", w.Name, directory)
+			latestCV, err = uploadConfiguration(ctx, client, w.ID, directory)
 			if err != nil {
-				// Check if the error is due to the variable already existing
-				if err.Error() == "Key has already been taken" {
-					// Variable was created by another process, try to update it instead
-					fmt.Printf("Variable %q already exists, updating instead\n", v.Key)
-					// We need to get the variable ID first since Update requires it
-					updateVars, updateListErr := client.Variables.List(ctx, w.ID, &tfe.VariableListOptions{})
-					if updateListErr != nil {
-						return fmt.Errorf("could not list variables for update: %w", updateListErr)
-					}
-
-					var updateVar *tfe.Variable
-					for _, ev := range updateVars.Items {
-						if ev.Key == v.Key {
-							updateVar = ev
-							break
-						}
-					}
-
-					if updateVar == nil {
-						return fmt.Errorf("variable %q not found for update", v.Key)
-					}
-
-					updateOpts := tfe.VariableUpdateOptions{
-						Value:       &valueStr,
-						Description: v.Description,
-						HCL:         v.HCL,
-						Sensitive:   v.Sensitive,
-					}
-					if v.Category != nil {
-						category := tfe.CategoryType(*v.Category)
-						updateOpts.Category = &category
-					}
-					_, updateErr := client.Variables.Update(ctx, w.ID, updateVar.ID, updateOpts)
-					if updateErr != nil {
-						return fmt.Errorf("could not update variable %q: %w", v.Key, updateErr)
-					}
-					fmt.Printf("Updated variable %q\n", v.Key)
-				} else {
-					return fmt.Errorf("could not create variable %q: %w", v.Key, err)
-				}
-			} else {
-				fmt.Printf("Created variable %q\n", v.Key)
-			}
-		} else {
-			// Variable exists, update it
-			valueStr := convertValueToString(v.Value)
-			updateOpts := tfe.VariableUpdateOptions{
-				Value:       &valueStr,
-				Description: v.Description,
-				HCL:         v.HCL,
-				Sensitive:   v.Sensitive,
+				return err
 			}
-			if v.Category != nil {
-				category := tfe.CategoryType(*v.Category)
-				updateOpts.Category = &category
+			if outputFile := outputPath(); outputFile != "" {
+				appendToFile(outputFile, "configuration-version-id", latestCV.ID)
 			}
-			_, err = client.Variables.Update(ctx, w.ID, existingVar.ID, updateOpts)
-			if err != nil {
-				return fmt.Errorf("could not update variable %q: %w", v.Key, err)
-			}
-			fmt.Printf("Updated variable %q\n", v.Key)
+		default:
+			return fmt.Errorf("workspace %q has no configuration version. Upload one with the upload-config command, or set directory to upload it on the first run", w.Name)
 		}
 	}
 
-	// Use the latest configuration version instead of creating a new one
-	cv, err := client.ConfigurationVersions.List(ctx, w.ID, &tfe.ConfigurationVersionListOptions{})
-	if err != nil {
-		return fmt.Errorf("unable to list configuration versions: %w", err)
+	// A named plan is always a saved plan, the name is carried in the run
+	// message so that it can be told apart from other speculative plans
+	runMessage := message
+	if planName != "" {
+		runMessage = fmt.Sprintf("%s [plan: %s]", message, planName)
 	}
-	if len(cv.Items) == 0 {
-		return fmt.Errorf("no configuration versions found for workspace")
-	}
-	// Use the most recent configuration version
-	latestCV := cv.Items[0]
-	fmt.Printf("Using existing configuration version: %s\n", latestCV.ID)
 
 	// Get a run going!
-	r, err := client.Runs.Create(ctx, tfe.RunCreateOptions{
+	runOpts := tfe.RunCreateOptions{
 		Workspace:            w,
 		ConfigurationVersion: latestCV,
 		Refresh:              tfe.Bool(true),
-		Message:              &message,
-	})
+		Message:              &runMessage,
+	}
+	if planOnly == "true" || dryRun == "true" {
+		runOpts.PlanOnly = tfe.Bool(true)
+	}
+	if savePlan == "true" || planName != "" {
+		runOpts.SavePlan = tfe.Bool(true)
+	}
+	if runTFVersion != "" {
+		runOpts.TerraformVersion = tfe.String(runTFVersion)
+	}
+	if genConfig == "true" {
+		runOpts.AllowConfigGeneration = tfe.Bool(true)
+	}
+	if dryRun == "true" {
+		runOpts.Variables = dryRunVariables(vars, runVars)
+	}
+	// Run variables take precedence over workspace variables for this run
+	// only, nothing is persisted on the workspace
+	for _, v := range runVars {
+		runOpts.Variables = append(runOpts.Variables, &tfe.RunVariable{Key: v.Key, Value: runVariableValue(v)})
+	}
+	r, err := client.Runs.Create(ctx, runOpts)
 	if err != nil {
 		return fmt.Errorf("unable to create run: %w", err)
 	}
-	runURL := fmt.Sprintf("%s/app/%s/workspaces/%s/runs/%s", url, organization, workspace, r.ID)
+	runID = r.ID
+	runURL := formatRunURL(urlTemplate, r.ID)
 	// Write outputs to GITHUB_OUTPUT file for GitHub Actions
-	if outputFile := os.Getenv("GITHUB_OUTPUT"); outputFile != "" {
+	if outputFile := outputPath(); outputFile != "" {
 		// Append run-id output
-		if err := appendToFile(outputFile, "run-id", r.ID); err != nil {
-			fmt.Printf("Warning: could not write run-id output: %v\n", err)
-		}
+		appendToFile(outputFile, "run-id", r.ID)
 		// Append run-url output
-		if err := appendToFile(outputFile, "run-url", runURL); err != nil {
-			fmt.Printf("Warning: could not write run-url output: %v\n", err)
+		appendToFile(outputFile, "run-url", runURL)
+		// Append plan outputs for saved plans
+		if runOpts.SavePlan != nil && r.Plan != nil {
+			appendToFile(outputFile, "plan-id", r.Plan.ID)
+			appendToFile(outputFile, "plan-name", planName)
+		}
+	}
+	logInfo("Run URL: %s", runURL)
+
+	if traceVars == "true" {
+		effective, err := effectiveVariables(ctx, client, w, r.ID)
+		if err != nil {
+			return err
+		}
+		if outputFile := outputPath(); outputFile != "" {
+			data, _ := json.Marshal(effective)
+			appendMultilineToFile(outputFile, "run-variables", string(data))
 		}
 	}
-	fmt.Println("Run URL: " + runURL)
 
+	if wait != "true" || waitStage == "queued" {
+		// Nothing reads the links later
+		writeLogURLs(ctx, client, r)
+	}
 	if wait != "true" {
 		return nil
 	}
-	fmt.Println("Waiting for run to complete")
+	stage = stageWait
+	if waitStage == "queued" {
+		logInfo("Waiting for run to be queued")
+		queued, err := waitForQueued(ctx, client, r.ID, poll)
+		if err != nil {
+			status := failedRunStatus(ctx, err)
+			metrics.status = status
+			writeRunStatus(status)
+			return err
+		}
+		metrics.status = string(queued.Status)
+		writeRunStatus(string(queued.Status))
+		return nil
+	}
+	logInfo("Waiting for run to complete")
+
+	finished, err := waitForRun(ctx, client, r.ID, waitOptions{
+		messages:   messages,
+		autoApply:  autoApply == "true",
+		apiTimeout: timeout,
+		poll:       poll,
+		annotate:   annotate != "false",
+		sourceRoot: annotationRoot(w),
+		applyDelay: delay,
+		queueGrace: grace,
+	})
+	writeLogURLs(ctx, client, r)
+	if webhookURL != "" {
+		notifyWebhook(ctx, client, r.ID, runURL, err, timeout)
+	}
+	if err != nil {
+		// run-id and run-url are already written, record the failure so
+		// that cleanup steps can still act on the run
+		status := failedRunStatus(ctx, err)
+		metrics.status = status
+		writeRunStatus(status)
+		return err
+	}
+	metrics.status = string(finished.Status)
+	writeRunStatus(string(finished.Status))
+	logInfo("run finished successfully")
+	if planJSON {
+		if err := printPlanJSON(ctx, client, finished); err != nil {
+			return err
+		}
+	}
+	stage = stageOutputs
+
+	if verifyApply == "true" && finished.Status == tfe.RunApplied {
+		if err := verifyCurrentRun(ctx, client, w.ID, r.ID, poll.initial); err != nil {
+			return err
+		}
+	}
+
+	if otherRuns == "include" {
+		if err := waitForOtherRuns(ctx, client, w.ID, r, messages); err != nil {
+			return err
+		}
+	}
+
+	if genConfig == "true" && finished.Plan != nil {
+		plan, err := client.Plans.Read(ctx, finished.Plan.ID)
+		if err != nil {
+			return fmt.Errorf("unable to read plan %q: %w", finished.Plan.ID, err)
+		}
+		if outputFile := outputPath(); outputFile != "" {
+			appendToFile(outputFile, "generated-config", fmt.Sprintf("%t", plan.GeneratedConfiguration))
+			// Generated configuration is downloaded from the run page
+			if plan.GeneratedConfiguration {
+				appendToFile(outputFile, "generated-config-url", runURL)
+			}
+		}
+		if plan.GeneratedConfiguration {
+			logInfo("Configuration was generated for imported resources, download it from %s", runURL)
+		}
+	}
+
+	if dryRun == "true" {
+		if err := writePlanSummary(ctx, client, finished); err != nil {
+			return err
+		}
+	}
+
+	// should-apply gates a later apply, which only makes sense for a plan
+	if finished.Status == tfe.RunPlannedAndFinished || finished.Status == tfe.RunPlannedAndSaved {
+		writeShouldApply(ctx, client, finished, costLimit)
+	}
+
+	if costEstimate == "true" {
+		if err := writeCostEstimate(ctx, client, r.ID); err != nil {
+			return err
+		}
+	}
+
+	if planHashOut == "true" && finished.Plan != nil {
+		hash, err := planHash(ctx, client, finished.Plan.ID)
+		if err != nil {
+			return err
+		}
+		logInfo("Plan hash: %s", hash)
+		if outputFile := outputPath(); outputFile != "" {
+			appendToFile(outputFile, "plan-hash", hash)
+		}
+	}
+
+	if driftOut == "true" && finished.Plan != nil {
+		if err := writeDriftResources(ctx, client, finished.Plan.ID); err != nil {
+			return err
+		}
+	}
+
+	if inlinePlan == "true" && finished.Plan != nil {
+		if outputFile := outputPath(); outputFile != "" {
+			if err := writeInlinePlan(ctx, client, finished.Plan.ID, outputFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	if stateOutputs == "true" && finished.Status == tfe.RunApplied {
+		if outputFile := outputPath(); outputFile != "" {
+			source := w
+			if outputsFrom != "" && outputsFrom != w.Name {
+				source, err = client.Workspaces.Read(ctx, organization, outputsFrom)
+				if err != nil {
+					return fmt.Errorf("could not read outputs-from workspace %q: %w", outputsFrom, err)
+				}
+			}
+			if err := writeStateOutputs(ctx, client, source.ID, outputFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// newClient builds the API client. Requests and retries are counted in
+// metrics and, with a budget, retries are charged against it. httpTimeout
+// bounds each HTTP exchange when positive
+func newClient(metrics *actionMetrics, budget *retryBudget, httpTimeout time.Duration) (*tfe.Client, error) {
+	cfg := tfe.DefaultConfig()
+	cfg.Address = url
+	// The client replaces the path of the address with its base paths
+	cfg.BasePath = pathPrefix() + tfe.DefaultBasePath
+	cfg.RegistryBasePath = pathPrefix() + tfe.DefaultRegistryPath
+	cfg.Token = tfeToken
+	cfg.RetryLogHook = func(attemptNum int, resp *http.Response) {
+		metrics.retries.Add(1)
+		if budget != nil && resp != nil {
+			budget.fail(resp.Request)
+		}
+	}
+	if budget != nil {
+		// go-tfe only retries rate limited requests on its own, so once the
+		// budget is spent the error stops the retry loop
+		cfg.HTTPClient = &http.Client{
+			Transport: &budgetTransport{
+				next:   http.DefaultTransport.(*http.Transport).Clone(),
+				budget: budget,
+			},
+		}
+	}
+	if httpTimeout > 0 {
+		// Bounds the whole exchange, including connecting and reading the
+		// body, which the per-call contexts leave open on a stalled connection
+		cfg.HTTPClient.Timeout = httpTimeout
+	}
+	transport := cfg.HTTPClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	cfg.HTTPClient.Transport = &countingTransport{next: transport, count: &metrics.apiCalls}
+	return tfe.NewClient(cfg)
+}
 
+// pathPrefix returns the path the installation is served under, the path of
+// url followed by api-path-prefix, with a leading and no trailing slash, or
+// "" when there is none. The client replaces the path of its address, so a
+// path given in url has to be carried over to the base paths
+func pathPrefix() string {
+	_, path := splitAddress(url)
+	var prefix string
+	for _, p := range []string{path, apiPrefix} {
+		if p = strings.Trim(p, "/"); p != "" {
+			prefix += "/" + p
+		}
+	}
+	return prefix
+}
+
+// splitAddress splits an address such as https://tfe.example.com/tfe into
+// its scheme and host, https://tfe.example.com, and its path, /tfe
+func splitAddress(address string) (origin, path string) {
+	scheme, rest := "", address
+	if i := strings.Index(address, "://"); i >= 0 {
+		scheme, rest = address[:i+3], address[i+3:]
+	}
+	host, path, _ := strings.Cut(rest, "/")
+	return scheme + host, "/" + path
+}
+
+// baseURL returns the address of the installation, the scheme and host of url
+// followed by pathPrefix, so that run URLs and API requests share a path
+func baseURL() string {
+	origin, _ := splitAddress(url)
+	return origin + pathPrefix()
+}
+
+// defaultURLTemplate is the run page of Terraform Cloud and of current
+// Terraform Enterprise releases
+const defaultURLTemplate = "{base}/app/{org}/workspaces/{workspace}/runs/{run}"
+
+// formatRunURL renders the address of the run page from the url-template
+// input, substituting {base}, {org}, {workspace} and {run}
+func formatRunURL(template, runID string) string {
+	if template == "" {
+		template = defaultURLTemplate
+	}
+	return strings.NewReplacer(
+		"{base}", baseURL(),
+		"{org}", organization,
+		"{workspace}", workspace,
+		"{run}", runID,
+	).Replace(template)
+}
+
+// printPlanJSON writes the plan JSON of the finished run to stdout
+func printPlanJSON(ctx context.Context, client *tfe.Client, r *tfe.Run) error {
+	if r.Plan == nil {
+		return fmt.Errorf("run %q has no plan", r.ID)
+	}
+	planJSON, err := client.Plans.ReadJSONOutput(ctx, r.Plan.ID)
+	if err != nil {
+		return fmt.Errorf("could not read plan JSON output: %w", err)
+	}
+	if _, err := os.Stdout.Write(planJSON); err != nil {
+		return fmt.Errorf("could not print plan JSON: %w", err)
+	}
+	return nil
+}
+
+// failedRunStatus is the run-status recorded when waiting for the run
+// failed: interrupted when the action was stopped or reached its deadline,
+// errored otherwise
+func failedRunStatus(ctx context.Context, err error) string {
+	if (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) && ctx.Err() != nil {
+		return "interrupted"
+	}
+	return "errored"
+}
+
+// readOwnRun reads the run created by the action. Polling always goes
+// through its ID, never through the workspace's current run: variable
+// changes can make VCS-driven runs start next to ours and become current
+func readOwnRun(ctx context.Context, client *tfe.Client, runID string) (*tfe.Run, error) {
+	r, err := client.Runs.Read(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find run %q: %w", runID, err)
+	}
+	if r.ID != runID {
+		return nil, fmt.Errorf("read run %q while tracking run %q", r.ID, runID)
+	}
+	return r, nil
+}
+
+// errRunTimedOut is wrapped by the errors of waitForRun and waitForQueued
+// when the run did not get there within the timeout
+var errRunTimedOut = errors.New("run timed out")
+
+// waitForQueued waits until the run leaves the pending status, which means
+// it has been queued or has already started planning
+func waitForQueued(ctx context.Context, client *tfe.Client, runID string, poll pollCurve) (*tfe.Run, error) {
+	timeout := time.After(maximumTimeout)
+	backoff := newPollBackoff(poll)
 	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(maximumTimeout):
-			return fmt.Errorf("run timed out")
-		case <-time.After(time.Second * 5):
-			checkin, err := client.Runs.Read(ctx, r.ID)
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, fmt.Errorf("%w waiting for %q to be queued", errRunTimedOut, runID)
+		case <-time.After(backoff.interval()):
+			checkin, err := readOwnRun(ctx, client, runID)
 			if err != nil {
-				return fmt.Errorf("unable to find run %q: %w", r.ID, err)
+				return nil, err
+			}
+			if checkin.Status != tfe.RunPending {
+				logInfo("Run status: %s", checkin.Status)
+				return checkin, nil
+			}
+		}
+	}
+}
+
+// parseStatusMessages decodes the status-messages mapping of run statuses to
+// display text
+func parseStatusMessages() (map[tfe.RunStatus]string, error) {
+	ret := map[tfe.RunStatus]string{}
+	if statusMsgs == "" {
+		return ret, nil
+	}
+	err := json.Unmarshal([]byte(statusMsgs), &ret)
+	return ret, err
+}
+
+// statusMessage returns the display text for status, falling back to the raw
+// status when it is not mapped
+func statusMessage(messages map[tfe.RunStatus]string, status tfe.RunStatus) string {
+	if msg, ok := messages[status]; ok {
+		return msg
+	}
+	return string(status)
+}
+
+// runUploadConfig implements the upload-config command, which uploads the
+// configuration from directory without creating a run
+func runUploadConfig(ctx context.Context, client *tfe.Client, w *tfe.Workspace) error {
+	if directory == "" {
+		return fmt.Errorf("upload-config requires the directory input")
+	}
+	cv, err := uploadConfiguration(ctx, client, w.ID, directory)
+	if err != nil {
+		return err
+	}
+	if outputFile := outputPath(); outputFile != "" {
+		appendToFile(outputFile, "configuration-version-id", cv.ID)
+	}
+	return nil
+}
+
+// waitOptions controls how waitForRun follows a run
+type waitOptions struct {
+	// messages maps run statuses to the text logged for them
+	messages map[tfe.RunStatus]string
+	// autoApply confirms the run once its plan awaits confirmation
+	autoApply bool
+	// apiTimeout bounds the calls made outside of the TFE client
+	apiTimeout time.Duration
+	// poll is the curve of the intervals between status checks, the
+	// default one is used when unset
+	poll pollCurve
+	// annotate emits GitHub error annotations when the run errors, with
+	// file paths relative to sourceRoot
+	annotate   bool
+	sourceRoot string
+	// applyDelay is waited before confirming the run
+	applyDelay time.Duration
+	// queueGrace extends the timeout once when it hits a queued run
+	queueGrace time.Duration
+}
+
+// confirmRun applies a run awaiting confirmation, first waiting for the
+// GitHub deployment approval when github-token is set. With
+// expected-plan-hash the plan must match the reviewed one
+func confirmRun(ctx context.Context, client *tfe.Client, r *tfe.Run, opts waitOptions) error {
+	runID := r.ID
+	if expectedHash != "" {
+		if err := verifyPlanHash(ctx, client, r); err != nil {
+			return err
+		}
+	}
+	if requireRes != "" {
+		if err := verifyRequiredResource(ctx, client, r); err != nil {
+			return err
+		}
+	}
+	if githubToken != "" {
+		if err := waitForDeploymentApproval(ctx, githubEnv, opts.apiTimeout); err != nil {
+			return err
+		}
+	}
+	if opts.applyDelay > 0 {
+		if err := waitApplyDelay(ctx, runID, opts.applyDelay); err != nil {
+			return err
+		}
+	}
+	err := client.Runs.Apply(ctx, runID, tfe.RunApplyOptions{
+		Comment: tfe.String("Applied by terraform-cloud-action"),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to apply run %q: %w", runID, err)
+	}
+	logInfo("Applying run %q", runID)
+	return nil
+}
+
+// applyDelayLogInterval is how often the remaining apply-delay is logged
+const applyDelayLogInterval = time.Second * 30
+
+// waitApplyDelay waits out apply-delay before the run is confirmed, giving
+// an operator the chance to cancel the workflow or discard the run
+func waitApplyDelay(ctx context.Context, runID string, delay time.Duration) error {
+	deadline := time.Now().Add(delay)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil
+		}
+		logInfo("Applying run %q in %s", runID, remaining.Round(time.Second))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("apply-delay interrupted, run %q was not applied: %w", runID, ctx.Err())
+		case <-time.After(min(remaining, applyDelayLogInterval)):
+		}
+	}
+}
+
+// isRunQueued reports whether the run is waiting in the queue for its plan
+// or apply to start
+func isRunQueued(status tfe.RunStatus) bool {
+	switch status {
+	case tfe.RunPending, tfe.RunPlanQueued, tfe.RunApplyQueued:
+		return true
+	}
+	return false
+}
+
+// isApplyInProgress reports whether the run has been confirmed and is on its
+// way to being applied, so confirming it again would be redundant
+func isApplyInProgress(status tfe.RunStatus) bool {
+	switch status {
+	case tfe.RunConfirmed, tfe.RunApplyQueued, tfe.RunApplying:
+		return true
+	}
+	return false
+}
+
+// waitForRun polls the run until it reaches a terminal status, returning the
+// final run on success. Every status change is logged. The run is read with
+// readOwnRun, so another run becoming current does not change what is watched
+func waitForRun(ctx context.Context, client *tfe.Client, runID string, opts waitOptions) (*tfe.Run, error) {
+	var lastStatus tfe.RunStatus
+	confirmed := false
+	graced := false
+	timeout := time.After(maximumTimeout)
+	backoff := newPollBackoff(opts.poll)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			// A run that has not started yet is held up by the queue
+			// rather than stuck, which queue-grace allows for once
+			if opts.queueGrace > 0 && !graced && isRunQueued(lastStatus) {
+				graced = true
+				logWarn("run %q is still %s, extending the timeout by queue-grace %s", runID, lastStatus, opts.queueGrace)
+				timeout = time.After(opts.queueGrace)
+				continue
+			}
+			return nil, fmt.Errorf("%w waiting for %q to finish", errRunTimedOut, runID)
+		case <-time.After(backoff.interval()):
+			checkin, err := readOwnRun(ctx, client, runID)
+			if err != nil {
+				return nil, err
+			}
+			statusChanged := checkin.Status != lastStatus
+			if statusChanged {
+				logInfo("Run status: %s", statusMessage(opts.messages, checkin.Status))
+				lastStatus = checkin.Status
+				backoff.reset()
+			}
+
+			if isRunTaskStatus(checkin.Status) && (statusChanged || onRunTask == "fail") {
+				tasks, err := pendingRunTasks(ctx, client, runID)
+				if err != nil {
+					return nil, err
+				}
+				if onRunTask == "fail" {
+					return nil, fmt.Errorf("run is waiting on run tasks: %s", strings.Join(tasks, ", "))
+				}
+				logInfo("Waiting on run tasks: %s", strings.Join(tasks, ", "))
+			}
+
+			// A run that is already confirmed, e.g. by a person or by an
+			// earlier poll whose response lagged behind, is applying soon
+			if isApplyInProgress(checkin.Status) {
+				confirmed = true
+			}
+			if opts.autoApply && !confirmed && checkin.Actions != nil && checkin.Actions.IsConfirmable {
+				if err := confirmRun(ctx, client, checkin, opts); err != nil {
+					return nil, err
+				}
+				confirmed = true
 			}
 
 			switch checkin.Status {
-			case tfe.RunApplied, tfe.RunPlannedAndFinished:
-				fmt.Println("run finished successfully")
-				return nil
+			case tfe.RunApplied, tfe.RunPlannedAndFinished, tfe.RunPlannedAndSaved:
+				return checkin, nil
 			case tfe.RunCanceled:
-				return fmt.Errorf("run was canceled")
+				return nil, fmt.Errorf("run was canceled")
 			case tfe.RunDiscarded:
-				return fmt.Errorf("run was discarded")
+				if discardedOK == "true" {
+					return checkin, nil
+				}
+				return nil, fmt.Errorf("run was discarded")
 			case tfe.RunErrored:
-				return fmt.Errorf("run encountered an error")
+				if opts.annotate {
+					annotateRunErrors(ctx, client, checkin, opts.sourceRoot)
+				}
+				return nil, fmt.Errorf("run encountered an error")
 			}
 
 			// RunApplyQueued        RunStatus = "apply_queued"
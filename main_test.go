@@ -0,0 +1,1022 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestHandleExistingRun(t *testing.T) {
+	setPoll := func(t *testing.T) {
+		prev := existingRunPoll
+		existingRunPoll = time.Millisecond
+		t.Cleanup(func() { existingRunPoll = prev })
+	}
+
+	tests := []struct {
+		name        string
+		mode        string
+		status      tfe.RunStatus
+		cancelable  bool
+		discardable bool
+		wantErr     string
+		wantCancel  int
+		wantDiscard int
+	}{
+		{name: "error", mode: "error", status: tfe.RunPlanning, cancelable: true, wantErr: "already has run"},
+		{name: "cancel planning run", mode: "cancel-existing", status: tfe.RunPlanning, cancelable: true, wantCancel: 1},
+		{name: "discard pending run", mode: "cancel-existing", status: tfe.RunPending, discardable: true, wantDiscard: 1},
+		{name: "discard run awaiting confirmation", mode: "cancel-existing", status: tfe.RunPlanned, discardable: true, wantDiscard: 1},
+		{name: "neither cancelable nor discardable", mode: "cancel-existing", status: tfe.RunApplyQueued, wantErr: "can neither be canceled nor discarded"},
+		{name: "finished run is ignored", mode: "error", status: tfe.RunApplied},
+		{name: "invalid mode", mode: "kill", status: tfe.RunPlanning, wantErr: "invalid on-existing-run"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK, runDoc("run-1", tt.status, tt.cancelable, tt.discardable))
+			stub.reply("POST", "/api/v2/runs/run-1/actions/cancel", http.StatusAccepted, "")
+			stub.reply("POST", "/api/v2/runs/run-1/actions/discard", http.StatusAccepted, "")
+			setInput(t, &onExisting, tt.mode)
+
+			w := &tfe.Workspace{ID: "ws-1", CurrentRun: &tfe.Run{ID: "run-1"}}
+			err := handleExistingRun(context.Background(), client, w)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := stub.count("POST", "/api/v2/runs/run-1/actions/cancel"); got != tt.wantCancel {
+				t.Errorf("cancel calls = %d, want %d", got, tt.wantCancel)
+			}
+			if got := stub.count("POST", "/api/v2/runs/run-1/actions/discard"); got != tt.wantDiscard {
+				t.Errorf("discard calls = %d, want %d", got, tt.wantDiscard)
+			}
+		})
+	}
+
+	t.Run("wait", func(t *testing.T) {
+		setPoll(t)
+		stub, client := newTFEStub(t)
+		reads := 0
+		stub.handle("GET", "/api/v2/runs/run-1", func(w http.ResponseWriter, r *http.Request) {
+			reads++
+			status := tfe.RunApplying
+			if reads > 2 {
+				status = tfe.RunApplied
+			}
+			writeJSONAPI(w, http.StatusOK, runDoc("run-1", status, true, false))
+		})
+		setInput(t, &onExisting, "wait")
+
+		w := &tfe.Workspace{ID: "ws-1", CurrentRun: &tfe.Run{ID: "run-1"}}
+		if err := handleExistingRun(context.Background(), client, w); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if reads != 3 {
+			t.Errorf("run reads = %d, want 3", reads)
+		}
+		if stub.count("POST", "/api/v2/runs/run-1/actions/cancel") != 0 {
+			t.Error("wait canceled the existing run")
+		}
+	})
+}
+
+func TestRunRejectsInvalidInputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		inputs  map[*string]string
+		wantErr string
+	}{
+		{
+			name:    "prune with descriptions-only",
+			inputs:  map[*string]string{&descOnly: "true", &prune: "true"},
+			wantErr: "prune cannot be combined with descriptions-only",
+		},
+		{
+			name:    "misspelled on-run-task",
+			inputs:  map[*string]string{&onRunTask: "fial"},
+			wantErr: `invalid on-run-task "fial"`,
+		},
+		{
+			name:    "misspelled other-runs",
+			inputs:  map[*string]string{&otherRuns: "includes"},
+			wantErr: `invalid other-runs "includes"`,
+		},
+		{
+			name:    "require-vars without json-vars",
+			inputs:  map[*string]string{&requireVars: "true", &jsonVars: ""},
+			wantErr: "require-vars is set but json-vars holds no variables to apply",
+		},
+		{
+			name:    "require-vars with an empty json-vars",
+			inputs:  map[*string]string{&requireVars: "true", &jsonVars: "[]"},
+			wantErr: "require-vars is set but json-vars holds no variables to apply",
+		},
+		{
+			name:    "github-token without github-environment",
+			inputs:  map[*string]string{&githubToken: "ghs_token", &autoApply: "true"},
+			wantErr: "github-token requires github-environment",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for input, value := range tt.inputs {
+				setInput(t, input, value)
+			}
+			err := run(context.Background(), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// createdRun decodes the attributes of the run created on the stub
+func createdRun(t *testing.T, stub *tfeStub) map[string]any {
+	t.Helper()
+	bodies := stub.requestBodies("POST", "/api/v2/runs")
+	if len(bodies) != 1 {
+		t.Fatalf("runs created = %d, want 1", len(bodies))
+	}
+	var doc struct {
+		Data struct {
+			Attributes map[string]any `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(bodies[0]), &doc); err != nil {
+		t.Fatalf("could not decode the run creation: %v", err)
+	}
+	return doc.Data.Attributes
+}
+
+func TestRunSavesNamedPlan(t *testing.T) {
+	tests := []struct {
+		name        string
+		planOnly    string
+		savePlan    string
+		planName    string
+		wantSave    bool
+		wantMessage string
+		wantOutputs map[string]string
+	}{
+		{name: "regular run", wantMessage: "deploy"},
+		{name: "plan-only", planOnly: "true", wantMessage: "deploy"},
+		{
+			name:        "save-plan",
+			savePlan:    "true",
+			wantSave:    true,
+			wantMessage: "deploy",
+			wantOutputs: map[string]string{"plan-id": "plan-1", "plan-name": ""},
+		},
+		{
+			name:        "named plan",
+			planOnly:    "true",
+			planName:    "nightly",
+			wantSave:    true,
+			wantMessage: "deploy [plan: nightly]",
+			wantOutputs: map[string]string{"plan-id": "plan-1", "plan-name": "nightly"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			outputs := captureOutputs(t)
+			setInput(t, &message, "deploy")
+			setInput(t, &planOnly, tt.planOnly)
+			setInput(t, &savePlan, tt.savePlan)
+			setInput(t, &planName, tt.planName)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			attrs := createdRun(t, stub)
+			if got, _ := attrs["save-plan"].(bool); got != tt.wantSave {
+				t.Errorf("save-plan = %t, want %t", got, tt.wantSave)
+			}
+			if got, _ := attrs["plan-only"].(bool); got != (tt.planOnly == "true") {
+				t.Errorf("plan-only = %t, want %t", got, tt.planOnly == "true")
+			}
+			if attrs["message"] != tt.wantMessage {
+				t.Errorf("message = %v, want %q", attrs["message"], tt.wantMessage)
+			}
+			got := outputs()
+			if got["run-id"] != "run-1" {
+				t.Errorf("run-id = %q, want run-1", got["run-id"])
+			}
+			for _, key := range []string{"plan-id", "plan-name"} {
+				want, ok := tt.wantOutputs[key]
+				if value, found := got[key]; found != ok || value != want {
+					t.Errorf("%s = %q (written %t), want %q (written %t)", key, value, found, want, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckAPIVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		remote  string
+		minimum string
+		wantErr string
+	}{
+		{name: "newer server", remote: "2.6", minimum: "2.5"},
+		{name: "same version", remote: "2.5", minimum: "2.5"},
+		{name: "older server", remote: "2.4", minimum: "2.5", wantErr: "supports API version 2.4, 2.5 or newer is required"},
+		{name: "no version reported", minimum: "2.5", wantErr: "did not report an API version"},
+		{name: "invalid minimum", remote: "2.6", minimum: "latest", wantErr: `invalid min-api-version "latest"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.remote != "" {
+					w.Header().Set("TFP-API-Version", tt.remote)
+				}
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+			client, err := tfe.NewClient(&tfe.Config{Address: server.URL, Token: "test-token"})
+			if err != nil {
+				t.Fatalf("could not create client: %v", err)
+			}
+
+			err = checkAPIVersion(client, tt.minimum)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStatusMessages(t *testing.T) {
+	setInput(t, &statusMsgs, `{"applied":"Deployed to production","planning":"Working out the changes"}`)
+	messages, err := parseStatusMessages()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := statusMessage(messages, tfe.RunPlanning); got != "Working out the changes" {
+		t.Errorf("mapped status = %q", got)
+	}
+	if got := statusMessage(messages, tfe.RunPlanQueued); got != "plan_queued" {
+		t.Errorf("unmapped status = %q, want the raw status", got)
+	}
+
+	stub, client := newTFEStub(t)
+	stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK, `{"data":{"id":"run-1","type":"runs","attributes":{"status":"applied"}}}`)
+	stdout := captureStdout(t, func() {
+		if _, err := waitForRun(context.Background(), client, "run-1", waitOptions{messages: messages}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+	if !strings.Contains(stdout, "Run status: Deployed to production\n") {
+		t.Errorf("log = %q, want the custom message of applied", stdout)
+	}
+}
+
+func TestRunGeneratesConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		generated bool
+	}{
+		{name: "configuration generated", generated: true},
+		{name: "nothing to generate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveRun(tfe.RunPlannedAndFinished)
+			stub.reply("GET", "/api/v2/plans/plan-1", http.StatusOK,
+				fmt.Sprintf(`{"data":{"id":"plan-1","type":"plans","attributes":{"generated-configuration":%t}}}`, tt.generated))
+			outputs := captureOutputs(t)
+			setInput(t, &genConfig, "true")
+			setInput(t, &wait, "true")
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got, _ := createdRun(t, stub)["allow-config-generation"].(bool); !got {
+				t.Error("the run was created without allow-config-generation")
+			}
+			got := outputs()
+			if got["generated-config"] != fmt.Sprint(tt.generated) {
+				t.Errorf("generated-config = %q, want %t", got["generated-config"], tt.generated)
+			}
+			configURL, written := got["generated-config-url"]
+			if written != tt.generated || (written && configURL != got["run-url"]) {
+				t.Errorf("generated-config-url = %q (written %t), want the run URL %q", configURL, written, got["run-url"])
+			}
+		})
+	}
+}
+
+func TestRunWritesOutputsOnFailedWait(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     tfe.RunStatus
+		wantErr    string
+		wantStatus string
+	}{
+		{name: "applied", status: tfe.RunApplied, wantStatus: "applied"},
+		{name: "errored", status: tfe.RunErrored, wantErr: "run encountered an error", wantStatus: "errored"},
+		{name: "canceled", status: tfe.RunCanceled, wantErr: "run was canceled", wantStatus: "errored"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveRun(tt.status)
+			outputs := captureOutputs(t)
+			setInput(t, &wait, "true")
+
+			err := run(context.Background(), nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			got := outputs()
+			if got["run-id"] != "run-1" || !strings.HasSuffix(got["run-url"], "/runs/run-1") {
+				t.Errorf("run-id, run-url = %q, %q, want run-1 and its URL", got["run-id"], got["run-url"])
+			}
+			if got["run-status"] != tt.wantStatus {
+				t.Errorf("run-status = %q, want %q", got["run-status"], tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestParseVarsStrict(t *testing.T) {
+	const typo = `[{"key":"token","value":"x","sensative":true}]`
+	tests := []struct {
+		name    string
+		strict  string
+		payload string
+		wantErr string
+	}{
+		{name: "lenient ignores unknown fields", payload: typo},
+		{name: "strict rejects unknown fields", strict: "true", payload: typo, wantErr: `unknown field "sensative"`},
+		{name: "strict accepts known fields", strict: "true", payload: `[{"key":"token","value":"x","sensitive":true}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &strictVars, tt.strict)
+			vars, err := parseVars(tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(vars) != 1 || vars[0].Key != "token" {
+				t.Errorf("vars = %+v, want token", vars)
+			}
+		})
+	}
+}
+
+func TestVerifyCurrentRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		current   string
+		statuses  []tfe.RunStatus
+		wantErr   string
+		wantReads int
+	}{
+		{name: "our run applied", current: "run-1", statuses: []tfe.RunStatus{tfe.RunApplied}, wantReads: 1},
+		{name: "superseded", current: "run-2", statuses: []tfe.RunStatus{tfe.RunPlanning}, wantErr: `run "run-1" was superseded by run "run-2" (status planning)`, wantReads: 1},
+		{name: "not applied", current: "run-1", statuses: []tfe.RunStatus{tfe.RunErrored}, wantErr: "has status errored", wantReads: 1},
+		{name: "applied once settled", current: "run-1", statuses: []tfe.RunStatus{tfe.RunApplying, tfe.RunApplying, tfe.RunApplied}, wantReads: 3},
+		{name: "still applying", current: "run-1", statuses: []tfe.RunStatus{tfe.RunApplying}, wantErr: "has status applying", wantReads: verifyReadRetries + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			reads := 0
+			stub.handle("GET", "/api/v2/workspaces/ws-1", func(w http.ResponseWriter, r *http.Request) {
+				status := tt.statuses[min(reads, len(tt.statuses)-1)]
+				reads++
+				writeJSONAPI(w, http.StatusOK, fmt.Sprintf(`{
+					"data":{"id":"ws-1","type":"workspaces","relationships":{"current-run":{"data":{"id":%[1]q,"type":"runs"}}}},
+					"included":[{"id":%[1]q,"type":"runs","attributes":{"status":%[2]q}}]}`, tt.current, status))
+			})
+
+			err := verifyCurrentRun(context.Background(), client, "ws-1", "run-1", 30*time.Millisecond)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if reads != tt.wantReads {
+				t.Errorf("workspace reads = %d, want %d", reads, tt.wantReads)
+			}
+		})
+	}
+}
+
+func TestWaitForDiscardedRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		discarded string
+		wantErr   string
+	}{
+		{name: "failure by default", wantErr: "run was discarded"},
+		{name: "success when opted in", discarded: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.serveRun(tfe.RunDiscarded)
+			setInput(t, &discardedOK, tt.discarded)
+
+			r, err := waitForRun(context.Background(), client, "run-1", waitOptions{})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if r.Status != tfe.RunDiscarded {
+				t.Errorf("status = %s, want discarded", r.Status)
+			}
+		})
+	}
+}
+
+func TestRunWaitsUntilQueued(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	statuses := []tfe.RunStatus{tfe.RunPending, tfe.RunPending, tfe.RunPlanQueued, tfe.RunPlanning, tfe.RunApplied}
+	reads := 0
+	stub.handle("GET", "/api/v2/runs/run-1", func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[min(reads, len(statuses)-1)]
+		reads++
+		writeJSONAPI(w, http.StatusOK, fmt.Sprintf(`{"data":{"id":"run-1","type":"runs","attributes":{"status":%q}}}`, status))
+	})
+	outputs := captureOutputs(t)
+	setInput(t, &wait, "true")
+	setInput(t, &waitStage, "queued")
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reads != 3 {
+		t.Errorf("run reads = %d, want 3: the wait returns once the run leaves pending", reads)
+	}
+	got := outputs()
+	if got["run-id"] != "run-1" || got["run-status"] != "plan_queued" {
+		t.Errorf("run-id, run-status = %q, %q, want run-1, plan_queued", got["run-id"], got["run-status"])
+	}
+}
+
+func TestRunTerraformVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		planOnly string
+		version  string
+		wantErr  string
+	}{
+		{name: "plan-only run", planOnly: "true", version: "1.9.5"},
+		{name: "workspace version by default", planOnly: "true"},
+		{name: "applying run", version: "1.9.5", wantErr: "run-terraform-version requires plan-only or dry-run"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			setInput(t, &planOnly, tt.planOnly)
+			setInput(t, &runTFVersion, tt.version)
+
+			err := run(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if n := stub.count("POST", "/api/v2/runs"); n != 0 {
+					t.Errorf("runs created = %d, want none", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got, set := createdRun(t, stub)["terraform-version"]
+			if set != (tt.version != "") || (set && got != tt.version) {
+				t.Errorf("terraform-version = %v (set %t), want %q", got, set, tt.version)
+			}
+		})
+	}
+}
+
+func TestConfirmRunWaitsApplyDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		cancel    bool
+		wantApply bool
+	}{
+		{name: "applied after the delay", wantApply: true},
+		{name: "interrupted during the delay", cancel: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			var appliedAt time.Time
+			stub.handle("POST", "/api/v2/runs/run-1/actions/apply", func(w http.ResponseWriter, r *http.Request) {
+				appliedAt = time.Now()
+				w.WriteHeader(http.StatusAccepted)
+			})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			err := confirmRun(ctx, client, &tfe.Run{ID: "run-1"}, waitOptions{applyDelay: 100 * time.Millisecond})
+			if !tt.wantApply {
+				if err == nil || !strings.Contains(err.Error(), "apply-delay interrupted") {
+					t.Errorf("error = %v, want the interrupted apply-delay", err)
+				}
+				if n := stub.count("POST", "/api/v2/runs/run-1/actions/apply"); n != 0 {
+					t.Errorf("apply calls = %d, want 0", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if waited := appliedAt.Sub(start); waited < 100*time.Millisecond {
+				t.Errorf("applied after %s, want at least the apply-delay", waited)
+			}
+		})
+	}
+}
+
+func TestFormatRunURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{name: "default", want: "https://tfe.example.com/app/org/workspaces/ws/runs/run-1"},
+		{name: "custom", template: "{base}/{org}/{workspace}/runs/{run}?tab=plan", want: "https://tfe.example.com/org/ws/runs/run-1?tab=plan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &url, "https://tfe.example.com/")
+			setInput(t, &organization, "org")
+			setInput(t, &workspace, "ws")
+
+			if got := formatRunURL(tt.template, "run-1"); got != tt.want {
+				t.Errorf("formatRunURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunFormatsRunURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  string
+		wantURL  string
+	}{
+		{name: "custom template", template: "{base}/runs/{run}", wantURL: "/runs/run-1"},
+		{name: "missing run placeholder", template: "{base}/app/{org}", wantErr: "must contain the {run} placeholder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			outputs := captureOutputs(t)
+			setInput(t, &urlTemplate, tt.template)
+
+			err := run(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if n := stub.count("POST", "/api/v2/runs"); n != 0 {
+					t.Errorf("runs created = %d, want 0", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := outputs()["run-url"]; got != stub.URL+tt.wantURL {
+				t.Errorf("run-url = %q, want %q", got, stub.URL+tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestRunDeadline(t *testing.T) {
+	tests := []struct {
+		name       string
+		deadline   string
+		wantErr    string
+		wantStatus string
+	}{
+		{name: "reached while waiting", deadline: time.Now().Add(200 * time.Millisecond).Format(time.RFC3339Nano), wantErr: "reached", wantStatus: "interrupted"},
+		{name: "invalid", deadline: "tomorrow", wantErr: `invalid deadline "tomorrow"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveRun(tfe.RunPlanning)
+			outputs := captureOutputs(t)
+			setInput(t, &wait, "true")
+			setInput(t, &deadline, tt.deadline)
+
+			err := run(context.Background(), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := outputs()["run-status"]; got != tt.wantStatus {
+				t.Errorf("run-status = %q, want %q", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRunComposesWorkspaceName(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.reply("GET", "/api/v2/organizations/org/workspaces/svc-api-prod", http.StatusOK,
+		`{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"svc-api-prod"}}}`)
+	outputs := captureOutputs(t)
+	setInput(t, &workspace, "api")
+	setInput(t, &wsPrefix, "svc-")
+	setInput(t, &wsSuffix, "-prod")
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := stub.count("GET", "/api/v2/organizations/org/workspaces/svc-api-prod"); n == 0 {
+		t.Error("the composed workspace name was not looked up")
+	}
+	if got := outputs()["run-url"]; !strings.HasSuffix(got, "/workspaces/svc-api-prod/runs/run-1") {
+		t.Errorf("run-url = %q, want the composed workspace name", got)
+	}
+}
+
+func TestRunTracksOwnRun(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	// A VCS-driven run started by the variable changes became current
+	stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusOK,
+		`{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws"},`+
+			`"relationships":{"current-run":{"data":{"id":"run-2","type":"runs"}}}}}`)
+	stub.reply("GET", "/api/v2/runs/run-2", http.StatusOK, `{"data":{"id":"run-2","type":"runs","attributes":{"status":"planning"}}}`)
+	stub.serveRun(tfe.RunApplied)
+	outputs := captureOutputs(t)
+	setInput(t, &wait, "true")
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := outputs()
+	if got["run-id"] != "run-1" || got["run-status"] != "applied" {
+		t.Errorf("run-id, run-status = %q, %q, want run-1 applied", got["run-id"], got["run-status"])
+	}
+	if n := stub.count("GET", "/api/v2/runs/run-2"); n != 0 {
+		t.Errorf("the current run was read %d times", n)
+	}
+}
+
+func TestReadOwnRun(t *testing.T) {
+	stub, client := newTFEStub(t)
+	stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK, `{"data":{"id":"run-2","type":"runs","attributes":{"status":"planning"}}}`)
+
+	_, err := readOwnRun(context.Background(), client, "run-1")
+	if err == nil || !strings.Contains(err.Error(), `read run "run-2" while tracking run "run-1"`) {
+		t.Fatalf("error = %v, want the other run to be rejected", err)
+	}
+}
+
+func TestWaitForRunQueueGrace(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  tfe.RunStatus
+		grace   time.Duration
+		wantErr string
+	}{
+		{name: "timed out without grace", status: tfe.RunPlanQueued, wantErr: "run timed out"},
+		{name: "queued run extended", status: tfe.RunPlanQueued, grace: 500 * time.Millisecond},
+		{name: "running run not extended", status: tfe.RunPlanning, grace: 500 * time.Millisecond, wantErr: "run timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			start := time.Now()
+			stub.handle("GET", "/api/v2/runs/run-1", func(w http.ResponseWriter, r *http.Request) {
+				status := tt.status
+				if time.Since(start) > 200*time.Millisecond {
+					status = tfe.RunApplied
+				}
+				writeJSONAPI(w, http.StatusOK, fmt.Sprintf(`{"data":{"id":"run-1","type":"runs","attributes":{"status":%q}}}`, status))
+			})
+			prev := maximumTimeout
+			maximumTimeout = 100 * time.Millisecond
+			t.Cleanup(func() { maximumTimeout = prev })
+
+			poll := pollCurve{initial: 10 * time.Millisecond, max: 10 * time.Millisecond, factor: 1}
+			r, err := waitForRun(context.Background(), client, "run-1", waitOptions{poll: poll, queueGrace: tt.grace})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if r.Status != tfe.RunApplied {
+				t.Errorf("status = %s, want applied", r.Status)
+			}
+		})
+	}
+}
+
+func TestRunPlanJSON(t *testing.T) {
+	const plan = `{"format_version":"1.2","resource_changes":[]}`
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.serveRun(tfe.RunPlannedAndFinished)
+	stub.handle("GET", "/api/v2/plans/plan-1/json-output", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(plan))
+	})
+	outputs := captureOutputs(t)
+	for _, input := range []*string{&planOnly, &wait, &waitStage} {
+		setInput(t, input, *input)
+	}
+	prevLog := logOutput
+	t.Cleanup(func() {
+		logOutput, discardOutputs = prevLog, false
+	})
+
+	var err error
+	stdout := captureStdout(t, func() {
+		err = run(context.Background(), []string{"plan-json"})
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stdout != plan {
+		t.Errorf("stdout = %q, want only the plan JSON", stdout)
+	}
+	if got := outputs(); len(got) != 0 {
+		t.Errorf("outputs = %v, want none", got)
+	}
+	if got := createdRun(t, stub)["plan-only"]; got != true {
+		t.Errorf("run created with plan-only %v, want true", got)
+	}
+}
+
+func TestRunEncodesRunVariables(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	setInput(t, &runVarsJSON, `[
+		{"key":"greeting","value":"hello ${name} %{if x}"},
+		{"key":"replicas","value":3},
+		{"key":"tags","value":{"team":"${team}"}},
+		{"key":"expr","value":"var.a + 1","hcl":true}
+	]`)
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := map[string]any{}
+	variables, _ := createdRun(t, stub)["variables"].([]any)
+	for _, v := range variables {
+		attrs, _ := v.(map[string]any)
+		got[attrs["key"].(string)] = attrs["value"]
+	}
+	want := map[string]any{
+		"greeting": `"hello $${name} %%{if x}"`,
+		"replicas": `3`,
+		"tags":     `{ team = "$${team}" }`,
+		"expr":     `var.a + 1`,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("run variables = %v, want %v", got, want)
+	}
+}
+
+func TestPathPrefix(t *testing.T) {
+	tests := []struct {
+		url, prefix string
+		wantPrefix  string
+		wantBase    string
+	}{
+		{url: "https://app.terraform.io", wantBase: "https://app.terraform.io"},
+		{url: "https://proxy.example.com", prefix: "tfe/", wantPrefix: "/tfe", wantBase: "https://proxy.example.com/tfe"},
+		{url: "https://proxy.example.com/tfe/", wantPrefix: "/tfe", wantBase: "https://proxy.example.com/tfe"},
+		{url: "https://proxy.example.com/a/", prefix: "/b", wantPrefix: "/a/b", wantBase: "https://proxy.example.com/a/b"},
+	}
+	for _, tt := range tests {
+		setInput(t, &url, tt.url)
+		setInput(t, &apiPrefix, tt.prefix)
+		if got := pathPrefix(); got != tt.wantPrefix {
+			t.Errorf("pathPrefix(%q, %q) = %q, want %q", tt.url, tt.prefix, got, tt.wantPrefix)
+		}
+		if got := baseURL(); got != tt.wantBase {
+			t.Errorf("baseURL(%q, %q) = %q, want %q", tt.url, tt.prefix, got, tt.wantBase)
+		}
+	}
+}
+
+func TestRunUnderPathPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		prefix string
+	}{
+		{name: "api-path-prefix", prefix: "/tfe"},
+		{name: "path in url", path: "/tfe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveUnder("/tfe")
+			outputs := captureOutputs(t)
+			setInput(t, &url, stub.URL+tt.path)
+			setInput(t, &apiPrefix, tt.prefix)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, want := outputs()["run-url"], stub.URL+"/tfe/app/org/workspaces/ws/runs/run-1"; got != want {
+				t.Errorf("run-url = %q, want %q", got, want)
+			}
+			if n := stub.count("POST", "/api/v2/runs"); n != 1 {
+				t.Errorf("runs created under the prefix = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRunHTTPTimeout(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	stub.handle("GET", "/api/v2/organizations/org/workspaces/ws", func(w http.ResponseWriter, r *http.Request) {
+		// A stalled connection, which only the HTTP timeout bounds
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	setInput(t, &httpTimeout, "100ms")
+
+	start := time.Now()
+	err := run(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+		t.Fatalf("error = %v, want the HTTP timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("run took %s despite the 100ms http-timeout", elapsed)
+	}
+}
+
+func TestRunInterruptedWhileWaiting(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stub.handle("GET", "/api/v2/runs/run-1", func(w http.ResponseWriter, r *http.Request) {
+		// The workflow is canceled while the run is still planning
+		cancel()
+		writeJSONAPI(w, http.StatusOK, `{"data":{"id":"run-1","type":"runs","attributes":{"status":"planning"}}}`)
+	})
+	outputs := captureOutputs(t)
+	setInput(t, &wait, "true")
+
+	err := run(ctx, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want %v", err, context.Canceled)
+	}
+
+	// Written by the deferred flush of run, not by reading them back
+	if written, _ := os.ReadFile(os.Getenv("GITHUB_OUTPUT")); !strings.Contains(string(written), "run-status=interrupted\n") {
+		t.Errorf("GITHUB_OUTPUT = %q, want the outputs flushed on interruption", written)
+	}
+	got := outputs()
+	if got["run-id"] != "run-1" || !strings.HasSuffix(got["run-url"], "/runs/run-1") || got["run-status"] != "interrupted" {
+		t.Errorf("outputs = %v, want run-id, run-url and run-status interrupted", got)
+	}
+}
+
+func TestRunAppliesOnce(t *testing.T) {
+	runDoc := func(status tfe.RunStatus) string {
+		// The actions lag behind the status, the run still looks confirmable
+		return fmt.Sprintf(`{"data":{"id":"run-1","type":"runs","attributes":{"status":%q,"actions":{"is-confirmable":true}}}}`, status)
+	}
+	tests := []struct {
+		name      string
+		statuses  []tfe.RunStatus
+		wantApply int
+	}{
+		{name: "confirmed by us", statuses: []tfe.RunStatus{tfe.RunPlanned, tfe.RunConfirmed, tfe.RunApplying, tfe.RunApplied}, wantApply: 1},
+		{name: "already confirmed", statuses: []tfe.RunStatus{tfe.RunConfirmed, tfe.RunConfirmed, tfe.RunApplied}},
+		{name: "already applying", statuses: []tfe.RunStatus{tfe.RunApplying, tfe.RunApplied}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			var mu sync.Mutex
+			reads := 0
+			stub.handle("GET", "/api/v2/runs/run-1", func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				status := tt.statuses[min(reads, len(tt.statuses)-1)]
+				reads++
+				mu.Unlock()
+				writeJSONAPI(w, http.StatusOK, runDoc(status))
+			})
+			stub.handle("POST", "/api/v2/runs/run-1/actions/apply", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})
+			setInput(t, &wait, "true")
+			setInput(t, &autoApply, "true")
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := stub.count("POST", "/api/v2/runs/run-1/actions/apply"); n != tt.wantApply {
+				t.Errorf("applies = %d, want %d", n, tt.wantApply)
+			}
+		})
+	}
+}
+
+func TestRunWithoutJSONVars(t *testing.T) {
+	for _, value := range []string{"", "[]"} {
+		t.Run(fmt.Sprintf("%q", value), func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			setInput(t, &jsonVars, value)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := stub.count("POST", "/api/v2/runs"); n != 1 {
+				t.Errorf("runs created = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestRunReportsActionVersion(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	outputs := captureOutputs(t)
+	setInput(t, &actionVersion, "v1.2.3")
+
+	var err error
+	log := captureStdout(t, func() {
+		err = run(context.Background(), nil)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first, _, _ := strings.Cut(log, "\n"); first != "terraform-cloud-action v1.2.3" {
+		t.Errorf("first log line = %q, want the action version", first)
+	}
+	if got := outputs()["action-version"]; got != "v1.2.3" {
+		t.Errorf("action-version = %q, want v1.2.3", got)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// actionMetrics collects the figures written to metrics-file
+type actionMetrics struct {
+	start    time.Time
+	retries  atomic.Int64
+	apiCalls atomic.Int64
+	status   string
+}
+
+func newActionMetrics() *actionMetrics {
+	return &actionMetrics{start: time.Now()}
+}
+
+// promLabel escapes a Prometheus label value
+func promLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// render formats the metrics in the Prometheus text exposition format
+func (m *actionMetrics) render(runErr error) string {
+	labels := fmt.Sprintf(`organization="%s",workspace="%s"`, promLabel(organization), promLabel(workspace))
+	success := 1
+	if runErr != nil {
+		success = 0
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP tfc_action_duration_seconds Wall-clock duration of the action.\n")
+	fmt.Fprintf(&b, "# TYPE tfc_action_duration_seconds gauge\n")
+	fmt.Fprintf(&b, "tfc_action_duration_seconds{%s} %g\n", labels, time.Since(m.start).Seconds())
+	fmt.Fprintf(&b, "# HELP tfc_action_retries_total API requests retried by the action.\n")
+	fmt.Fprintf(&b, "# TYPE tfc_action_retries_total counter\n")
+	fmt.Fprintf(&b, "tfc_action_retries_total{%s} %d\n", labels, m.retries.Load())
+	fmt.Fprintf(&b, "# HELP tfc_action_api_calls_total API requests sent by the action, retries included.\n")
+	fmt.Fprintf(&b, "# TYPE tfc_action_api_calls_total counter\n")
+	fmt.Fprintf(&b, "tfc_action_api_calls_total{%s} %d\n", labels, m.apiCalls.Load())
+	fmt.Fprintf(&b, "# HELP tfc_action_success Whether the action succeeded.\n")
+	fmt.Fprintf(&b, "# TYPE tfc_action_success gauge\n")
+	fmt.Fprintf(&b, "tfc_action_success{%s} %d\n", labels, success)
+	if m.status != "" {
+		fmt.Fprintf(&b, "# HELP tfc_action_run_status Final status of the run created by the action.\n")
+		fmt.Fprintf(&b, "# TYPE tfc_action_run_status gauge\n")
+		fmt.Fprintf(&b, "tfc_action_run_status{%s,status=\"%s\"} 1\n", labels, promLabel(m.status))
+	}
+	return b.String()
+}
+
+// write stores the metrics in filename for a node exporter textfile
+// collector. The file is written next to its destination and renamed so the
+// collector never scrapes a partial file
+func (m *actionMetrics) write(filename string, runErr error) {
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(m.render(runErr)), 0644); err != nil {
+		logWarn("could not write metrics file: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		logWarn("could not write metrics file: %v", err)
+	}
+}
+
+// countingTransport counts the API requests sent through it, every retry
+// attempt included, and the rate limited responses for concurrencyLimit
+type countingTransport struct {
+	next  http.RoundTripper
+	count *atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		rateLimitedCalls.Add(1)
+	}
+	return resp, err
+}
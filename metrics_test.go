@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestActionMetricsWrite(t *testing.T) {
+	setInput(t, &organization, "org")
+	setInput(t, &workspace, `ws"1`)
+	labels := `organization="org",workspace="ws\"1"`
+
+	tests := []struct {
+		name   string
+		status string
+		runErr error
+		want   []string
+		absent string
+	}{
+		{
+			name:   "applied run",
+			status: "applied",
+			want: []string{
+				"# TYPE tfc_action_retries_total counter",
+				"tfc_action_retries_total{" + labels + "} 2",
+				"tfc_action_success{" + labels + "} 1",
+				"tfc_action_run_status{" + labels + `,status="applied"} 1`,
+			},
+		},
+		{
+			name:   "failed before a run",
+			runErr: errors.New("could not read workspace"),
+			want: []string{
+				"tfc_action_retries_total{" + labels + "} 2",
+				"tfc_action_success{" + labels + "} 0",
+			},
+			absent: "tfc_action_run_status",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newActionMetrics()
+			m.retries.Add(2)
+			m.status = tt.status
+			file := filepath.Join(t.TempDir(), "tfc.prom")
+
+			m.write(file, tt.runErr)
+
+			data, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("could not read metrics: %v", err)
+			}
+			lines := strings.Split(string(data), "\n")
+			for _, want := range tt.want {
+				found := false
+				for _, line := range lines {
+					found = found || line == want
+				}
+				if !found {
+					t.Errorf("metrics miss %q:\n%s", want, data)
+				}
+			}
+			if !regexp.MustCompile(`(?m)^tfc_action_duration_seconds\{` + regexp.QuoteMeta(labels) + `\} [0-9.e-]+$`).Match(data) {
+				t.Errorf("metrics miss the duration:\n%s", data)
+			}
+			if tt.absent != "" && strings.Contains(string(data), tt.absent) {
+				t.Errorf("metrics contain %s:\n%s", tt.absent, data)
+			}
+			if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+				t.Error("the temporary metrics file was left behind")
+			}
+		})
+	}
+}
+
+func TestCountingTransport(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.reply("GET", "/limited", http.StatusTooManyRequests, "")
+	stub.reply("GET", "/ok", http.StatusOK, "")
+	var count atomic.Int64
+	client := &http.Client{Transport: &countingTransport{next: http.DefaultTransport, count: &count}}
+	limitedBefore := rateLimitedCalls.Load()
+
+	for _, path := range []string{"/ok", "/limited", "/limited"} {
+		resp, err := client.Get(stub.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if got := count.Load(); got != 3 {
+		t.Errorf("count = %d, want 3", got)
+	}
+	if got := rateLimitedCalls.Load() - limitedBefore; got != 2 {
+		t.Errorf("rate limited calls = %d, want 2", got)
+	}
+}
+
+func TestRunWritesAPICalls(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	outputs := captureOutputs(t)
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stub.mu.Lock()
+	// Less the ping of the client newTFEStub creates for the test
+	calls := len(stub.calls) - 1
+	stub.mu.Unlock()
+	if got := outputs()["api-calls"]; got != strconv.Itoa(calls) {
+		t.Errorf("api-calls = %s, want the %d requests the stub received", got, calls)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// pendingOutput is an output buffered until flushOutputs
+type pendingOutput struct {
+	filename string
+	key      string
+	value    string
+	content  string
+}
+
+// discardOutputs is set by the plan-json command, which writes no outputs
+var discardOutputs bool
+
+// outputPath returns the file outputs are appended to, GITHUB_OUTPUT. Outside
+// of GitHub Actions, with dotenv-file, it is the null device so that the
+// outputs are still collected for the dotenv file. Empty means no outputs
+func outputPath() string {
+	if discardOutputs {
+		return ""
+	}
+	if filename := os.Getenv("GITHUB_OUTPUT"); filename != "" || dotenvFile == "" {
+		return filename
+	}
+	return os.DevNull
+}
+
+// outputBuffer holds the outputs written during the run, so that the
+// GITHUB_OUTPUT file is either complete or untouched rather than partially
+// populated when the action is interrupted
+var outputBuffer struct {
+	mu      sync.Mutex
+	entries []pendingOutput
+}
+
+func bufferOutput(filename, key, value, content string) {
+	outputBuffer.mu.Lock()
+	defer outputBuffer.mu.Unlock()
+	outputBuffer.entries = append(outputBuffer.entries, pendingOutput{filename, key, value, content})
+}
+
+// appendToFile buffers a key-value pair for the GITHUB_OUTPUT file. Nothing
+// is written yet, failing to write is reported by flushOutputs
+func appendToFile(filename, key, value string) {
+	// Use simple key=value format for single-line outputs
+	bufferOutput(filename, key, value, fmt.Sprintf("%s=%s\n", key, value))
+}
+
+// appendMultilineToFile buffers a key-value pair for the GITHUB_OUTPUT file
+// using the heredoc syntax, which allows the value to span several lines
+func appendMultilineToFile(filename, key, value string) {
+	delimiter := "EOF"
+	for strings.Contains(value, delimiter) {
+		delimiter += "_EOF"
+	}
+	bufferOutput(filename, key, value, fmt.Sprintf("%s<<%s\n%s\n%s\n", key, delimiter, value, delimiter))
+}
+
+// flushOutputs writes the buffered outputs with a single append per file.
+// When a file cannot be written a warning is logged for each of its keys
+func flushOutputs() {
+	outputBuffer.mu.Lock()
+	entries := outputBuffer.entries
+	outputBuffer.entries = nil
+	outputBuffer.mu.Unlock()
+
+	var files []string
+	contents := map[string]*strings.Builder{}
+	keys := map[string][]string{}
+	for _, e := range entries {
+		if contents[e.filename] == nil {
+			files = append(files, e.filename)
+			contents[e.filename] = &strings.Builder{}
+		}
+		contents[e.filename].WriteString(e.content)
+		keys[e.filename] = append(keys[e.filename], e.key)
+	}
+	for _, filename := range files {
+		if err := writeOutputFile(filename, contents[filename].String()); err != nil {
+			for _, key := range keys[filename] {
+				logWarn("could not write %s output: %v", key, err)
+			}
+		}
+	}
+	if dotenvFile != "" {
+		if err := writeDotenvFile(dotenvFile, entries); err != nil {
+			logWarn("could not write dotenv file: %v", err)
+		}
+	}
+}
+
+// writeDotenvFile writes the outputs to filename as KEY=value lines, with the
+// same keys as GITHUB_OUTPUT. Values that would not survive unquoted, such as
+// multiline ones, are double quoted and escaped
+func writeDotenvFile(filename string, entries []pendingOutput) error {
+	var b strings.Builder
+	for _, e := range entries {
+		value := e.value
+		if strings.ContainsAny(value, "\n\r\"'#$\\ \t") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, "%s=%s\n", e.key, value)
+	}
+	return os.WriteFile(filename, []byte(b.String()), 0644)
+}
+
+func writeOutputFile(filename, content string) error {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %w", err)
+	}
+
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write to output file: %w", err)
+	}
+
+	return file.Close()
+}
+
+// writeRunStatus writes the run-status output, if running in GitHub Actions
+func writeRunStatus(status string) {
+	outputFile := outputPath()
+	if outputFile == "" {
+		return
+	}
+	appendToFile(outputFile, "run-status", status)
+}
+
+// maxInlinePlanSize bounds the encoded plan-json-base64 output, keeping it
+// well under the GitHub Actions output size limits
+const maxInlinePlanSize = 512 << 10
+
+// encodeInlinePlan gzips and base64-encodes a plan JSON document
+func encodeInlinePlan(planJSON []byte) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(planJSON); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// writeInlinePlan writes the plan JSON gzipped and base64-encoded as the
+// plan-json-base64 output. Plans too large to inline are skipped with a warning
+func writeInlinePlan(ctx context.Context, client *tfe.Client, planID, filename string) error {
+	planJSON, err := client.Plans.ReadJSONOutput(ctx, planID)
+	if err != nil {
+		return fmt.Errorf("could not read plan JSON output: %w", err)
+	}
+
+	encoded, err := encodeInlinePlan(planJSON)
+	if err != nil {
+		return fmt.Errorf("could not encode plan JSON output: %w", err)
+	}
+	if len(encoded) > maxInlinePlanSize {
+		logWarn("encoded plan is %d bytes, larger than the %d byte inline limit, skipping plan-json-base64 output", len(encoded), maxInlinePlanSize)
+		return nil
+	}
+
+	appendToFile(filename, "plan-json-base64", encoded)
+	return nil
+}
+
+// maskValue asks GitHub Actions to redact every line of value from the logs
+func maskValue(value string) {
+	for _, line := range strings.Split(value, "\n") {
+		if line != "" {
+			fmt.Fprintf(logOutput, "::add-mask::%s\n", line)
+		}
+	}
+}
+
+// stateOutputValue renders a state output value for GITHUB_OUTPUT. Strings
+// are written as-is, anything else is JSON-encoded
+func stateOutputValue(value interface{}) (string, error) {
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// writeStateOutputs writes the workspace's current state outputs to the
+// GITHUB_OUTPUT file as output-<name>. Sensitive outputs are skipped unless
+// include-sensitive-outputs is set, in which case they are masked first
+func writeStateOutputs(ctx context.Context, client *tfe.Client, workspaceID, filename string) error {
+	outputs, err := client.StateVersionOutputs.ReadCurrent(ctx, workspaceID)
+	if err != nil {
+		return fmt.Errorf("could not read state outputs: %w", err)
+	}
+
+	for _, o := range outputs.Items {
+		if o.Sensitive {
+			if inclSecrets != "true" {
+				logInfo("Skipping sensitive state output %q", o.Name)
+				continue
+			}
+			// The current outputs listing redacts sensitive values, they
+			// have to be read one by one
+			o, err = client.StateVersionOutputs.Read(ctx, o.ID)
+			if err != nil {
+				return fmt.Errorf("could not read sensitive state output: %w", err)
+			}
+		}
+
+		value, err := stateOutputValue(o.Value)
+		if err != nil {
+			return fmt.Errorf("could not encode state output %q: %w", o.Name, err)
+		}
+		if o.Sensitive {
+			maskValue(value)
+		}
+
+		key := "output-" + o.Name
+		if strings.Contains(value, "\n") {
+			appendMultilineToFile(filename, key, value)
+		} else {
+			appendToFile(filename, key, value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("could not create pipe: %v", err)
+	}
+	prev, prevLog := os.Stdout, logOutput
+	os.Stdout, logOutput = w, w
+	done := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- string(data)
+	}()
+	defer func() {
+		os.Stdout, logOutput = prev, prevLog
+	}()
+	f()
+	w.Close()
+	return <-done
+}
+
+func TestWriteStateOutputs(t *testing.T) {
+	const current = `{"data":[
+		{"id":"wsout-1","type":"state-version-outputs","attributes":{"name":"endpoint","sensitive":false,"value":"https://example.com"}},
+		{"id":"wsout-2","type":"state-version-outputs","attributes":{"name":"password","sensitive":true,"value":null}},
+		{"id":"wsout-3","type":"state-version-outputs","attributes":{"name":"zones","sensitive":false,"value":["a","b"]}}
+	]}`
+	const secret = `{"data":{"id":"wsout-2","type":"state-version-outputs","attributes":{"name":"password","sensitive":true,"value":"hunter2"}}}`
+
+	tests := []struct {
+		name     string
+		include  string
+		wantPass bool
+	}{
+		{name: "sensitive outputs skipped by default"},
+		{name: "sensitive outputs included", include: "true", wantPass: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("GET", "/api/v2/workspaces/ws-1/current-state-version-outputs", http.StatusOK, current)
+			stub.reply("GET", "/api/v2/state-version-outputs/wsout-2", http.StatusOK, secret)
+			outputs := captureOutputs(t)
+			setInput(t, &inclSecrets, tt.include)
+
+			var err error
+			stdout := captureStdout(t, func() {
+				err = writeStateOutputs(context.Background(), client, "ws-1", os.Getenv("GITHUB_OUTPUT"))
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := outputs()
+			if got["output-endpoint"] != "https://example.com" || got["output-zones"] != `["a","b"]` {
+				t.Errorf("outputs = %v, want the endpoint and zones", got)
+			}
+			password, written := got["output-password"]
+			if written != tt.wantPass || (written && password != "hunter2") {
+				t.Errorf("output-password = %q (written %t), want written %t", password, written, tt.wantPass)
+			}
+			masked := strings.Contains(stdout, "::add-mask::hunter2")
+			if masked != tt.wantPass {
+				t.Errorf("masked = %t, want %t", masked, tt.wantPass)
+			}
+			if n := stub.count("GET", "/api/v2/state-version-outputs/wsout-2"); (n > 0) != tt.wantPass {
+				t.Errorf("sensitive output reads = %d", n)
+			}
+		})
+	}
+}
+
+func TestWriteInlinePlan(t *testing.T) {
+	plan := []byte(`{"format_version":"1.2","resource_changes":[{"address":"null_resource.a","change":{"actions":["create"]}}]}`)
+	noise := make([]byte, maxInlinePlanSize)
+	rand.New(rand.NewSource(1)).Read(noise)
+
+	tests := []struct {
+		name      string
+		plan      []byte
+		wantWrite bool
+	}{
+		{name: "round-trips", plan: plan, wantWrite: true},
+		{name: "too large to inline", plan: noise},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.handle("GET", "/api/v2/plans/plan-1/json-output", func(w http.ResponseWriter, r *http.Request) {
+				w.Write(tt.plan)
+			})
+			outputs := captureOutputs(t)
+
+			if err := writeInlinePlan(context.Background(), client, "plan-1", os.Getenv("GITHUB_OUTPUT")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			encoded, written := outputs()["plan-json-base64"]
+			if written != tt.wantWrite {
+				t.Fatalf("plan-json-base64 written = %t, want %t", written, tt.wantWrite)
+			}
+			if !written {
+				return
+			}
+			compressed, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatalf("invalid base64: %v", err)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("invalid gzip: %v", err)
+			}
+			decoded, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("invalid gzip: %v", err)
+			}
+			if !bytes.Equal(decoded, tt.plan) {
+				t.Errorf("decoded plan = %s, want %s", decoded, tt.plan)
+			}
+		})
+	}
+}
+
+func TestRunReadsOutputsFrom(t *testing.T) {
+	outputDoc := func(value string) string {
+		return `{"data":[{"id":"wsout-1","type":"state-version-outputs","attributes":{"name":"endpoint","sensitive":false,"value":"` + value + `"}}]}`
+	}
+	tests := []struct {
+		name string
+		from string
+		want string
+	}{
+		{name: "the run's workspace by default", want: "https://ws.example.com"},
+		{name: "the run's workspace by name", from: "ws", want: "https://ws.example.com"},
+		{name: "another workspace", from: "shared", want: "https://shared.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveRun(tfe.RunApplied)
+			stub.reply("GET", "/api/v2/organizations/org/workspaces/shared", http.StatusOK,
+				`{"data":{"id":"ws-2","type":"workspaces","attributes":{"name":"shared"}}}`)
+			stub.reply("GET", "/api/v2/workspaces/ws-1/current-state-version-outputs", http.StatusOK, outputDoc("https://ws.example.com"))
+			stub.reply("GET", "/api/v2/workspaces/ws-2/current-state-version-outputs", http.StatusOK, outputDoc("https://shared.example.com"))
+			outputs := captureOutputs(t)
+			setInput(t, &wait, "true")
+			setInput(t, &stateOutputs, "true")
+			setInput(t, &outputsFrom, tt.from)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := outputs()["output-endpoint"]; got != tt.want {
+				t.Errorf("output-endpoint = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteDriftResources(t *testing.T) {
+	tests := []struct {
+		name string
+		plan string
+		want string
+	}{
+		{name: "no drift", plan: `{"resource_changes":[{"address":"null_resource.a","change":{"actions":["create"]}}]}`, want: `[]`},
+		{
+			name: "drifted resources",
+			plan: `{"resource_drift":[
+				{"address":"aws_instance.web","change":{"actions":["update"]}},
+				{"address":"aws_instance.cache","change":{"actions":["no-op"]}},
+				{"address":"aws_instance.db","change":{"actions":["delete"]}}
+			]}`,
+			want: `["aws_instance.db","aws_instance.web"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.handle("GET", "/api/v2/plans/plan-1/json-output", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.plan))
+			})
+			outputs := captureOutputs(t)
+
+			if err := writeDriftResources(context.Background(), client, "plan-1"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := outputs()["drift-resources"]; got != tt.want {
+				t.Errorf("drift-resources = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWritesOutputsOnFlush(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	outputs := captureOutputs(t)
+	outputFile := os.Getenv("GITHUB_OUTPUT")
+	var whileWaiting []byte
+	stub.handle("GET", "/api/v2/runs/run-1", func(w http.ResponseWriter, r *http.Request) {
+		whileWaiting, _ = os.ReadFile(outputFile)
+		writeJSONAPI(w, http.StatusOK, `{"data":{"id":"run-1","type":"runs","attributes":{"status":"applied"}}}`)
+	})
+	setInput(t, &wait, "true")
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(whileWaiting) != 0 {
+		t.Errorf("GITHUB_OUTPUT while waiting = %q, want nothing written before the flush", whileWaiting)
+	}
+	written, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("could not read outputs: %v", err)
+	}
+	if !strings.Contains(string(written), "run-id=run-1\n") || !strings.Contains(string(written), "run-status=applied\n") {
+		t.Errorf("GITHUB_OUTPUT = %q, want run-id and run-status", written)
+	}
+	if got := outputs(); got["run-id"] != "run-1" {
+		t.Errorf("outputs = %v, want them written once", got)
+	}
+}
+
+func TestFlushOutputsWarnsOnFailure(t *testing.T) {
+	filename := t.TempDir() + "/missing/github_output"
+	appendToFile(filename, "run-id", "run-1")
+	appendMultilineToFile(filename, "variable-ids", "{}")
+
+	log := captureStdout(t, flushOutputs)
+
+	for _, key := range []string{"run-id", "variable-ids"} {
+		if !strings.Contains(log, "Warning: could not write "+key+" output") {
+			t.Errorf("log = %q, want the failure of %s reported", log, key)
+		}
+	}
+}
+
+func TestWriteDotenvFile(t *testing.T) {
+	filename := t.TempDir() + "/outputs.env"
+	entries := []pendingOutput{
+		{key: "run-id", value: "run-1"},
+		{key: "run-message", value: "deploy $VERSION"},
+		{key: "variable-ids", value: "{\n  \"a\": \"var-1\"\n}"},
+	}
+
+	if err := writeDotenvFile(filename, entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("could not read dotenv file: %v", err)
+	}
+	const want = "run-id=run-1\n" +
+		"run-message=\"deploy $VERSION\"\n" +
+		"variable-ids=\"{\\n  \\\"a\\\": \\\"var-1\\\"\\n}\"\n"
+	if string(data) != want {
+		t.Errorf("dotenv file = %q, want %q", data, want)
+	}
+}
+
+func TestRunWritesDotenvFileOutsideActions(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	t.Setenv("GITHUB_OUTPUT", "")
+	filename := t.TempDir() + "/outputs.env"
+	setInput(t, &dotenvFile, filename)
+
+	if got := outputPath(); got != os.DevNull {
+		t.Errorf("outputPath() = %q, want %q", got, os.DevNull)
+	}
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("could not read dotenv file: %v", err)
+	}
+	if !strings.Contains(string(data), "run-id=run-1\n") {
+		t.Errorf("dotenv file = %q, want the run-id output", data)
+	}
+}
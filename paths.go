@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// matchesPath reports whether a changed file matches a trigger pattern.
+// Patterns containing glob characters are matched with path.Match, any other
+// pattern matches the file itself or anything below it
+func matchesPath(pattern, file string) bool {
+	pattern = strings.TrimPrefix(pattern, "/")
+	file = strings.TrimPrefix(file, "/")
+	if strings.ContainsAny(pattern, "*?[") {
+		ok, _ := path.Match(pattern, file)
+		return ok
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	return pattern == "" || file == pattern || strings.HasPrefix(file, pattern+"/")
+}
+
+// triggerPaths returns the patterns deciding whether the workspace is
+// affected by a change: trigger-paths when set, otherwise the workspace's
+// working directory and trigger prefixes
+func triggerPaths(w *tfe.Workspace) []string {
+	if patterns := splitList(trigPaths); len(patterns) > 0 {
+		return patterns
+	}
+	var patterns []string
+	if w.WorkingDirectory != "" {
+		patterns = append(patterns, w.WorkingDirectory)
+	}
+	return append(patterns, w.TriggerPrefixes...)
+}
+
+// isAffected reports whether any of the changed files matches the patterns.
+// Without patterns every change affects the workspace
+func isAffected(patterns, changed []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, file := range changed {
+		for _, pattern := range patterns {
+			if matchesPath(pattern, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		pattern, file string
+		want          bool
+	}{
+		{"infra", "infra/main.tf", true},
+		{"infra/", "infra/modules/vpc/main.tf", true},
+		{"/infra", "infra/main.tf", true},
+		{"infra", "/infra/main.tf", true},
+		{"infra", "infra", true},
+		{"infra", "infrastructure/main.tf", false},
+		{"infra", "app/infra/main.tf", false},
+		{"infra/*.tf", "infra/main.tf", true},
+		{"infra/*.tf", "infra/modules/main.tf", false},
+		{"*.tfvars", "prod.tfvars", true},
+		{"env/?/main.tf", "env/a/main.tf", true},
+		{"env/[ab]/main.tf", "env/c/main.tf", false},
+		{"/", "anything.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.file, func(t *testing.T) {
+			if got := matchesPath(tt.pattern, tt.file); got != tt.want {
+				t.Errorf("matchesPath(%q, %q) = %t, want %t", tt.pattern, tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsAffected(t *testing.T) {
+	w := &tfe.Workspace{WorkingDirectory: "infra", TriggerPrefixes: []string{"modules"}}
+	tests := []struct {
+		name      string
+		trigger   string
+		changed   []string
+		workspace *tfe.Workspace
+		want      bool
+	}{
+		{name: "working directory", workspace: w, changed: []string{"README.md", "infra/main.tf"}, want: true},
+		{name: "trigger prefix", workspace: w, changed: []string{"modules/vpc/main.tf"}, want: true},
+		{name: "unrelated change", workspace: w, changed: []string{"app/main.go"}},
+		{name: "trigger-paths replace the workspace settings", workspace: w, trigger: "docs\napp/*", changed: []string{"app/main.go"}, want: true},
+		{name: "trigger-paths without a match", workspace: w, trigger: "app/*", changed: []string{"infra/main.tf"}},
+		{name: "no patterns", workspace: &tfe.Workspace{}, changed: []string{"anything"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &trigPaths, tt.trigger)
+			if got := isAffected(triggerPaths(tt.workspace), tt.changed); got != tt.want {
+				t.Errorf("isAffected() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// planHash hashes the resource changes of the plan JSON. Other parts of the
+// document, such as its timestamp or the prior state, differ between runs
+// planning the same changes, so hashing them would never match. Map keys are
+// sorted when re-encoding, which makes the hash canonical
+func planHash(ctx context.Context, client *tfe.Client, planID string) (string, error) {
+	planJSON, err := client.Plans.ReadJSONOutput(ctx, planID)
+	if err != nil {
+		return "", fmt.Errorf("unable to read plan JSON of %q: %w", planID, err)
+	}
+	var doc struct {
+		ResourceChanges interface{} `json:"resource_changes"`
+	}
+	if err := json.Unmarshal(planJSON, &doc); err != nil {
+		return "", fmt.Errorf("unable to decode plan JSON of %q: %w", planID, err)
+	}
+	canonical, err := json.Marshal(doc.ResourceChanges)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// verifyPlanHash refuses to apply the run unless the hash of its plan is
+// expected-plan-hash
+func verifyPlanHash(ctx context.Context, client *tfe.Client, r *tfe.Run) error {
+	if r.Plan == nil {
+		return fmt.Errorf("run %q has no plan to verify against expected-plan-hash", r.ID)
+	}
+	hash, err := planHash(ctx, client, r.Plan.ID)
+	if err != nil {
+		return err
+	}
+	if hash != expectedHash {
+		return fmt.Errorf("plan hash %s of run %q does not match expected-plan-hash %s, refusing to apply", hash, r.ID, expectedHash)
+	}
+	logInfo("Plan hash matches expected-plan-hash")
+	return nil
+}
+
+// verifyRequiredResource refuses to apply the run unless its plan changes
+// the require-resource address. A plan that leaves it untouched or only
+// reads it does not count
+func verifyRequiredResource(ctx context.Context, client *tfe.Client, r *tfe.Run) error {
+	if r.Plan == nil {
+		return fmt.Errorf("run %q has no plan to check for require-resource", r.ID)
+	}
+	planJSON, err := client.Plans.ReadJSONOutput(ctx, r.Plan.ID)
+	if err != nil {
+		return fmt.Errorf("unable to read plan JSON of %q: %w", r.Plan.ID, err)
+	}
+	var doc struct {
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+	}
+	if err := json.Unmarshal(planJSON, &doc); err != nil {
+		return fmt.Errorf("unable to decode plan JSON of %q: %w", r.Plan.ID, err)
+	}
+	for _, rc := range doc.ResourceChanges {
+		if rc.Address != requireRes {
+			continue
+		}
+		for _, action := range rc.Change.Actions {
+			if action != "no-op" && action != "read" {
+				logInfo("Plan changes required resource %s", requireRes)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("plan of run %q does not change require-resource %s, refusing to apply", r.ID, requireRes)
+}
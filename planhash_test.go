@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestPlanHash(t *testing.T) {
+	plans := map[string]string{
+		"plan-1": `{"timestamp":"2024-01-01T00:00:00Z","resource_changes":[{"address":"null_resource.a","change":{"actions":["create"],"after":{"a":1,"b":2}}}]}`,
+		"plan-2": `{"timestamp":"2024-02-01T00:00:00Z","resource_changes":[{"change":{"after":{"b":2,"a":1},"actions":["create"]},"address":"null_resource.a"}]}`,
+		"plan-3": `{"timestamp":"2024-01-01T00:00:00Z","resource_changes":[{"address":"null_resource.a","change":{"actions":["delete"]}}]}`,
+	}
+	stub, client := newTFEStub(t)
+	hashes := map[string]string{}
+	for id, doc := range plans {
+		stub.handle("GET", "/api/v2/plans/"+id+"/json-output", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(doc))
+		})
+	}
+	for id := range plans {
+		hash, err := planHash(context.Background(), client, id)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		hashes[id] = hash
+	}
+
+	if hashes["plan-1"] != hashes["plan-2"] {
+		t.Errorf("plans with the same changes hash to %s and %s", hashes["plan-1"], hashes["plan-2"])
+	}
+	if hashes["plan-1"] == hashes["plan-3"] {
+		t.Errorf("plans with different changes both hash to %s", hashes["plan-1"])
+	}
+}
+
+func TestConfirmRunVerifiesPlanHash(t *testing.T) {
+	const plan = `{"resource_changes":[{"address":"null_resource.a","change":{"actions":["create"]}}]}`
+	tests := []struct {
+		name      string
+		expected  func(hash string) string
+		wantApply bool
+	}{
+		{name: "matching hash", expected: func(hash string) string { return hash }, wantApply: true},
+		{name: "unexpected hash", expected: func(hash string) string { return strings.Repeat("0", len(hash)) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.handle("GET", "/api/v2/plans/plan-1/json-output", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(plan))
+			})
+			stub.handle("POST", "/api/v2/runs/run-1/actions/apply", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})
+			hash, err := planHash(context.Background(), client, "plan-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			setInput(t, &expectedHash, tt.expected(hash))
+
+			r := &tfe.Run{ID: "run-1", Plan: &tfe.Plan{ID: "plan-1"}}
+			err = confirmRun(context.Background(), client, r, waitOptions{})
+			if (err == nil) != tt.wantApply {
+				t.Errorf("confirmRun() error = %v, want apply %t", err, tt.wantApply)
+			}
+			if n := stub.count("POST", "/api/v2/runs/run-1/actions/apply"); (n > 0) != tt.wantApply {
+				t.Errorf("apply calls = %d, want apply %t", n, tt.wantApply)
+			}
+		})
+	}
+}
+
+func TestConfirmRunRequiresResource(t *testing.T) {
+	tests := []struct {
+		name      string
+		actions   string
+		wantApply bool
+	}{
+		{name: "resource changed", actions: `["delete","create"]`, wantApply: true},
+		{name: "resource untouched", actions: `["no-op"]`},
+		{name: "resource only read", actions: `["read"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := `{"resource_changes":[
+				{"address":"aws_instance.web","change":{"actions":["update"]}},
+				{"address":"aws_instance.db","change":{"actions":` + tt.actions + `}}
+			]}`
+			stub, client := newTFEStub(t)
+			stub.handle("GET", "/api/v2/plans/plan-1/json-output", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(plan))
+			})
+			stub.handle("POST", "/api/v2/runs/run-1/actions/apply", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusAccepted)
+			})
+			setInput(t, &requireRes, "aws_instance.db")
+
+			r := &tfe.Run{ID: "run-1", Plan: &tfe.Plan{ID: "plan-1"}}
+			err := confirmRun(context.Background(), client, r, waitOptions{})
+			if (err == nil) != tt.wantApply {
+				t.Errorf("confirmRun() error = %v, want apply %t", err, tt.wantApply)
+			}
+			if n := stub.count("POST", "/api/v2/runs/run-1/actions/apply"); (n > 0) != tt.wantApply {
+				t.Errorf("apply calls = %d, want apply %t", n, tt.wantApply)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// pollCurve describes how the interval between two checks of a run's status
+// grows while the run keeps the same status
+type pollCurve struct {
+	initial time.Duration
+	max     time.Duration
+	factor  float64
+}
+
+// defaultPollCurve checks early transitions quickly and slows down to a
+// check every 15 seconds during long plans and applies
+var defaultPollCurve = pollCurve{initial: time.Second * 2, max: time.Second * 15, factor: 1.5}
+
+// parsePollCurve reads the poll-interval, poll-max-interval and
+// poll-backoff inputs
+func parsePollCurve() (pollCurve, error) {
+	curve := defaultPollCurve
+	var err error
+	if curve.initial, err = parseDuration("poll-interval", pollInterval, defaultPollCurve.initial); err != nil {
+		return curve, err
+	}
+	if curve.max, err = parseDuration("poll-max-interval", pollMax, defaultPollCurve.max); err != nil {
+		return curve, err
+	}
+	if curve.max < curve.initial {
+		curve.max = curve.initial
+	}
+	if pollFactor != "" {
+		f, err := strconv.ParseFloat(pollFactor, 64)
+		if err != nil || f < 1 {
+			return curve, fmt.Errorf("invalid poll-backoff %q: must be a number of at least 1", pollFactor)
+		}
+		curve.factor = f
+	}
+	return curve, nil
+}
+
+// pollBackoff yields the successive poll intervals along a pollCurve
+type pollBackoff struct {
+	curve pollCurve
+	next  time.Duration
+}
+
+func newPollBackoff(curve pollCurve) *pollBackoff {
+	if curve.initial <= 0 {
+		curve = defaultPollCurve
+	}
+	return &pollBackoff{curve: curve, next: curve.initial}
+}
+
+// interval returns the time to wait before the next check and grows the
+// following one toward the cap
+func (b *pollBackoff) interval() time.Duration {
+	d := b.next
+	b.next = time.Duration(float64(b.next) * b.curve.factor)
+	if b.next > b.curve.max {
+		b.next = b.curve.max
+	}
+	return d
+}
+
+// reset starts the curve over, as a status change often announces others
+func (b *pollBackoff) reset() {
+	b.next = b.curve.initial
+}
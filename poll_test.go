@@ -0,0 +1,88 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPollBackoff(t *testing.T) {
+	tests := []struct {
+		name  string
+		curve pollCurve
+		want  []time.Duration
+	}{
+		{
+			name:  "default",
+			curve: defaultPollCurve,
+			want:  []time.Duration{2 * time.Second, 3 * time.Second, 4500 * time.Millisecond, 6750 * time.Millisecond, 10125 * time.Millisecond, 15 * time.Second, 15 * time.Second},
+		},
+		{
+			name:  "doubling up to a cap",
+			curve: pollCurve{initial: time.Second, max: 5 * time.Second, factor: 2},
+			want:  []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:  "constant",
+			curve: pollCurve{initial: time.Second, max: time.Second, factor: 1},
+			want:  []time.Duration{time.Second, time.Second, time.Second},
+		},
+		{
+			name:  "unset curve falls back to the default",
+			curve: pollCurve{},
+			want:  []time.Duration{2 * time.Second, 3 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newPollBackoff(tt.curve)
+			var got []time.Duration
+			for range tt.want {
+				got = append(got, b.interval())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("intervals = %v, want %v", got, tt.want)
+			}
+			b.reset()
+			if d := b.interval(); d != tt.want[0] {
+				t.Errorf("interval after reset = %s, want %s", d, tt.want[0])
+			}
+		})
+	}
+}
+
+func TestParsePollCurve(t *testing.T) {
+	tests := []struct {
+		name                   string
+		interval, max, backoff string
+		want                   pollCurve
+		wantErr                string
+	}{
+		{name: "defaults", want: defaultPollCurve},
+		{name: "custom", interval: "1s", max: "30s", backoff: "2", want: pollCurve{initial: time.Second, max: 30 * time.Second, factor: 2}},
+		{name: "max below interval", interval: "20s", want: pollCurve{initial: 20 * time.Second, max: 20 * time.Second, factor: 1.5}},
+		{name: "invalid interval", interval: "soon", wantErr: `invalid poll-interval "soon"`},
+		{name: "backoff below one", backoff: "0.5", wantErr: `invalid poll-backoff "0.5"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &pollInterval, tt.interval)
+			setInput(t, &pollMax, tt.max)
+			setInput(t, &pollFactor, tt.backoff)
+			got, err := parsePollCurve()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("curve = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
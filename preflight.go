@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// preflightCheck is a workspace permission the action needs and why
+type preflightCheck struct {
+	permission string
+	granted    bool
+	reason     string
+}
+
+// checkPermissions verifies, before anything is changed, that the token may
+// perform every operation the inputs will lead to, so that a missing
+// permission does not fail the action halfway through. The permissions are
+// those the API reports for the token when reading the workspace
+func checkPermissions(w *tfe.Workspace, command string, vars []workspaceVar) error {
+	p := w.Permissions
+	if p == nil {
+		logWarn("the workspace read did not report permissions, skipping the preflight check")
+		return nil
+	}
+
+	var checks []preflightCheck
+	if command == "upload-config" {
+		checks = append(checks, preflightCheck{"can-queue-run", p.CanQueueRun, "upload a configuration version"})
+	} else {
+		if dryRun != "true" {
+			if len(vars) > 0 || sourceWS != "" || prune == "true" {
+				checks = append(checks, preflightCheck{"can-update-variable", p.CanUpdateVariable, "write variables"})
+			}
+			if globalState != "" || consumers != "" {
+				checks = append(checks, preflightCheck{"can-update", p.CanUpdate, "change remote state sharing"})
+			}
+			if vcsRepo != "" || vcsBranch != "" || vcsOAuth != "" {
+				checks = append(checks, preflightCheck{"can-update", p.CanUpdate, "change the VCS connection"})
+			}
+		}
+		checks = append(checks, preflightCheck{"can-queue-run", p.CanQueueRun, "create the run"})
+		if autoApply == "true" && planOnly != "true" && dryRun != "true" {
+			checks = append(checks, preflightCheck{"can-queue-apply", p.CanQueueApply, "apply the run"})
+		}
+	}
+
+	var missing []string
+	for _, c := range checks {
+		if !c.granted {
+			missing = append(missing, fmt.Sprintf("%s (to %s)", c.permission, c.reason))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the token lacks permissions on workspace %q: %s", w.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// downgradeToPlanOnly turns an auto-apply run into a plan-only one when the
+// token may not apply runs and on-apply-denied is plan-only, so that the
+// changes are still planned for someone allowed to apply them
+func downgradeToPlanOnly(w *tfe.Workspace) {
+	if onApplyDeny != "plan-only" || autoApply != "true" || planOnly == "true" || dryRun == "true" {
+		return
+	}
+	if w.Permissions == nil || w.Permissions.CanQueueApply {
+		return
+	}
+	logWarn("the token lacks can-queue-apply on workspace %q, creating a plan-only run instead", w.Name)
+	planOnly = "true"
+}
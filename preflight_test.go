@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestCheckPermissions(t *testing.T) {
+	all := tfe.WorkspacePermissions{CanUpdate: true, CanUpdateVariable: true, CanQueueRun: true, CanQueueApply: true}
+	without := func(f func(p *tfe.WorkspacePermissions)) *tfe.WorkspacePermissions {
+		p := all
+		f(&p)
+		return &p
+	}
+	vars := []workspaceVar{{Key: "region", Value: "eu-west-1"}}
+
+	tests := []struct {
+		name        string
+		permissions *tfe.WorkspacePermissions
+		command     string
+		vars        []workspaceVar
+		inputs      map[*string]string
+		wantErr     string
+	}{
+		{name: "every permission", permissions: &all, vars: vars, inputs: map[*string]string{&autoApply: "true"}},
+		{name: "permissions not reported", vars: vars},
+		{
+			name:        "variable writes",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanUpdateVariable = false }),
+			vars:        vars,
+			wantErr:     "can-update-variable (to write variables)",
+		},
+		{
+			name:        "no variables to write",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanUpdateVariable = false }),
+		},
+		{
+			name:        "prune without variables",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanUpdateVariable = false }),
+			inputs:      map[*string]string{&prune: "true"},
+			wantErr:     "can-update-variable (to write variables)",
+		},
+		{
+			name:        "dry-run writes nothing",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanUpdateVariable = false }),
+			vars:        vars,
+			inputs:      map[*string]string{&dryRun: "true"},
+		},
+		{
+			name:        "run creation",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanQueueRun = false; p.CanUpdateVariable = false }),
+			vars:        vars,
+			wantErr:     "can-update-variable (to write variables), can-queue-run (to create the run)",
+		},
+		{
+			name:        "auto-apply",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanQueueApply = false }),
+			inputs:      map[*string]string{&autoApply: "true"},
+			wantErr:     "can-queue-apply (to apply the run)",
+		},
+		{
+			name:        "upload-config only queues",
+			permissions: without(func(p *tfe.WorkspacePermissions) { p.CanUpdateVariable = false }),
+			command:     "upload-config",
+			vars:        vars,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for input, value := range tt.inputs {
+				setInput(t, input, value)
+			}
+			w := &tfe.Workspace{Name: "ws", Permissions: tt.permissions}
+			err := checkPermissions(w, tt.command, tt.vars)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunChecksPermissionsFirst(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusOK, `{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws",
+		"permissions":{"can-update":true,"can-update-variable":false,"can-queue-run":true,"can-queue-apply":true}}}}`)
+	store := stub.serveVariables("ws-1")
+	setInput(t, &jsonVars, `[{"key":"region","value":"eu-west-1"}]`)
+
+	err := run(context.Background(), nil)
+	if err == nil || !strings.Contains(err.Error(), `the token lacks permissions on workspace "ws": can-update-variable (to write variables)`) {
+		t.Fatalf("error = %v, want the missing variable permission", err)
+	}
+	if len(store.snapshot()) != 0 || stub.count("POST", "/api/v2/runs") != 0 {
+		t.Error("the action changed the workspace before failing")
+	}
+}
+
+func TestRunOnApplyDenied(t *testing.T) {
+	tests := []struct {
+		name         string
+		onDenied     string
+		wantErr      string
+		wantPlanOnly bool
+	}{
+		{name: "fails by default", wantErr: "can-queue-apply"},
+		{name: "plan-only", onDenied: "plan-only", wantPlanOnly: true},
+		{name: "invalid", onDenied: "skip", wantErr: `invalid on-apply-denied "skip"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusOK, `{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws",
+				"permissions":{"can-update":true,"can-update-variable":true,"can-queue-run":true,"can-queue-apply":false}}}}`)
+			setInput(t, &autoApply, "true")
+			setInput(t, &planOnly, "")
+			setInput(t, &onApplyDeny, tt.onDenied)
+
+			err := run(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if n := stub.count("POST", "/api/v2/runs"); n != 0 {
+					t.Errorf("runs created = %d, want 0", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := createdRun(t, stub)["plan-only"]; got != tt.wantPlanOnly {
+				t.Errorf("plan-only = %v, want %t", got, tt.wantPlanOnly)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// provenancePrefix starts the description line recording where a variable
+// was last changed from, which is how a previous one is recognized
+const provenancePrefix = "Changed by terraform-cloud-action from "
+
+// stripProvenance removes the provenance line from a description
+func stripProvenance(description string) string {
+	var kept []string
+	for _, line := range strings.Split(description, "\n") {
+		if !strings.HasPrefix(line, provenancePrefix) {
+			kept = append(kept, line)
+		}
+	}
+	return strings.TrimRight(strings.Join(kept, "\n"), "\n")
+}
+
+// variableDescription returns the description to store for a created or
+// updated variable. With provenance, it is the declared description, or the
+// existing one when none is declared, followed by a line naming the commit
+// and the time of the change. The line replaces a prior one, so descriptions
+// never pile them up
+func variableDescription(v workspaceVar, existing *tfe.Variable, now time.Time) *string {
+	sha := os.Getenv("GITHUB_SHA")
+	if provenance != "true" || sha == "" {
+		return v.Description
+	}
+	description := ""
+	if v.Description != nil {
+		description = *v.Description
+	} else if existing != nil {
+		description = existing.Description
+	}
+	description = stripProvenance(description)
+
+	source := sha
+	if repo := os.Getenv("GITHUB_REPOSITORY"); repo != "" {
+		source = repo + "@" + sha
+	}
+	line := fmt.Sprintf("%s%s at %s", provenancePrefix, source, now.UTC().Format(time.RFC3339))
+	if description != "" {
+		line = description + "\n" + line
+	}
+	return &line
+}
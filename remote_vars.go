@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMaxVarsSize bounds the json-vars payload when max-vars-size is unset
+const defaultMaxVarsSize = 1 << 20
+
+// isRemoteVars reports whether json-vars points to a URL rather than holding
+// the variables inline
+func isRemoteVars(value string) bool {
+	return strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://")
+}
+
+// fetchRemoteVars downloads the json-vars payload from address. The response
+// must be JSON and no larger than limit bytes
+func fetchRemoteVars(ctx context.Context, address string, timeout time.Duration, limit int64) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid json-vars URL: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if varsAuth != "" {
+		req.Header.Set("Authorization", varsAuth)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch json-vars: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not fetch json-vars: unexpected status %s", resp.Status)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return "", fmt.Errorf("could not fetch json-vars: unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	if resp.ContentLength > limit {
+		return "", fmt.Errorf("json-vars payload is %d bytes, exceeding the %d byte limit", resp.ContentLength, limit)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("could not read json-vars: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return "", fmt.Errorf("json-vars payload exceeds the %d byte limit", limit)
+	}
+
+	return string(body), nil
+}
+
+// parseMaxVarsSize reads the max-vars-size input
+func parseMaxVarsSize() (int64, error) {
+	if maxVarsSize == "" {
+		return defaultMaxVarsSize, nil
+	}
+	n, err := strconv.ParseInt(maxVarsSize, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid max-vars-size %q: must be a positive number of bytes", maxVarsSize)
+	}
+	return n, nil
+}
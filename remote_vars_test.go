@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchRemoteVars(t *testing.T) {
+	const payload = `[{"key":"region","value":"eu-west-1"}]`
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		// chunked hides the length of the body, which is then only
+		// checked while reading it
+		chunked bool
+		auth    string
+		limit   int64
+		wantErr string
+	}{
+		{name: "valid payload", status: http.StatusOK, contentType: "application/json", body: payload, limit: 1024},
+		{name: "json suffix", status: http.StatusOK, contentType: "application/vnd.vars+json; charset=utf-8", body: payload, limit: 1024},
+		{name: "authorization header", status: http.StatusOK, contentType: "application/json", body: payload, auth: "Bearer abc", limit: 1024},
+		{name: "oversized payload", status: http.StatusOK, contentType: "application/json", body: payload, limit: 10, wantErr: "exceeding the 10 byte limit"},
+		{name: "oversized chunked payload", status: http.StatusOK, contentType: "application/json", body: payload, chunked: true, limit: 10, wantErr: "exceeds the 10 byte limit"},
+		{name: "not JSON", status: http.StatusOK, contentType: "text/html", body: "<html>", limit: 1024, wantErr: `unexpected content type "text/html"`},
+		{name: "error status", status: http.StatusForbidden, contentType: "application/json", body: "{}", limit: 1024, wantErr: "unexpected status 403"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotAuth string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotAuth = r.Header.Get("Authorization")
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+				if tt.chunked {
+					w.(http.Flusher).Flush()
+				}
+			}))
+			defer server.Close()
+			setInput(t, &varsAuth, tt.auth)
+
+			got, err := fetchRemoteVars(context.Background(), server.URL+"/vars.json", 5*time.Second, tt.limit)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.body {
+				t.Errorf("payload = %q, want %q", got, tt.body)
+			}
+			if gotAuth != tt.auth {
+				t.Errorf("Authorization = %q, want %q", gotAuth, tt.auth)
+			}
+		})
+	}
+}
+
+func TestParseMaxVarsSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "", want: defaultMaxVarsSize},
+		{value: "2048", want: 2048},
+		{value: "0", wantErr: true},
+		{value: "1MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			setInput(t, &maxVarsSize, tt.value)
+			got, err := parseMaxVarsSize()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseMaxVarsSize() = %d, %v, want %d, error %t", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunLimitsVarsSize(t *testing.T) {
+	const payload = `[{"key":"region","value":"eu-west-1"}]`
+	tests := []struct {
+		name    string
+		limit   int
+		wantErr string
+	}{
+		{name: "at the limit", limit: len(payload)},
+		{name: "over the limit", limit: len(payload) - 1, wantErr: "exceeding the 37 byte limit of max-vars-size"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			store := stub.serveVariables("ws-1")
+			setInput(t, &jsonVars, payload)
+			setInput(t, &maxVarsSize, strconv.Itoa(tt.limit))
+
+			err := run(context.Background(), nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(store.snapshot()) != 1 {
+					t.Errorf("variables = %+v, want region", store.snapshot())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if len(store.snapshot()) != 0 || stub.count("POST", "/api/v2/runs") != 0 {
+				t.Error("the action changed the workspace before rejecting json-vars")
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errRetryBudgetExhausted is returned in place of a retryable response once
+// the action has spent its whole retry budget
+var errRetryBudgetExhausted = errors.New("retry budget exhausted")
+
+// retryBudget bounds the total time the action spends backing off between
+// retries, across every API call it makes
+type retryBudget struct {
+	limit time.Duration
+
+	mu      sync.Mutex
+	spent   time.Duration
+	retries int
+	// failed holds when the pending attempts of each request failed, keyed
+	// by attemptKey
+	failed map[string][]time.Time
+}
+
+func newRetryBudget(limit time.Duration) *retryBudget {
+	return &retryBudget{limit: limit, failed: map[string][]time.Time{}}
+}
+
+// attemptKey identifies the attempts of a request. They cannot be matched by
+// *http.Request: http.Client hands the transport a copy of the request on
+// every attempt once a timeout is set
+func attemptKey(req *http.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// charge records a new attempt of req. If a previous attempt of the same
+// request failed, the time waited since then is taken from the budget
+func (b *retryBudget) charge(req *http.Request) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := attemptKey(req)
+	pending := b.failed[key]
+	if len(pending) == 0 {
+		return nil
+	}
+	failedAt := pending[0]
+	if len(pending) == 1 {
+		delete(b.failed, key)
+	} else {
+		b.failed[key] = pending[1:]
+	}
+	b.spent += time.Since(failedAt)
+	b.retries++
+	if b.limit > 0 && b.spent >= b.limit {
+		return fmt.Errorf("%w after %d retries (%s spent, limit %s)", errRetryBudgetExhausted, b.retries, b.spent.Round(time.Millisecond), b.limit)
+	}
+	return nil
+}
+
+// fail records that an attempt of req failed and is about to be retried
+func (b *retryBudget) fail(req *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	key := attemptKey(req)
+	b.failed[key] = append(b.failed[key], time.Now())
+}
+
+// budgetTransport charges the time spent between retried attempts against a
+// retryBudget. Failed responses are recorded by the client's retry hook, which
+// go-tfe only calls when it schedules a retry, so that a final response never
+// leaves a pending failure behind. Transport errors are not retried, so they
+// are never recorded. Consecutive attempts are matched by method and URL
+type budgetTransport struct {
+	next   http.RoundTripper
+	budget *retryBudget
+}
+
+func (t *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.budget.charge(req); err != nil {
+		return nil, err
+	}
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetMatchesCopiedRequests(t *testing.T) {
+	b := newRetryBudget(time.Hour)
+	req, _ := http.NewRequest("GET", "https://app.terraform.io/api/v2/runs/run-1", nil)
+
+	b.fail(req)
+	// http.Client passes the transport a copy once a timeout is set
+	if err := b.charge(req.Clone(context.Background())); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.retries != 1 {
+		t.Errorf("retries = %d, want 1", b.retries)
+	}
+	if len(b.failed) != 0 {
+		t.Errorf("pending failures = %v, want none", b.failed)
+	}
+}
+
+func TestRetryBudgetStopsRetrying(t *testing.T) {
+	for _, timeout := range []time.Duration{0, 10 * time.Second} {
+		t.Run(timeout.String(), func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			setInput(t, &url, stub.URL)
+			setInput(t, &tfeToken, "test-token")
+			stub.reply("GET", "/api/v2/organizations/org", http.StatusTooManyRequests, `{"errors":[{"status":"429"}]}`)
+
+			// Longer than the 400ms longest wait of go-tfe, so that the
+			// first retry always fits
+			budget := newRetryBudget(time.Second)
+			client, err := newClient(newActionMetrics(), budget, timeout)
+			if err != nil {
+				t.Fatalf("could not create client: %v", err)
+			}
+
+			start := time.Now()
+			_, err = client.Organizations.Read(context.Background(), "org")
+			if !errors.Is(err, errRetryBudgetExhausted) {
+				t.Fatalf("error = %v, want %v", err, errRetryBudgetExhausted)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("retried for %s despite the budget", elapsed)
+			}
+			if n := stub.count("GET", "/api/v2/organizations/org"); n < 2 {
+				t.Errorf("attempts = %d, want the request retried before the budget ran out", n)
+			}
+		})
+	}
+}
+
+func TestRetryBudgetFinalResponseLeavesNothingPending(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	setInput(t, &url, stub.URL)
+	setInput(t, &tfeToken, "test-token")
+	attempts := 0
+	stub.handle("GET", "/api/v2/organizations/org", func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			writeJSONAPI(w, http.StatusTooManyRequests, `{"errors":[{"status":"429"}]}`)
+			return
+		}
+		writeJSONAPI(w, http.StatusNotFound, `{"errors":[{"status":"404"}]}`)
+	})
+
+	budget := newRetryBudget(time.Minute)
+	client, err := newClient(newActionMetrics(), budget, 10*time.Second)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	client.Organizations.Read(context.Background(), "org")
+
+	if budget.retries != 1 {
+		t.Errorf("retries = %d, want 1", budget.retries)
+	}
+	if len(budget.failed) != 0 {
+		t.Errorf("pending failures = %v, want none", budget.failed)
+	}
+}
+
+func TestRetryBudgetIgnoresTransportErrors(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	setInput(t, &url, stub.URL)
+	setInput(t, &tfeToken, "test-token")
+	var mu sync.Mutex
+	broken := true
+	stub.handle("GET", "/api/v2/organizations/org", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if broken {
+			// Drop the connection without a response
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		writeJSONAPI(w, http.StatusOK, `{"data":{"id":"org","type":"organizations","attributes":{"name":"org"}}}`)
+	})
+
+	budget := newRetryBudget(20 * time.Millisecond)
+	client, err := newClient(newActionMetrics(), budget, 0)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	if _, err := client.Organizations.Read(context.Background(), "org"); err == nil {
+		t.Fatal("expected the dropped connection to fail the request")
+	}
+	mu.Lock()
+	broken = false
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	// The next request is a new one, not a retry charged for the wait
+	if _, err := client.Organizations.Read(context.Background(), "org"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if budget.retries != 0 {
+		t.Errorf("retries = %d, want 0", budget.retries)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// structuredLogLine is a line of the JSON log Terraform writes for
+// workspaces using structured run output
+type structuredLogLine struct {
+	Level   string `json:"@level"`
+	Message string `json:"@message"`
+	Type    string `json:"type"`
+	Changes *struct {
+		Add    int `json:"add"`
+		Change int `json:"change"`
+		Remove int `json:"remove"`
+	} `json:"changes"`
+	Diagnostic *struct {
+		Summary string `json:"summary"`
+		Detail  string `json:"detail"`
+		Range   *struct {
+			Filename string `json:"filename"`
+			Start    struct {
+				Line int `json:"line"`
+			} `json:"start"`
+		} `json:"range"`
+	} `json:"diagnostic"`
+}
+
+// changeCounts are the resource counts of a plan
+type changeCounts struct {
+	add, change, destroy int
+}
+
+// rawChangeSummary matches the summary line of unstructured plan logs, once
+// stripped of the ansiEscape color codes
+var (
+	rawChangeSummary = regexp.MustCompile(`Plan: (\d+) to add, (\d+) to change, (\d+) to destroy`)
+	ansiEscape       = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+)
+
+// parseLogLine decodes a structured log line. Unstructured lines, including
+// the control characters framing raw logs, are reported with ok false
+func parseLogLine(line string) (structuredLogLine, bool) {
+	var l structuredLogLine
+	line = strings.Trim(line, "\x02\x03")
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &l) != nil || l.Message == "" {
+		return l, false
+	}
+	return l, true
+}
+
+// logMessage returns the human-readable text of a log line, which is the
+// message of structured lines and the line itself otherwise
+func logMessage(line string) string {
+	if l, ok := parseLogLine(line); ok {
+		return l.Message
+	}
+	return strings.Trim(line, "\x02\x03")
+}
+
+// parseChangeCounts extracts the resource counts from plan logs, in the
+// structured format or falling back to the summary line of raw logs
+func parseChangeCounts(sc *bufio.Scanner) (changeCounts, bool, error) {
+	var counts changeCounts
+	found := false
+	for sc.Scan() {
+		line := sc.Text()
+		if l, ok := parseLogLine(line); ok {
+			if l.Type == "change_summary" && l.Changes != nil {
+				counts = changeCounts{l.Changes.Add, l.Changes.Change, l.Changes.Remove}
+				found = true
+			}
+			continue
+		}
+		if m := rawChangeSummary.FindStringSubmatch(ansiEscape.ReplaceAllString(line, "")); m != nil {
+			counts.add, _ = strconv.Atoi(m[1])
+			counts.change, _ = strconv.Atoi(m[2])
+			counts.destroy, _ = strconv.Atoi(m[3])
+			found = true
+		}
+	}
+	return counts, found, sc.Err()
+}
+
+// writeLogURLs writes the plan-log-url and apply-log-url outputs, the
+// log-read-url links of the plan and apply of the run. They can be opened
+// without a token but expire, so they are read as late as possible. A link
+// that cannot be read is left out with a warning
+func writeLogURLs(ctx context.Context, client *tfe.Client, r *tfe.Run) {
+	outputFile := outputPath()
+	// An interrupted action cannot read them anymore
+	if outputFile == "" || ctx.Err() != nil {
+		return
+	}
+	if r.Plan != nil {
+		if plan, err := client.Plans.Read(ctx, r.Plan.ID); err != nil {
+			logWarn("could not read plan %q for plan-log-url: %v", r.Plan.ID, err)
+		} else if plan.LogReadURL != "" {
+			appendToFile(outputFile, "plan-log-url", plan.LogReadURL)
+		}
+	}
+	if r.Apply != nil {
+		if apply, err := client.Applies.Read(ctx, r.Apply.ID); err != nil {
+			logWarn("could not read apply %q for apply-log-url: %v", r.Apply.ID, err)
+		} else if apply.LogReadURL != "" {
+			appendToFile(outputFile, "apply-log-url", apply.LogReadURL)
+		}
+	}
+}
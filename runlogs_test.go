@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestWriteLogURLs(t *testing.T) {
+	const (
+		planLog  = "https://archivist.terraform.io/v1/object/plan-log?sig=abc"
+		applyLog = "https://archivist.terraform.io/v1/object/apply-log?sig=def"
+	)
+	planDoc := `{"data":{"id":"plan-1","type":"plans","attributes":{"log-read-url":"` + planLog + `"}}}`
+	applyDoc := `{"data":{"id":"apply-1","type":"applies","attributes":{"log-read-url":"` + applyLog + `"}}}`
+
+	tests := []struct {
+		name        string
+		run         *tfe.Run
+		planFails   bool
+		interrupted bool
+		want        map[string]string
+	}{
+		{
+			name: "plan and apply",
+			run:  &tfe.Run{ID: "run-1", Plan: &tfe.Plan{ID: "plan-1"}, Apply: &tfe.Apply{ID: "apply-1"}},
+			want: map[string]string{"plan-log-url": planLog, "apply-log-url": applyLog},
+		},
+		{
+			name:      "unreadable plan is left out",
+			run:       &tfe.Run{ID: "run-1", Plan: &tfe.Plan{ID: "plan-1"}, Apply: &tfe.Apply{ID: "apply-1"}},
+			planFails: true,
+			want:      map[string]string{"apply-log-url": applyLog},
+		},
+		{
+			name: "run without an apply",
+			run:  &tfe.Run{ID: "run-1", Plan: &tfe.Plan{ID: "plan-1"}},
+			want: map[string]string{"plan-log-url": planLog},
+		},
+		{
+			name:        "interrupted",
+			run:         &tfe.Run{ID: "run-1", Plan: &tfe.Plan{ID: "plan-1"}, Apply: &tfe.Apply{ID: "apply-1"}},
+			interrupted: true,
+			want:        map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			if !tt.planFails {
+				stub.reply("GET", "/api/v2/plans/plan-1", http.StatusOK, planDoc)
+			}
+			stub.reply("GET", "/api/v2/applies/apply-1", http.StatusOK, applyDoc)
+			outputs := captureOutputs(t)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.interrupted {
+				cancel()
+			}
+			writeLogURLs(ctx, client, tt.run)
+
+			got := outputs()
+			for _, key := range []string{"plan-log-url", "apply-log-url"} {
+				if got[key] != tt.want[key] {
+					t.Errorf("%s = %q, want %q", key, got[key], tt.want[key])
+				}
+			}
+		})
+	}
+}
+
+func TestParseChangeCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		log       string
+		want      changeCounts
+		wantFound bool
+	}{
+		{
+			name: "structured",
+			log: `{"@level":"info","@message":"Terraform 1.6.0","type":"version"}
+{"@level":"info","@message":"Plan: 1 to add, 2 to change, 3 to destroy.","type":"change_summary","changes":{"add":1,"change":2,"remove":3,"operation":"plan"}}`,
+			want:      changeCounts{1, 2, 3},
+			wantFound: true,
+		},
+		{
+			name:      "raw",
+			log:       "\x02Terraform will perform the following actions:\n\nPlan: 4 to add, 0 to change, 1 to destroy.\n\x03",
+			want:      changeCounts{4, 0, 1},
+			wantFound: true,
+		},
+		{
+			name:      "raw with colors",
+			log:       "\x1b[0m\x1b[1mPlan:\x1b[0m 2 to add, 1 to change, 0 to destroy.\x1b[0m",
+			want:      changeCounts{2, 1, 0},
+			wantFound: true,
+		},
+		{
+			name:      "structured summary message is not read as raw",
+			log:       `{"@level":"info","@message":"Plan: 9 to add, 9 to change, 9 to destroy.","type":"log"}`,
+			wantFound: false,
+		},
+		{
+			name: "no changes",
+			log:  "No changes. Your infrastructure matches the configuration.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := parseChangeCounts(bufio.NewScanner(strings.NewReader(tt.log)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if found != tt.wantFound || got != tt.want {
+				t.Errorf("parseChangeCounts() = %+v, %t, want %+v, %t", got, found, tt.want, tt.wantFound)
+			}
+		})
+	}
+}
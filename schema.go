@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// validateVarsSchema validates the json-vars payload against a JSON Schema,
+// reporting every violation with its location in the payload
+func validateVarsSchema(payload, schema string) error {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("vars-schema.json", strings.NewReader(schema)); err != nil {
+		return fmt.Errorf("could not load vars-schema: %w", err)
+	}
+	compiled, err := compiler.Compile("vars-schema.json")
+	if err != nil {
+		return fmt.Errorf("could not compile vars-schema: %w", err)
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		return err
+	}
+
+	err = compiled.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	var violations []string
+	collectViolations(ve, &violations)
+	return fmt.Errorf("json-vars does not match vars-schema:\n  %s", strings.Join(violations, "\n  "))
+}
+
+// collectViolations flattens the leaf causes of a validation error, which
+// are the precise violations
+func collectViolations(ve *jsonschema.ValidationError, violations *[]string) {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		*violations = append(*violations, fmt.Sprintf("%s: %s", location, ve.Message))
+		return
+	}
+	for _, cause := range ve.Causes {
+		collectViolations(cause, violations)
+	}
+}
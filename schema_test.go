@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVarsSchema(t *testing.T) {
+	const schema = `{
+		"type": "array",
+		"minItems": 1,
+		"items": {
+			"type": "object",
+			"required": ["key", "value"],
+			"properties": {"key": {"type": "string", "pattern": "^[a-z_]+$"}}
+		}
+	}`
+	tests := []struct {
+		name    string
+		payload string
+		wantErr string
+	}{
+		{name: "valid", payload: `[{"key": "region", "value": "eu-west-1"}]`},
+		{name: "empty payload", payload: "", wantErr: "/: minimum 1 items required"},
+		{name: "whitespace payload", payload: " \n", wantErr: "/: minimum 1 items required"},
+		{name: "empty list", payload: "[]", wantErr: "/: minimum 1 items required"},
+		{name: "missing value", payload: `[{"key": "region"}]`, wantErr: "/0: missing properties: 'value'"},
+		{name: "invalid key", payload: `[{"key": "Region", "value": "x"}]`, wantErr: "/0/key: does not match pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &varsSchema, schema)
+			_, err := parseVars(tt.payload)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
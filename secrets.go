@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// redactedValue replaces sensitive values wherever they would be shown, in
+// the diff report and in the logged inputs
+const redactedValue = "(sensitive)"
+
+// secretRef returns the name of the secret a json-vars value references as
+// {"secretRef": "NAME"}, if any
+func secretRef(value interface{}) (string, bool) {
+	m, ok := value.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return "", false
+	}
+	name, ok := m["secretRef"].(string)
+	return name, ok
+}
+
+// readSecretsFile reads a JSON object mapping secret names to their values
+func readSecretsFile(filename string) (map[string]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read secrets-file: %w", err)
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("could not decode secrets-file. Make sure that this is a map of secret names to string values: %w", err)
+	}
+	return secrets, nil
+}
+
+// resolveSecretRefs replaces secretRef values in json-vars with the secret
+// they name from the secrets file. Resolved variables are always stored as
+// sensitive and their values are masked in the logs
+func resolveSecretRefs(vars []workspaceVar, filename string) error {
+	var secrets map[string]string
+	for i, v := range vars {
+		name, ok := secretRef(v.Value)
+		if !ok {
+			continue
+		}
+		if secrets == nil {
+			if filename == "" {
+				return fmt.Errorf("variable %q references secret %q but no secrets-file is set", v.Key, name)
+			}
+			var err error
+			if secrets, err = readSecretsFile(filename); err != nil {
+				return err
+			}
+		}
+		value, ok := secrets[name]
+		if !ok {
+			return fmt.Errorf("variable %q references secret %q, which is not in secrets-file", v.Key, name)
+		}
+		maskValue(value)
+		sensitive := true
+		vars[i].Value = value
+		vars[i].Sensitive = &sensitive
+	}
+	return nil
+}
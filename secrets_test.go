@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunResolvesSecretRefs(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	store := stub.serveVariables("ws-1")
+	filename := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(filename, []byte(`{"DB_PASSWORD":"hunter2"}`), 0600); err != nil {
+		t.Fatalf("could not write secrets-file: %v", err)
+	}
+	setInput(t, &secretsFile, filename)
+	setInput(t, &jsonVars, `[{"key":"db_password","value":{"secretRef":"DB_PASSWORD"},"sensitive":false}]`)
+
+	var err error
+	stdout := captureStdout(t, func() { err = run(context.Background(), nil) })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stored := store.snapshot()
+	if len(stored) != 1 || stored[0].Value != "hunter2" || !stored[0].Sensitive {
+		t.Errorf("variables = %+v, want db_password stored as a sensitive hunter2", stored)
+	}
+	if !strings.Contains(stdout, "::add-mask::hunter2\n") {
+		t.Errorf("log = %q, want the secret masked", stdout)
+	}
+}
+
+func TestRunRejectsUnresolvedSecretRefs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(filename, []byte(`{"OTHER":"x"}`), 0600); err != nil {
+		t.Fatalf("could not write secrets-file: %v", err)
+	}
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{name: "no secrets-file", wantErr: `references secret "DB_PASSWORD" but no secrets-file is set`},
+		{name: "missing secret", file: filename, wantErr: `references secret "DB_PASSWORD", which is not in secrets-file`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveVariables("ws-1")
+			setInput(t, &secretsFile, tt.file)
+			setInput(t, &jsonVars, `[{"key":"db_password","value":{"secretRef":"DB_PASSWORD"}}]`)
+
+			err := run(context.Background(), nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// tfeStub is a minimal Terraform Cloud API answering the requests it has a
+// handler for, keyed by method and path, with a 404 for anything else
+type tfeStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	prefixes map[string]http.HandlerFunc
+	// mount, when set, is the path the API is served under, as behind a
+	// reverse proxy. Requests outside of it get a 404
+	mount  string
+	calls  []string
+	bodies map[string][]string
+}
+
+// newTFEStub starts a stub and returns it with a client talking to it
+func newTFEStub(t *testing.T) (*tfeStub, *tfe.Client) {
+	t.Helper()
+	s := &tfeStub{handlers: map[string]http.HandlerFunc{}, prefixes: map[string]http.HandlerFunc{}, bodies: map[string][]string{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	client, err := tfe.NewClient(&tfe.Config{Address: s.URL, Token: "test-token"})
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	return s, client
+}
+
+func (s *tfeStub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	mount := s.mount
+	s.mu.Unlock()
+	if mount != "" {
+		path, ok := strings.CutPrefix(r.URL.Path, mount)
+		if !ok {
+			writeJSONAPI(w, http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+			return
+		}
+		r.URL.Path = path
+	}
+
+	key := r.Method + " " + r.URL.Path
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	s.calls = append(s.calls, key)
+	s.bodies[key] = append(s.bodies[key], string(body))
+	h := s.handlers[key]
+	if h == nil {
+		for prefix, ph := range s.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				h = ph
+			}
+		}
+	}
+	s.mu.Unlock()
+	r.Body = io.NopCloser(strings.NewReader(string(body)))
+
+	if r.URL.Path == "/api/v2/ping" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if h == nil {
+		writeJSONAPI(w, http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+		return
+	}
+	h(w, r)
+}
+
+// serveUnder moves the API under path, like a reverse proxy serving it there
+func (s *tfeStub) serveUnder(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mount = path
+}
+
+// handle registers the handler of the requests with method to path
+func (s *tfeStub) handle(method, path string, h http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method+" "+path] = h
+}
+
+// handlePrefix registers the handler of the requests with method to any
+// path below prefix that has no handler of its own
+func (s *tfeStub) handlePrefix(method, prefix string, h http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prefixes[method+" "+prefix] = h
+}
+
+// reply registers a handler answering with a fixed status and document
+func (s *tfeStub) reply(method, path string, status int, doc string) {
+	s.handle(method, path, func(w http.ResponseWriter, r *http.Request) {
+		writeJSONAPI(w, status, doc)
+	})
+}
+
+// count returns how many requests with method to path were received
+func (s *tfeStub) count(method, path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.calls {
+		if c == method+" "+path {
+			n++
+		}
+	}
+	return n
+}
+
+// requestBodies returns the bodies of the requests with method to path
+func (s *tfeStub) requestBodies(method, path string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.bodies[method+" "+path]...)
+}
+
+// serveWorkspace registers the workspace "ws" of organization "org" as ws-1,
+// without variables and with the configuration version cv-1, and points the
+// inputs of run to the stub, polling it quickly. Runs created on it are run-1
+func (s *tfeStub) serveWorkspace(t *testing.T) {
+	t.Helper()
+	setInput(t, &url, s.URL)
+	setInput(t, &pollInterval, "10ms")
+	setInput(t, &tfeToken, "test-token")
+	setInput(t, &organization, "org")
+	setInput(t, &workspace, "ws")
+	setInput(t, &jsonVars, "[]")
+	s.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusOK,
+		`{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws"}}}`)
+	s.reply("GET", "/api/v2/workspaces/ws-1/vars", http.StatusOK, listDoc())
+	s.reply("GET", "/api/v2/workspaces/ws-1/configuration-versions", http.StatusOK,
+		listDoc(`{"id":"cv-1","type":"configuration-versions","attributes":{"status":"uploaded"}}`))
+	s.reply("POST", "/api/v2/runs", http.StatusCreated, createdRunDoc)
+}
+
+// createdRunDoc is the run-1 the stub answers a run creation with
+const createdRunDoc = `{"data":{"id":"run-1","type":"runs","attributes":{"status":"pending"},` +
+	`"relationships":{"plan":{"data":{"id":"plan-1","type":"plans"}}}}}`
+
+// serveRun answers the reads of run-1 with status, planned by plan-1
+func (s *tfeStub) serveRun(status tfe.RunStatus) {
+	s.reply("GET", "/api/v2/runs/run-1", http.StatusOK, fmt.Sprintf(`{"data":{"id":"run-1","type":"runs","attributes":{"status":%q},`+
+		`"relationships":{"plan":{"data":{"id":"plan-1","type":"plans"}}}}}`, status))
+}
+
+// serveUpload accepts the configuration version cv-2 created on ws-1, with
+// its upload URL on the stub, and reports it uploaded once it is read
+func (s *tfeStub) serveUpload() {
+	s.reply("POST", "/api/v2/workspaces/ws-1/configuration-versions", http.StatusCreated, fmt.Sprintf(
+		`{"data":{"id":"cv-2","type":"configuration-versions","attributes":{"status":"pending","upload-url":%q}}}`, s.URL+"/upload/cv-2"))
+	s.handle("PUT", "/upload/cv-2", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	s.reply("GET", "/api/v2/configuration-versions/cv-2", http.StatusOK,
+		`{"data":{"id":"cv-2","type":"configuration-versions","attributes":{"status":"uploaded"}}}`)
+}
+
+func writeJSONAPI(w http.ResponseWriter, status int, doc string) {
+	w.Header().Set("Content-Type", tfe.ContentTypeJSONAPI)
+	w.WriteHeader(status)
+	if doc != "" {
+		io.WriteString(w, doc)
+	}
+}
+
+// runDoc renders a run document with the given status and actions
+func runDoc(id string, status tfe.RunStatus, cancelable, discardable bool) string {
+	return fmt.Sprintf(`{"data":{"id":%q,"type":"runs","attributes":{"status":%q,"actions":{"is-cancelable":%t,"is-discardable":%t}}}}`,
+		id, status, cancelable, discardable)
+}
+
+// variableDoc renders a variable resource for a variables listing
+func variableDoc(id, key, value string, category tfe.CategoryType, sensitive bool) string {
+	return fmt.Sprintf(`{"id":%q,"type":"vars","attributes":{"key":%q,"value":%q,"category":%q,"sensitive":%t,"hcl":false}}`,
+		id, key, value, category, sensitive)
+}
+
+// listDoc renders a listing of resources on a single page
+func listDoc(resources ...string) string {
+	return fmt.Sprintf(`{"data":[%s],"meta":{"pagination":{"current-page":1,"total-pages":1,"total-count":%d}}}`,
+		strings.Join(resources, ","), len(resources))
+}
+
+// captureOutputs points GITHUB_OUTPUT to a temporary file and returns a
+// function flushing the buffered outputs and reading them back by key
+func captureOutputs(t *testing.T) func() map[string]string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "github_output")
+	t.Setenv("GITHUB_OUTPUT", file)
+	return func() map[string]string {
+		t.Helper()
+		flushOutputs()
+		data, err := os.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("could not read outputs: %v", err)
+		}
+		outputs := map[string]string{}
+		lines := strings.Split(string(data), "\n")
+		for i := 0; i < len(lines); i++ {
+			if key, delimiter, ok := strings.Cut(lines[i], "<<"); ok {
+				var value []string
+				for i++; i < len(lines) && lines[i] != delimiter; i++ {
+					value = append(value, lines[i])
+				}
+				outputs[key] = strings.Join(value, "\n")
+			} else if key, value, ok := strings.Cut(lines[i], "="); ok {
+				outputs[key] = value
+			}
+		}
+		return outputs
+	}
+}
+
+// setInput sets an input global for the duration of the test
+func setInput(t *testing.T, input *string, value string) {
+	t.Helper()
+	prev := *input
+	*input = value
+	t.Cleanup(func() { *input = prev })
+}
+
+// fakeVariable is a workspace variable held by a variableStore
+type fakeVariable struct {
+	ID          string
+	Key         string
+	Value       string
+	Description string
+	Category    string
+	HCL         bool
+	Sensitive   bool
+}
+
+// variableStore serves the variables API of a workspace from memory,
+// enforcing the uniqueness of keys within a category like the real API
+type variableStore struct {
+	mu   sync.Mutex
+	vars []*fakeVariable
+	next int
+	// fail, when set, makes the request fail with a 500 when it returns true
+	fail func(method, key string) bool
+}
+
+// serveVariables registers a variableStore for the variables of workspaceID
+func (s *tfeStub) serveVariables(workspaceID string, initial ...fakeVariable) *variableStore {
+	store := &variableStore{}
+	for _, v := range initial {
+		v := v
+		store.vars = append(store.vars, &v)
+	}
+	path := "/api/v2/workspaces/" + workspaceID + "/vars"
+	s.handle("GET", path, store.list)
+	s.handle("POST", path, store.create)
+	s.handlePrefix("PATCH", path+"/", store.update)
+	s.handlePrefix("DELETE", path+"/", store.delete)
+	return store
+}
+
+// snapshot returns the variables sorted by category and key
+func (st *variableStore) snapshot() []fakeVariable {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var out []fakeVariable
+	for _, v := range st.vars {
+		out = append(out, *v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Category+"/"+out[i].Key < out[j].Category+"/"+out[j].Key
+	})
+	return out
+}
+
+func (v *fakeVariable) doc() string {
+	value := v.Value
+	if v.Sensitive {
+		value = ""
+	}
+	return fmt.Sprintf(`{"id":%q,"type":"vars","attributes":{"key":%q,"value":%q,"description":%q,"category":%q,"hcl":%t,"sensitive":%t}}`,
+		v.ID, v.Key, value, v.Description, v.Category, v.HCL, v.Sensitive)
+}
+
+type variableAttributes struct {
+	Key         *string `json:"key"`
+	Value       *string `json:"value"`
+	Description *string `json:"description"`
+	Category    *string `json:"category"`
+	HCL         *bool   `json:"hcl"`
+	Sensitive   *bool   `json:"sensitive"`
+}
+
+func decodeVariable(r *http.Request) (variableAttributes, error) {
+	var doc struct {
+		Data struct {
+			Attributes variableAttributes `json:"attributes"`
+		} `json:"data"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&doc)
+	return doc.Data.Attributes, err
+}
+
+func (st *variableStore) failed(w http.ResponseWriter, method, key string) bool {
+	if st.fail != nil && st.fail(method, key) {
+		writeJSONAPI(w, http.StatusInternalServerError, `{"errors":[{"status":"500","title":"injected failure"}]}`)
+		return true
+	}
+	return false
+}
+
+func (st *variableStore) find(id string) *fakeVariable {
+	for _, v := range st.vars {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (st *variableStore) list(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var docs []string
+	for _, v := range st.vars {
+		docs = append(docs, v.doc())
+	}
+	writeJSONAPI(w, http.StatusOK, listDoc(docs...))
+}
+
+func (st *variableStore) create(w http.ResponseWriter, r *http.Request) {
+	attrs, err := decodeVariable(r)
+	if err != nil || attrs.Key == nil {
+		writeJSONAPI(w, http.StatusBadRequest, `{"errors":[{"status":"400","title":"bad request"}]}`)
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.failed(w, "POST", *attrs.Key) {
+		return
+	}
+	v := &fakeVariable{Key: *attrs.Key, Category: string(tfe.CategoryTerraform)}
+	if attrs.Category != nil {
+		v.Category = *attrs.Category
+	}
+	for _, existing := range st.vars {
+		if existing.Key == v.Key && existing.Category == v.Category {
+			writeJSONAPI(w, http.StatusUnprocessableEntity, `{"errors":[{"status":"422","title":"Key has already been taken"}]}`)
+			return
+		}
+	}
+	st.next++
+	v.ID = fmt.Sprintf("var-%d", st.next)
+	v.apply(attrs)
+	st.vars = append(st.vars, v)
+	writeJSONAPI(w, http.StatusCreated, `{"data":`+v.doc()+`}`)
+}
+
+func (v *fakeVariable) apply(attrs variableAttributes) {
+	if attrs.Key != nil {
+		v.Key = *attrs.Key
+	}
+	if attrs.Value != nil {
+		v.Value = *attrs.Value
+	}
+	if attrs.Description != nil {
+		v.Description = *attrs.Description
+	}
+	if attrs.Category != nil {
+		v.Category = *attrs.Category
+	}
+	if attrs.HCL != nil {
+		v.HCL = *attrs.HCL
+	}
+	if attrs.Sensitive != nil {
+		v.Sensitive = *attrs.Sensitive
+	}
+}
+
+func (st *variableStore) update(w http.ResponseWriter, r *http.Request) {
+	attrs, err := decodeVariable(r)
+	if err != nil {
+		writeJSONAPI(w, http.StatusBadRequest, `{"errors":[{"status":"400","title":"bad request"}]}`)
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	v := st.find(path.Base(r.URL.Path))
+	if v == nil {
+		writeJSONAPI(w, http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+		return
+	}
+	if st.failed(w, "PATCH", v.Key) {
+		return
+	}
+	v.apply(attrs)
+	writeJSONAPI(w, http.StatusOK, `{"data":`+v.doc()+`}`)
+}
+
+func (st *variableStore) delete(w http.ResponseWriter, r *http.Request) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	id := path.Base(r.URL.Path)
+	for i, v := range st.vars {
+		if v.ID != id {
+			continue
+		}
+		if st.failed(w, "DELETE", v.Key) {
+			return
+		}
+		st.vars = append(st.vars[:i], st.vars[i+1:]...)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSONAPI(w, http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+}
+
+// inFlight records the most requests served at once by the handlers it wraps
+type inFlight struct {
+	mu           sync.Mutex
+	active, peak int
+}
+
+// wrap delays h a little so that concurrent requests overlap
+func (f *inFlight) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.active++
+		f.peak = max(f.peak, f.active)
+		f.mu.Unlock()
+		defer func() {
+			f.mu.Lock()
+			f.active--
+			f.mu.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+		h(w, r)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// effectiveVariable is an entry of the run-variables output
+type effectiveVariable struct {
+	Key         string `json:"key"`
+	Category    string `json:"category"`
+	Source      string `json:"source"`
+	VariableSet string `json:"variable_set,omitempty"`
+	Value       string `json:"value,omitempty"`
+	HCL         bool   `json:"hcl"`
+	Sensitive   bool   `json:"sensitive"`
+}
+
+// Precedence ranks of the sources of a variable, the lowest wins. Priority
+// variable sets override everything, run variables override the workspace's
+// own variables, which override the variable sets applied to it. Among
+// sets, the narrower scope wins
+const (
+	rankPriorityWorkspaceSet = iota
+	rankPriorityProjectSet
+	rankPriorityGlobalSet
+	rankRun
+	rankWorkspace
+	rankWorkspaceSet
+	rankProjectSet
+	rankGlobalSet
+)
+
+// variableSetRank returns the precedence rank of the variables of a set
+// applied to the workspace
+func variableSetRank(set *tfe.VariableSet, workspaceID string) int {
+	rank := rankProjectSet
+	switch {
+	case set.Global:
+		rank = rankGlobalSet
+	default:
+		for _, w := range set.Workspaces {
+			if w.ID == workspaceID {
+				rank = rankWorkspaceSet
+			}
+		}
+	}
+	if set.Priority {
+		rank -= rankWorkspaceSet - rankPriorityWorkspaceSet
+	}
+	return rank
+}
+
+// effectiveVariables reads back the variables in effect for the run: its run
+// variables, the workspace variables and those of the variable sets applied
+// to the workspace, keeping for each key and category the one that takes
+// precedence. Conflicting sets of the same scope are resolved by name, the
+// first wins. Values are omitted when any variable of the key is sensitive,
+// so that a run variable overriding a sensitive one does not reveal it
+func effectiveVariables(ctx context.Context, client *tfe.Client, w *tfe.Workspace, runID string) ([]effectiveVariable, error) {
+	r, err := client.Runs.Read(ctx, runID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read run %q: %w", runID, err)
+	}
+	workspaceVars, err := listVariables(ctx, client, w.ID)
+	if err != nil {
+		return nil, err
+	}
+	sets, err := listWorkspaceVariableSets(ctx, client, w.ID, "vars,workspaces")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Name < sets[j].Name })
+
+	type candidate struct {
+		effectiveVariable
+		rank int
+	}
+	var candidates []candidate
+	for _, v := range r.Variables {
+		candidates = append(candidates, candidate{effectiveVariable{Key: v.Key, Category: string(tfe.CategoryTerraform), Source: "run", Value: v.Value, HCL: true}, rankRun})
+	}
+	for _, v := range workspaceVars {
+		candidates = append(candidates, candidate{effectiveVariable{Key: v.Key, Category: string(v.Category), Source: "workspace", Value: v.Value, HCL: v.HCL, Sensitive: v.Sensitive}, rankWorkspace})
+	}
+	for _, set := range sets {
+		rank := variableSetRank(set, w.ID)
+		for _, v := range set.Variables {
+			candidates = append(candidates, candidate{effectiveVariable{Key: v.Key, Category: string(v.Category), Source: "variable-set", VariableSet: set.Name, Value: v.Value, HCL: v.HCL, Sensitive: v.Sensitive}, rank})
+		}
+	}
+	// Stable, so that the first set by name wins within a rank
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].rank < candidates[j].rank })
+
+	sensitive := map[string]bool{}
+	for _, c := range candidates {
+		if c.Sensitive {
+			sensitive[c.Category+"/"+c.Key] = true
+		}
+	}
+	ret := []effectiveVariable{}
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		id := c.Category + "/" + c.Key
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		ev := c.effectiveVariable
+		if sensitive[id] {
+			ev.Sensitive = true
+			ev.Value = ""
+		}
+		ret = append(ret, ev)
+	}
+	return ret, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// varsetDoc renders a variable set applied to ws-1 or, when global, to every
+// workspace, with the IDs of its variables
+func varsetDoc(id, name string, global, priority, direct bool, varIDs ...string) string {
+	var vars, workspaces []string
+	for _, v := range varIDs {
+		vars = append(vars, fmt.Sprintf(`{"id":%q,"type":"vars"}`, v))
+	}
+	if direct {
+		workspaces = append(workspaces, `{"id":"ws-1","type":"workspaces"}`)
+	}
+	return fmt.Sprintf(`{"id":%q,"type":"varsets","attributes":{"name":%q,"global":%t,"priority":%t},"relationships":{"vars":{"data":[%s]},"workspaces":{"data":[%s]}}}`,
+		id, name, global, priority, strings.Join(vars, ","), strings.Join(workspaces, ","))
+}
+
+func TestEffectiveVariables(t *testing.T) {
+	stub, client := newTFEStub(t)
+	stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK,
+		`{"data":{"id":"run-1","type":"runs","attributes":{"status":"planning","variables":[{"key":"region","value":"\"run\""},{"key":"token","value":"\"override\""}]}}}`)
+	stub.serveVariables("ws-1",
+		fakeVariable{ID: "var-1", Key: "region", Value: "ws", Category: "terraform"},
+		fakeVariable{ID: "var-2", Key: "size", Value: "ws", Category: "terraform"},
+		fakeVariable{ID: "var-3", Key: "token", Value: "secret", Category: "terraform", Sensitive: true},
+		fakeVariable{ID: "var-4", Key: "AWS_REGION", Value: "ws", Category: "env"},
+	)
+	setVar := func(id, key, value string) string {
+		v := fakeVariable{ID: id, Key: key, Value: value, Category: "terraform"}
+		return v.doc()
+	}
+	stub.reply("GET", "/api/v2/workspaces/ws-1/varsets", http.StatusOK, `{"data":[`+strings.Join([]string{
+		varsetDoc("varset-b", "b-workspace", false, false, true, "var-b1", "var-b2"),
+		varsetDoc("varset-a", "a-workspace", false, false, true, "var-a1"),
+		varsetDoc("varset-p", "project", false, false, false, "var-p1"),
+		varsetDoc("varset-g", "global", true, false, false, "var-g1", "var-g2"),
+		varsetDoc("varset-x", "priority", true, true, false, "var-x1"),
+	}, ",")+`],"included":[`+strings.Join([]string{
+		setVar("var-b1", "size", "b"),
+		setVar("var-b2", "color", "b"),
+		setVar("var-a1", "color", "a"),
+		setVar("var-p1", "zone", "project"),
+		setVar("var-g1", "color", "global"),
+		setVar("var-g2", "zone", "global"),
+		setVar("var-x1", "size", "priority"),
+	}, ",")+`],"meta":{"pagination":{"current-page":1,"total-pages":1}}}`)
+
+	got, err := effectiveVariables(context.Background(), client, &tfe.Workspace{ID: "ws-1"}, "run-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Category+got[i].Key < got[j].Category+got[j].Key })
+	want := []effectiveVariable{
+		{Key: "AWS_REGION", Category: "env", Source: "workspace", Value: "ws"},
+		{Key: "color", Category: "terraform", Source: "variable-set", VariableSet: "a-workspace", Value: "a"},
+		{Key: "region", Category: "terraform", Source: "run", Value: `"run"`, HCL: true},
+		{Key: "size", Category: "terraform", Source: "variable-set", VariableSet: "priority", Value: "priority"},
+		{Key: "token", Category: "terraform", Source: "run", HCL: true, Sensitive: true},
+		{Key: "zone", Category: "terraform", Source: "variable-set", VariableSet: "project", Value: "project"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("effective variables =\n%+v\nwant\n%+v", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// snapshotVariables records the workspace variables before they are changed,
+// so that a failed transactional update can restore them
+func snapshotVariables(ctx context.Context, cache *variableCache, w *tfe.Workspace) ([]tfe.Variable, error) {
+	existingVars, err := cache.list(ctx, w.ID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := make([]tfe.Variable, 0, len(existingVars))
+	for _, ev := range existingVars {
+		snapshot = append(snapshot, *ev)
+	}
+	return snapshot, nil
+}
+
+// rollbackVariables restores the workspace variables to the snapshot by
+// comparing it with their current state: created variables are deleted,
+// deleted ones recreated and changed ones updated back. Sensitive values
+// cannot be read, so sensitive variables that were deleted or written from
+// json-vars are only reported
+func rollbackVariables(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, snapshot []tfe.Variable, vars []workspaceVar) error {
+	// The action context may already be canceled, which is one of the
+	// failures worth rolling back
+	ctx = context.WithoutCancel(ctx)
+
+	cache.invalidate(w.ID)
+	current, err := cache.list(ctx, w.ID)
+	if err != nil {
+		return err
+	}
+	defer cache.invalidate(w.ID)
+
+	byID := map[string]*tfe.Variable{}
+	for _, ev := range current {
+		byID[ev.ID] = ev
+	}
+	before := map[string]bool{}
+	// lost holds the sensitive variables that are gone and cannot be
+	// recreated, whose replacement is kept rather than deleted
+	lost := map[string]bool{}
+	for _, prev := range snapshot {
+		before[prev.ID] = true
+		if _, ok := byID[prev.ID]; !ok && prev.Sensitive {
+			lost[string(prev.Category)+"/"+prev.Key] = true
+		}
+	}
+	declared := map[string]bool{}
+	for _, v := range vars {
+		declared[v.Key] = true
+	}
+
+	var errs []error
+	var unrestored []string
+	// Created variables go first, a variable recreated with another
+	// sensitivity holds the key its predecessor is restored under
+	for _, ev := range current {
+		if before[ev.ID] || lost[string(ev.Category)+"/"+ev.Key] {
+			continue
+		}
+		if err := client.Variables.Delete(ctx, w.ID, ev.ID); err != nil {
+			errs = append(errs, fmt.Errorf("could not delete created variable %q: %w", ev.Key, err))
+			continue
+		}
+		logInfo("Deleted created variable %q", ev.Key)
+	}
+	for _, prev := range snapshot {
+		ev, ok := byID[prev.ID]
+		switch {
+		case !ok && prev.Sensitive:
+			unrestored = append(unrestored, prev.Key)
+		case !ok:
+			_, err := client.Variables.Create(ctx, w.ID, tfe.VariableCreateOptions{
+				Key:         tfe.String(prev.Key),
+				Value:       tfe.String(prev.Value),
+				Description: tfe.String(prev.Description),
+				Category:    tfe.Category(prev.Category),
+				HCL:         tfe.Bool(prev.HCL),
+				Sensitive:   tfe.Bool(false),
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("could not recreate variable %q: %w", prev.Key, err))
+				continue
+			}
+			logInfo("Recreated variable %q", prev.Key)
+		case prev.Sensitive || ev.Sensitive:
+			// Turning a variable sensitive cannot be undone either
+			if declared[prev.Key] {
+				unrestored = append(unrestored, prev.Key)
+			}
+		case ev.Value != prev.Value || ev.Description != prev.Description || ev.HCL != prev.HCL || ev.Category != prev.Category || ev.Key != prev.Key:
+			_, err := client.Variables.Update(ctx, w.ID, prev.ID, tfe.VariableUpdateOptions{
+				Key:         tfe.String(prev.Key),
+				Value:       tfe.String(prev.Value),
+				Description: tfe.String(prev.Description),
+				Category:    tfe.Category(prev.Category),
+				HCL:         tfe.Bool(prev.HCL),
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("could not restore variable %q: %w", prev.Key, err))
+				continue
+			}
+			logInfo("Restored variable %q", prev.Key)
+		}
+	}
+
+	if len(unrestored) > 0 {
+		logWarn("sensitive variables cannot be restored and may have been changed: %s", strings.Join(unrestored, ", "))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestApplyVariablesRollsBackMidBatchFailure(t *testing.T) {
+	yes := true
+	tests := []struct {
+		name   string
+		inputs map[*string]string
+		vars   []workspaceVar
+	}{
+		{
+			name: "update and create before the failure",
+			vars: []workspaceVar{
+				{Key: "a", Value: "new"},
+				{Key: "c", Value: "created"},
+				{Key: "fails", Value: "x"},
+			},
+		},
+		{
+			name:   "variable recreated with another sensitivity",
+			inputs: map[*string]string{&recreateSens: "true"},
+			vars: []workspaceVar{
+				{Key: "b", Value: "secret", Sensitive: &yes},
+				{Key: "fails", Value: "x"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setInput(t, &transaction, "true")
+			for input, value := range tt.inputs {
+				setInput(t, input, value)
+			}
+			stub, client := newTFEStub(t)
+			store := stub.serveVariables("ws-1",
+				fakeVariable{ID: "var-a", Key: "a", Value: "old", Category: "terraform"},
+				fakeVariable{ID: "var-b", Key: "b", Value: "plain", Category: "terraform"},
+			)
+			store.fail = func(method, key string) bool { return key == "fails" }
+			before := withoutIDs(store.snapshot())
+
+			err := applyVariables(context.Background(), client, newVariableCache(client), &tfe.Workspace{ID: "ws-1"}, tt.vars)
+			if err == nil {
+				t.Fatal("expected the injected failure")
+			}
+			if after := withoutIDs(store.snapshot()); !reflect.DeepEqual(after, before) {
+				t.Errorf("variables after rollback = %+v, want %+v", after, before)
+			}
+		})
+	}
+}
+
+// withoutIDs drops the IDs, which change when a variable is recreated
+func withoutIDs(vars []fakeVariable) []fakeVariable {
+	for i := range vars {
+		vars[i].ID = ""
+	}
+	return vars
+}
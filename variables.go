@@ -0,0 +1,875 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// syncResult records what syncVariables did to the workspace variables
+type syncResult struct {
+	// ids maps the category/key of every created or updated variable to its
+	// ID, the category keeping apart a terraform and an env variable of the
+	// same key
+	ids map[string]string
+
+	created, updated, unchanged, skipped int
+	// unchangedKeys lists the variables left as they were, see skip-no-op
+	unchangedKeys []string
+}
+
+// summary renders the counts of the operations for the summarize-vars log
+// line, adding the number of pruned variables when pruning ran
+func (r *syncResult) summary(pruned []string) string {
+	parts := []string{fmt.Sprintf("%d created", r.created), fmt.Sprintf("%d updated", r.updated)}
+	if pruned != nil {
+		parts = append(parts, fmt.Sprintf("%d pruned", len(pruned)))
+	}
+	parts = append(parts, fmt.Sprintf("%d unchanged", r.unchanged))
+	if r.skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d skipped", r.skipped))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logVariable logs an operation on a single variable. With summarize-vars
+// these lines are only printed at the debug level
+func logVariable(format string, args ...interface{}) {
+	if varsSummary == "true" {
+		logDebug(format, args...)
+		return
+	}
+	logInfo(format, args...)
+}
+
+// recreateVariable replaces the existing variable by a new one built from
+// the json-vars entry, see recreate-on-sensitivity-change. Attributes the
+// entry leaves unset are carried over from the existing variable
+func recreateVariable(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, existing *tfe.Variable, v workspaceVar, now time.Time) (*tfe.Variable, error) {
+	hcl := existing.HCL
+	if v.HCL != nil {
+		hcl = *v.HCL
+	}
+	opts := tfe.VariableCreateOptions{
+		Key:         tfe.String(v.Key),
+		Value:       tfe.String(varValue(v)),
+		Description: variableDescription(v, existing, now),
+		Category:    tfe.Category(existing.Category),
+		HCL:         tfe.Bool(hcl),
+		Sensitive:   tfe.Bool(isSensitive(v)),
+	}
+	if opts.Description == nil {
+		opts.Description = tfe.String(existing.Description)
+	}
+
+	// The key is only free again once the old variable is gone
+	err := client.Variables.Delete(ctx, w.ID, existing.ID)
+	cache.invalidate(w.ID)
+	if err != nil {
+		return nil, fmt.Errorf("could not delete variable %q to recreate it: %w", v.Key, err)
+	}
+	created, err := client.Variables.Create(ctx, w.ID, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not recreate variable %q, it was deleted: %w", v.Key, err)
+	}
+	return created, nil
+}
+
+// reconcileVariables brings the workspace variables in line with json-vars,
+// or only previews the changes with dry-run, and writes diff-file
+func reconcileVariables(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) error {
+	// The report is computed before the variables change and only written
+	// once they did
+	var report string
+	var err error
+	if diffFile != "" {
+		report, err = variableDiff(ctx, cache, w, vars)
+		if err != nil {
+			return err
+		}
+	}
+	if dryRun == "true" {
+		err = previewDryRun(ctx, cache, w, vars)
+	} else {
+		err = applyVariables(ctx, client, cache, w, vars)
+	}
+	if err != nil {
+		return err
+	}
+	if diffFile != "" {
+		return writeVariableDiff(diffFile, report)
+	}
+	return nil
+}
+
+// syncOp is what syncing a json-vars entry did to its variable
+type syncOp int
+
+const (
+	opCreated syncOp = iota
+	opUpdated
+	opUnchanged
+	opSkipped
+)
+
+// variableOutcome is the result of syncing a single json-vars entry
+type variableOutcome struct {
+	op syncOp
+	// id is the ID of the created or updated variable
+	id string
+	// logs are the lines logged for the entry once its group finished
+	logs []string
+}
+
+// record adds the outcome of the entry v to the result and logs it
+func (r *syncResult) record(v workspaceVar, o *variableOutcome) {
+	switch o.op {
+	case opCreated:
+		r.created++
+	case opUpdated:
+		r.updated++
+	case opUnchanged:
+		r.unchanged++
+		r.unchangedKeys = append(r.unchangedKeys, v.Key)
+	case opSkipped:
+		r.skipped++
+	}
+	if o.id != "" {
+		r.ids[string(varCategory(v))+"/"+v.Key] = o.id
+	}
+	for _, line := range o.logs {
+		logVariable("%s", line)
+	}
+}
+
+// syncGroups splits json-vars into the groups synced one after another: all
+// entries at once, or with sensitive-order, each run of equally sensitive
+// entries once the previous one finished
+func syncGroups(vars []workspaceVar) [][]workspaceVar {
+	if sensOrder == "" {
+		return [][]workspaceVar{vars}
+	}
+	var groups [][]workspaceVar
+	for i, v := range vars {
+		if i == 0 || isSensitive(v) != isSensitive(vars[i-1]) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], v)
+	}
+	return groups
+}
+
+// syncVariables creates or updates the workspace variables from json-vars,
+// running as many of the operations at once as concurrency allows. The
+// first failure stops the operations that did not start yet
+func syncVariables(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) (*syncResult, error) {
+	result := &syncResult{ids: map[string]string{}}
+	existingVars, err := cache.list(ctx, w.ID)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := newConcurrencyLimit()
+	if err != nil {
+		return nil, err
+	}
+	ignored := ignoredUpdates()
+	now := time.Now()
+
+	for _, group := range syncGroups(vars) {
+		outcomes := make([]*variableOutcome, len(group))
+		errs := make([]error, len(group))
+		var failed atomic.Bool
+		var wg sync.WaitGroup
+		for i, v := range group {
+			workers.acquire()
+			if failed.Load() {
+				workers.release()
+				break
+			}
+			wg.Add(1)
+			go func() {
+				defer func() { workers.release(); wg.Done() }()
+				outcomes[i], errs[i] = syncVariable(ctx, client, cache, w, existingVars, v, ignored, now)
+				if errs[i] != nil {
+					failed.Store(true)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Recorded in json-vars order, so the log does not depend on which
+		// request finished first
+		for i, o := range outcomes {
+			if o != nil {
+				result.record(group[i], o)
+			}
+		}
+		if err := errors.Join(errs...); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// syncVariable creates or updates the workspace variable of a single
+// json-vars entry, looking it up in existingVars
+func syncVariable(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, existingVars []*tfe.Variable, v workspaceVar, ignored map[string]bool, now time.Time) (*variableOutcome, error) {
+	// Search for existing variable with this key and category
+	existingVar := findVariable(existingVars, v)
+
+	if existingVar != nil && ignored[v.Key] {
+		return &variableOutcome{op: opSkipped, logs: []string{fmt.Sprintf("Skipping variable %q, updates are ignored", v.Key)}}, nil
+	}
+
+	if descOnly == "true" {
+		// Only reconcile descriptions of variables that already exist
+		if existingVar == nil {
+			return &variableOutcome{op: opSkipped, logs: []string{fmt.Sprintf("Skipping variable %q, it does not exist", v.Key)}}, nil
+		}
+		if v.Description == nil || *v.Description == existingVar.Description {
+			return &variableOutcome{op: opUnchanged}, nil
+		}
+		_, err := client.Variables.Update(ctx, w.ID, existingVar.ID, tfe.VariableUpdateOptions{
+			Description: v.Description,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not update description of variable %q: %w", v.Key, err)
+		}
+		return &variableOutcome{op: opUpdated, id: existingVar.ID, logs: []string{fmt.Sprintf("Updated description of variable %q", v.Key)}}, nil
+	}
+
+	if existingVar == nil {
+		// Variable doesn't exist, create it
+
+		// Convert value to string for TFE
+		valueStr := varValue(v)
+
+		// Set default values for all fields (matching the test pattern)
+		hcl := isHCL(v)
+		sensitive := false
+		if v.Sensitive != nil {
+			sensitive = *v.Sensitive
+		}
+
+		// Create variable with TFE helper functions
+		createOpts := tfe.VariableCreateOptions{
+			Key:       tfe.String(v.Key),
+			Value:     tfe.String(valueStr),
+			Category:  tfe.Category(tfe.CategoryTerraform), // Default to terraform category
+			HCL:       tfe.Bool(hcl),
+			Sensitive: tfe.Bool(sensitive),
+		}
+
+		// Override category if specified
+		if v.Category != nil {
+			createOpts.Category = tfe.Category(tfe.CategoryType(*v.Category))
+		}
+
+		// Add description if provided
+		createOpts.Description = variableDescription(v, nil, now)
+
+		created, err := client.Variables.Create(ctx, w.ID, createOpts)
+		if err == nil {
+			cache.add(w.ID, created)
+			return &variableOutcome{op: opCreated, id: created.ID, logs: []string{fmt.Sprintf("Created variable %q", v.Key)}}, nil
+		}
+
+		// Check if the error is due to the variable already existing
+		if err.Error() != "Key has already been taken" {
+			return nil, fmt.Errorf("could not create variable %q: %w", v.Key, err)
+		}
+		if ignored[v.Key] {
+			// Created by another process, which then manages it
+			return &variableOutcome{op: opSkipped, logs: []string{fmt.Sprintf("Skipping variable %q, it already exists and updates are ignored", v.Key)}}, nil
+		}
+		// Variable was created by another process, try to update it instead.
+		// We need to get the variable ID first since Update requires it,
+		// the cached listing predates the other process
+		cache.invalidate(w.ID)
+		updateVars, updateListErr := cache.list(ctx, w.ID)
+		if updateListErr != nil {
+			return nil, fmt.Errorf("could not list variables for update: %w", updateListErr)
+		}
+
+		updateVar := findVariable(updateVars, v)
+
+		if updateVar == nil {
+			return nil, fmt.Errorf("variable %q not found for update", v.Key)
+		}
+
+		updateOpts := tfe.VariableUpdateOptions{
+			Value:       &valueStr,
+			Description: variableDescription(v, updateVar, now),
+			HCL:         v.HCL,
+			Sensitive:   v.Sensitive,
+		}
+		if v.Category != nil {
+			category := tfe.CategoryType(*v.Category)
+			updateOpts.Category = &category
+		}
+		_, updateErr := client.Variables.Update(ctx, w.ID, updateVar.ID, updateOpts)
+		if updateErr != nil {
+			return nil, fmt.Errorf("could not update variable %q: %w", v.Key, updateErr)
+		}
+		return &variableOutcome{op: opUpdated, id: updateVar.ID, logs: []string{
+			fmt.Sprintf("Variable %q already exists, updating instead", v.Key),
+			fmt.Sprintf("Updated variable %q", v.Key),
+		}}, nil
+	}
+
+	if recreateSens == "true" && v.Sensitive != nil && *v.Sensitive != existingVar.Sensitive {
+		recreated, err := recreateVariable(ctx, client, cache, w, existingVar, v, now)
+		if err != nil {
+			return nil, err
+		}
+		return &variableOutcome{op: opUpdated, id: recreated.ID, logs: []string{fmt.Sprintf("Recreated variable %q, its sensitivity changed", v.Key)}}, nil
+	}
+
+	if skipNoOp == "true" && isNoOpUpdate(existingVar, v) {
+		return &variableOutcome{op: opUnchanged, logs: []string{fmt.Sprintf("Variable %q is unchanged", v.Key)}}, nil
+	}
+
+	// Variable exists, update it
+	valueStr := varValue(v)
+	updateOpts := tfe.VariableUpdateOptions{
+		Value:       &valueStr,
+		Description: variableDescription(v, existingVar, now),
+		HCL:         v.HCL,
+		Sensitive:   v.Sensitive,
+	}
+	if v.Category != nil {
+		category := tfe.CategoryType(*v.Category)
+		updateOpts.Category = &category
+	}
+	_, err := client.Variables.Update(ctx, w.ID, existingVar.ID, updateOpts)
+	if err != nil {
+		return nil, fmt.Errorf("could not update variable %q: %w", v.Key, err)
+	}
+	return &variableOutcome{op: opUpdated, id: existingVar.ID, logs: []string{fmt.Sprintf("Updated variable %q", v.Key)}}, nil
+}
+
+// applyVariables syncs json-vars to the workspace and prunes undeclared
+// variables when prune is set, writing the related outputs. With
+// transactional, a failure rolls the variables back to their prior state
+func applyVariables(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) (err error) {
+	if transaction == "true" {
+		// Assigned, not declared, so that the rollback sees the returned err
+		var snapshot []tfe.Variable
+		snapshot, err = snapshotVariables(ctx, cache, w)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			logWarn("variable update failed, rolling back: %v", err)
+			if rbErr := rollbackVariables(ctx, client, cache, w, snapshot, vars); rbErr != nil {
+				err = fmt.Errorf("%w. Rollback was incomplete: %v", err, rbErr)
+			}
+		}()
+	}
+
+	synced, err := syncVariables(ctx, client, cache, w, vars)
+	if err != nil {
+		return err
+	}
+	if outputFile := outputPath(); outputFile != "" && len(vars) > 0 {
+		// Only IDs are written, never values, so sensitive variables are safe
+		ids, _ := json.Marshal(synced.ids)
+		appendMultilineToFile(outputFile, "variable-ids", string(ids))
+	}
+
+	if outputFile := outputPath(); outputFile != "" {
+		// Scalars, which workflow if: conditions can compare directly
+		for _, count := range []struct {
+			key   string
+			value int
+		}{
+			{"variables-created", synced.created},
+			{"variables-updated", synced.updated},
+			{"variables-skipped", synced.unchanged + synced.skipped},
+		} {
+			appendToFile(outputFile, count.key, fmt.Sprintf("%d", count.value))
+		}
+	}
+
+	if outputFile := outputPath(); outputFile != "" && (skipNoOp == "true" || descOnly == "true") {
+		unchanged := synced.unchangedKeys
+		if unchanged == nil {
+			unchanged = []string{}
+		}
+		keys, _ := json.Marshal(unchanged)
+		appendMultilineToFile(outputFile, "unchanged-keys", string(keys))
+	}
+
+	touched := map[tfe.CategoryType]bool{}
+	for ref := range synced.ids {
+		category, _, _ := strings.Cut(ref, "/")
+		touched[tfe.CategoryType(category)] = true
+	}
+
+	var pruned []string
+	if prune == "true" {
+		deleted, kept, err := pruneVariables(ctx, client, cache, w, vars)
+		pruned = []string{}
+		for _, ev := range deleted {
+			pruned = append(pruned, ev.Key)
+			touched[ev.Category] = true
+		}
+		keptKeys := []string{}
+		for _, ev := range kept {
+			keptKeys = append(keptKeys, ev.Key)
+		}
+		if outputFile := outputPath(); outputFile != "" {
+			// Written even when a delete failed, so that what was removed is known
+			appendToFile(outputFile, "variables-pruned", fmt.Sprintf("%d", len(pruned)))
+			keys, _ := json.Marshal(pruned)
+			appendMultilineToFile(outputFile, "pruned-keys", string(keys))
+			keys, _ = json.Marshal(keptKeys)
+			appendMultilineToFile(outputFile, "prune-kept-keys", string(keys))
+		}
+		if err != nil {
+			return err
+		}
+	} else if outputFile := outputPath(); outputFile != "" {
+		appendToFile(outputFile, "variables-pruned", "0")
+	}
+
+	if outputFile := outputPath(); outputFile != "" {
+		// Distinct categories of the created, updated and deleted variables
+		categories := []string{}
+		for category := range touched {
+			categories = append(categories, string(category))
+		}
+		sort.Strings(categories)
+		data, _ := json.Marshal(categories)
+		appendToFile(outputFile, "categories", string(data))
+	}
+	if varsSummary == "true" {
+		logInfo("Variables: %s", synced.summary(pruned))
+	}
+	return nil
+}
+
+// isNoOpUpdate reports whether updating the variable from the json-vars
+// entry would leave it unchanged. Every attribute the update sends counts, so
+// an identical value with another hcl flag or category is still updated.
+// Sensitive values cannot be read back, so sensitive variables are always
+// updated
+func isNoOpUpdate(existing *tfe.Variable, v workspaceVar) bool {
+	if existing.Sensitive || isSensitive(v) {
+		return false
+	}
+	if existing.Value != varValue(v) {
+		return false
+	}
+	if v.HCL != nil && *v.HCL != existing.HCL {
+		return false
+	}
+	if v.Category != nil && tfe.CategoryType(*v.Category) != existing.Category {
+		return false
+	}
+	description := existing.Description
+	if provenance == "true" {
+		// The provenance line changes with every commit, it alone does
+		// not make an update necessary
+		description = stripProvenance(description)
+	}
+	return v.Description == nil || *v.Description == description
+}
+
+// ignoredUpdates returns the set of keys of ignore-updates, variables that
+// are created when missing but never updated afterwards
+func ignoredUpdates() map[string]bool {
+	keys := map[string]bool{}
+	for _, key := range splitList(ignoredKeys) {
+		keys[key] = true
+	}
+	return keys
+}
+
+// findVariable returns the existing variable a json-vars entry applies to,
+// matched by key and category, or nil. An entry without a category is a
+// terraform variable, as it is created, so that an env variable of the same
+// key is never mistaken for it and repeated runs update what they created
+func findVariable(existingVars []*tfe.Variable, v workspaceVar) *tfe.Variable {
+	for _, ev := range existingVars {
+		if ev.Key == v.Key && ev.Category == varCategory(v) {
+			return ev
+		}
+	}
+	return nil
+}
+
+// variableChanges lists the keys of the variables a dry-run would change
+type variableChanges struct {
+	Create []string `json:"create"`
+	Update []string `json:"update"`
+	Delete []string `json:"delete"`
+}
+
+// previewVariables computes what syncVariables, and pruneVariables when
+// prune is set, would do to the workspace without changing anything
+func previewVariables(ctx context.Context, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) (*variableChanges, error) {
+	existingVars, err := cache.list(ctx, w.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := &variableChanges{Create: []string{}, Update: []string{}, Delete: []string{}}
+	ignored := ignoredUpdates()
+	for _, v := range vars {
+		existingVar := findVariable(existingVars, v)
+		switch {
+		case existingVar != nil && ignored[v.Key]:
+		case descOnly == "true":
+			if existingVar != nil && v.Description != nil && *v.Description != existingVar.Description {
+				changes.Update = append(changes.Update, v.Key)
+			}
+		case existingVar == nil:
+			changes.Create = append(changes.Create, v.Key)
+		case skipNoOp == "true" && isNoOpUpdate(existingVar, v):
+		default:
+			changes.Update = append(changes.Update, v.Key)
+		}
+	}
+	if prune == "true" {
+		stale, _ := staleVariables(existingVars, vars)
+		for _, ev := range stale {
+			changes.Delete = append(changes.Delete, ev.Key)
+		}
+	}
+	return changes, nil
+}
+
+// listVariables returns every variable of the workspace, following pagination
+func listVariables(ctx context.Context, client *tfe.Client, workspaceID string) ([]*tfe.Variable, error) {
+	var all []*tfe.Variable
+	opts := &tfe.VariableListOptions{ListOptions: tfe.ListOptions{PageSize: 100}}
+	for {
+		page, err := client.Variables.List(ctx, workspaceID, opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not list variables: %w", err)
+		}
+		all = append(all, page.Items...)
+		if page.Pagination == nil || page.Pagination.NextPage == 0 {
+			return all, nil
+		}
+		opts.PageNumber = page.Pagination.NextPage
+	}
+}
+
+// variableCache holds the variables listed for each workspace, so that a
+// sync lists them once instead of once per variable. Entries are keyed by
+// workspace ID and never shared between workspaces. It is safe for
+// concurrent use
+type variableCache struct {
+	client *tfe.Client
+
+	mu          sync.Mutex
+	byWorkspace map[string][]*tfe.Variable
+}
+
+func newVariableCache(client *tfe.Client) *variableCache {
+	return &variableCache{client: client, byWorkspace: map[string][]*tfe.Variable{}}
+}
+
+// list returns the variables of the workspace, listing them on first use
+func (c *variableCache) list(ctx context.Context, workspaceID string) ([]*tfe.Variable, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if vars, ok := c.byWorkspace[workspaceID]; ok {
+		return vars, nil
+	}
+	vars, err := listVariables(ctx, c.client, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	c.byWorkspace[workspaceID] = vars
+	return vars, nil
+}
+
+// add records a variable created on the workspace
+func (c *variableCache) add(workspaceID string, v *tfe.Variable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if vars, ok := c.byWorkspace[workspaceID]; ok {
+		c.byWorkspace[workspaceID] = append(vars, v)
+	}
+}
+
+// invalidate drops the cached variables of the workspace, so that the next
+// list reads them again
+func (c *variableCache) invalidate(workspaceID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.byWorkspace, workspaceID)
+}
+
+// sourceVariables reads the variables of another workspace of the
+// organization as json-vars entries. Sensitive variables cannot be read back
+// and are skipped
+func sourceVariables(ctx context.Context, client *tfe.Client, cache *variableCache, name string) ([]workspaceVar, error) {
+	source, err := client.Workspaces.Read(ctx, organization, name)
+	if err != nil {
+		return nil, fmt.Errorf("could not read source workspace %q: %w", name, err)
+	}
+	existingVars, err := cache.list(ctx, source.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied []workspaceVar
+	var skipped []string
+	for _, ev := range existingVars {
+		if ev.Sensitive {
+			skipped = append(skipped, ev.Key)
+			continue
+		}
+		category := string(ev.Category)
+		copied = append(copied, workspaceVar{
+			Key:         ev.Key,
+			Value:       ev.Value,
+			Description: tfe.String(ev.Description),
+			HCL:         tfe.Bool(ev.HCL),
+			Sensitive:   tfe.Bool(false),
+			Category:    &category,
+		})
+	}
+
+	logInfo("Copying %d variables from workspace %q", len(copied), name)
+	if len(skipped) > 0 {
+		logWarn("skipped %d sensitive variables of workspace %q that cannot be read: %s", len(skipped), name, strings.Join(skipped, ", "))
+	}
+	return copied, nil
+}
+
+// mergeSourceVars combines the variables copied from source-workspace with
+// json-vars. Copied variables that json-vars declares too, by category and
+// key, are dropped so that each variable is written once, from json-vars
+func mergeSourceVars(copied, vars []workspaceVar) []workspaceVar {
+	declared := map[string]bool{}
+	for _, v := range vars {
+		declared[string(varCategory(v))+"/"+v.Key] = true
+	}
+	merged := make([]workspaceVar, 0, len(copied)+len(vars))
+	for _, v := range copied {
+		if declared[string(varCategory(v))+"/"+v.Key] {
+			logDebug("Not copying variable %q, json-vars declares it", v.Key)
+			continue
+		}
+		merged = append(merged, v)
+	}
+	return append(merged, vars...)
+}
+
+// terraformIdentifier matches valid Terraform variable names
+var terraformIdentifier = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+
+// validateVarKeys checks that the terraform variables of json-vars are named
+// with valid identifiers, which the API would otherwise reject with a
+// confusing error
+func validateVarKeys(vars []workspaceVar) error {
+	for _, v := range vars {
+		if varCategory(v) == tfe.CategoryTerraform && !terraformIdentifier.MatchString(v.Key) {
+			return fmt.Errorf("invalid variable key %q: terraform variable names must start with a letter or underscore and contain only letters, digits, underscores and dashes", v.Key)
+		}
+	}
+	return nil
+}
+
+// isHCL reports whether a json-vars entry is created as an HCL variable:
+// as its hcl flag says, or else when its value looks like HCL, such as
+// complex values with brackets, braces, etc.
+func isHCL(v workspaceVar) bool {
+	if v.HCL != nil {
+		return *v.HCL
+	}
+	if v.Format != nil && *v.Format == "raw" {
+		return false
+	}
+	return containsHCLSyntax(varValue(v))
+}
+
+// checkSensitiveHCL rejects json-vars entries that are both sensitive and
+// HCL, see forbid-sensitive-hcl
+func checkSensitiveHCL(vars []workspaceVar) error {
+	for _, v := range vars {
+		if isSensitive(v) && isHCL(v) {
+			return fmt.Errorf("variable %q is both sensitive and HCL, which forbid-sensitive-hcl does not allow. Set \"hcl\": false on it", v.Key)
+		}
+	}
+	return nil
+}
+
+// dedupeVars drops the json-vars entries whose key and category appear again
+// later in the payload, so that the last one deterministically wins. With
+// on-duplicate-key set to error, a duplicate fails the action instead
+func dedupeVars(vars []workspaceVar, mode string) ([]workspaceVar, error) {
+	last := map[string]int{}
+	for i, v := range vars {
+		last[string(varCategory(v))+"/"+v.Key] = i
+	}
+	if len(last) == len(vars) {
+		return vars, nil
+	}
+	deduped := make([]workspaceVar, 0, len(last))
+	for i, v := range vars {
+		if last[string(varCategory(v))+"/"+v.Key] == i {
+			deduped = append(deduped, v)
+			continue
+		}
+		if mode == "error" {
+			return nil, fmt.Errorf("duplicate %s variable %q in json-vars", varCategory(v), v.Key)
+		}
+		logWarn("json-vars declares %s variable %q more than once, keeping the last entry", varCategory(v), v.Key)
+	}
+	return deduped, nil
+}
+
+// trimVarValues strips surrounding whitespace from string values, which YAML
+// sources sometimes introduce
+func trimVarValues(vars []workspaceVar) {
+	for i, v := range vars {
+		if s, ok := v.Value.(string); ok {
+			vars[i].Value = strings.TrimSpace(s)
+		}
+	}
+}
+
+// isSensitive reports whether a json-vars entry is marked sensitive
+func isSensitive(v workspaceVar) bool {
+	return v.Sensitive != nil && *v.Sensitive
+}
+
+// orderVars orders json-vars for application according to the
+// sensitive-order policy: "last" applies sensitive variables after all others,
+// "first" before them. Relative order within each group is preserved
+func orderVars(vars []workspaceVar, policy string) ([]workspaceVar, error) {
+	var sensitiveFirst bool
+	switch policy {
+	case "":
+		return vars, nil
+	case "last":
+		sensitiveFirst = false
+	case "first":
+		sensitiveFirst = true
+	default:
+		return nil, fmt.Errorf("invalid sensitive-order value %q, expected first or last", policy)
+	}
+
+	ordered := make([]workspaceVar, len(vars))
+	copy(ordered, vars)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return isSensitive(ordered[i]) == sensitiveFirst && isSensitive(ordered[j]) != sensitiveFirst
+	})
+	return ordered, nil
+}
+
+// varCategory resolves the category a json-vars entry targets, defaulting to
+// terraform like variable creation does
+func varCategory(v workspaceVar) tfe.CategoryType {
+	if v.Category != nil {
+		return tfe.CategoryType(*v.Category)
+	}
+	return tfe.CategoryTerraform
+}
+
+// staleVariables returns the existing variables that are not declared in
+// json-vars, matched by key and category, and that prune deletes. Unless
+// never-prune-sensitive is false, sensitive ones are returned as kept instead
+func staleVariables(existingVars []*tfe.Variable, vars []workspaceVar) (stale, kept []*tfe.Variable) {
+	declared := map[string]bool{}
+	for _, v := range vars {
+		declared[string(varCategory(v))+"/"+v.Key] = true
+	}
+
+	for _, ev := range existingVars {
+		switch {
+		case declared[string(ev.Category)+"/"+ev.Key]:
+		case ev.Sensitive && noPruneSens != "false":
+			kept = append(kept, ev)
+		default:
+			stale = append(stale, ev)
+		}
+	}
+	return stale, kept
+}
+
+// pruneVariables deletes the workspace variables that are not declared in
+// json-vars, returning the deleted variables and the sensitive ones kept by
+// never-prune-sensitive. Nothing is deleted if more than max-prune would be
+func pruneVariables(ctx context.Context, client *tfe.Client, cache *variableCache, w *tfe.Workspace, vars []workspaceVar) (pruned, kept []*tfe.Variable, err error) {
+	limit := -1
+	if maxPrune != "" {
+		n, err := strconv.Atoi(maxPrune)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("invalid max-prune %q: must be a non-negative integer", maxPrune)
+		}
+		limit = n
+	}
+
+	existingVars, err := cache.list(ctx, w.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stale, kept := staleVariables(existingVars, vars)
+	if len(kept) > 0 {
+		keys := make([]string, len(kept))
+		for i, ev := range kept {
+			keys[i] = ev.Key
+		}
+		logWarn("prune kept %d sensitive variables not declared in json-vars: %s. Set never-prune-sensitive to false to delete them", len(kept), strings.Join(keys, ", "))
+	}
+
+	if limit >= 0 && len(stale) > limit {
+		return nil, kept, fmt.Errorf("prune would delete %d variables, more than max-prune %d allows. Nothing was deleted, check json-vars for a misconfiguration", len(stale), limit)
+	}
+
+	workers, err := newConcurrencyLimit()
+	if err != nil {
+		return nil, kept, err
+	}
+
+	// Deletes are independent, run as many of them at once as the limit
+	// allows and keep going past failures so that one bad variable does not
+	// block the rest
+	deleted := make([]bool, len(stale))
+	errs := make([]error, len(stale))
+	var wg sync.WaitGroup
+	for i, ev := range stale {
+		wg.Add(1)
+		workers.acquire()
+		go func() {
+			defer func() { workers.release(); wg.Done() }()
+			if err := client.Variables.Delete(ctx, w.ID, ev.ID); err != nil {
+				errs[i] = fmt.Errorf("could not delete variable %q: %w", ev.Key, err)
+				return
+			}
+			deleted[i] = true
+			logVariable("Deleted variable %q", ev.Key)
+		}()
+	}
+	wg.Wait()
+	cache.invalidate(w.ID)
+
+	for i, ev := range stale {
+		if deleted[i] {
+			pruned = append(pruned, ev)
+		}
+	}
+	return pruned, kept, errors.Join(errs...)
+}
@@ -0,0 +1,1045 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestSyncVariablesDescriptionsOnly(t *testing.T) {
+	stub, client := newTFEStub(t)
+	setInput(t, &descOnly, "true")
+	stub.reply("GET", "/api/v2/workspaces/ws-1/vars", http.StatusOK, listDoc(
+		variableDoc("var-a", "a", "old", tfe.CategoryTerraform, false),
+		variableDoc("var-b", "b", "old", tfe.CategoryTerraform, false),
+	))
+	stub.reply("PATCH", "/api/v2/workspaces/ws-1/vars/var-a", http.StatusOK,
+		`{"data":`+variableDoc("var-a", "a", "old", tfe.CategoryTerraform, false)+`}`)
+
+	desc := "documented"
+	vars := []workspaceVar{
+		{Key: "a", Value: "new", Description: &desc},
+		{Key: "b", Value: "new"},
+		{Key: "c", Value: "new", Description: &desc},
+	}
+	w := &tfe.Workspace{ID: "ws-1"}
+	result, err := syncVariables(context.Background(), client, newVariableCache(client), w, vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bodies := stub.requestBodies("PATCH", "/api/v2/workspaces/ws-1/vars/var-a")
+	if len(bodies) != 1 {
+		t.Fatalf("updates of a = %d, want 1", len(bodies))
+	}
+	if !strings.Contains(bodies[0], `"description":"documented"`) {
+		t.Errorf("update %s does not set the description", bodies[0])
+	}
+	for _, attr := range []string{`"value"`, `"hcl"`, `"sensitive"`, `"category"`} {
+		if strings.Contains(bodies[0], attr) {
+			t.Errorf("update %s sends %s", bodies[0], attr)
+		}
+	}
+	if n := stub.count("PATCH", "/api/v2/workspaces/ws-1/vars/var-b"); n != 0 {
+		t.Errorf("b without a description was updated %d times", n)
+	}
+	if n := stub.count("POST", "/api/v2/workspaces/ws-1/vars"); n != 0 {
+		t.Errorf("descriptions-only created %d variables", n)
+	}
+	if result.updated != 1 || result.unchanged != 1 || result.skipped != 1 {
+		t.Errorf("updated, unchanged, skipped = %d, %d, %d, want 1, 1, 1", result.updated, result.unchanged, result.skipped)
+	}
+}
+
+func TestMergeSourceVars(t *testing.T) {
+	env := "env"
+	terraform := "terraform"
+	copied := []workspaceVar{
+		{Key: "region", Value: "eu-west-1", Category: &terraform},
+		{Key: "REGION", Value: "eu-west-1", Category: &env},
+		{Key: "size", Value: "small", Category: &terraform},
+		{Key: "TOKEN", Value: "copied", Category: &env},
+	}
+	vars := []workspaceVar{
+		{Key: "region", Value: "us-east-1"},
+		{Key: "TOKEN", Value: "declared", Category: &env},
+		{Key: "size", Value: "large", Category: &env},
+	}
+
+	merged := mergeSourceVars(copied, vars)
+	var got []string
+	for _, v := range merged {
+		got = append(got, string(varCategory(v))+"/"+v.Key+"="+v.Value.(string))
+	}
+	want := []string{
+		"env/REGION=eu-west-1",
+		"terraform/size=small",
+		"terraform/region=us-east-1",
+		"env/TOKEN=declared",
+		"env/size=large",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("merged = %v, want %v", got, want)
+	}
+}
+
+// createdVariables decodes the attributes of the variables created on ws-1
+func createdVariables(t *testing.T, stub *tfeStub) []map[string]any {
+	t.Helper()
+	var created []map[string]any
+	for _, body := range stub.requestBodies("POST", "/api/v2/workspaces/ws-1/vars") {
+		var doc struct {
+			Data struct {
+				Attributes map[string]any `json:"attributes"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(body), &doc); err != nil {
+			t.Fatalf("could not decode the variable creation: %v", err)
+		}
+		created = append(created, doc.Data.Attributes)
+	}
+	return created
+}
+
+func TestRunTrimsValues(t *testing.T) {
+	tests := []struct {
+		name string
+		trim string
+		want string
+	}{
+		{name: "verbatim by default", want: "  eu-west-1\n"},
+		{name: "trimmed", trim: "true", want: "eu-west-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.reply("POST", "/api/v2/workspaces/ws-1/vars", http.StatusCreated,
+				`{"data":{"id":"var-1","type":"vars","attributes":{"key":"region"}}}`)
+			setInput(t, &jsonVars, `[{"key":"region","value":"  eu-west-1\n"},{"key":"enabled","value":true}]`)
+			setInput(t, &trimValues, tt.trim)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			values := map[string]any{}
+			for _, attrs := range createdVariables(t, stub) {
+				values[attrs["key"].(string)] = attrs["value"]
+			}
+			if len(values) != 2 {
+				t.Fatalf("variables created = %v, want region and enabled", values)
+			}
+			if values["region"] != tt.want {
+				t.Errorf("region = %q, want %q", values["region"], tt.want)
+			}
+			if values["enabled"] != "true" {
+				t.Errorf("enabled = %q, want true", values["enabled"])
+			}
+		})
+	}
+}
+
+func TestRunWritesPruneOutputs(t *testing.T) {
+	tests := []struct {
+		name       string
+		failDelete string
+		wantErr    string
+		wantCount  string
+		wantKeys   string
+		wantLeft   int
+	}{
+		{name: "every stale variable deleted", wantCount: "2", wantKeys: `["old1","old2"]`, wantLeft: 1},
+		{name: "delete failed", failDelete: "old2", wantErr: `could not delete variable "old2"`, wantCount: "1", wantKeys: `["old1"]`, wantLeft: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			store := stub.serveVariables("ws-1",
+				fakeVariable{ID: "var-1", Key: "keep", Value: "1", Category: "terraform"},
+				fakeVariable{ID: "var-2", Key: "old1", Value: "2", Category: "terraform"},
+				fakeVariable{ID: "var-3", Key: "old2", Value: "3", Category: "env"},
+			)
+			store.fail = func(method, key string) bool { return method == "DELETE" && key == tt.failDelete }
+			outputs := captureOutputs(t)
+			setInput(t, &jsonVars, `[{"key":"keep","value":"1"}]`)
+			setInput(t, &prune, "true")
+
+			err := run(context.Background(), nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			got := outputs()
+			if got["variables-pruned"] != tt.wantCount || got["pruned-keys"] != tt.wantKeys {
+				t.Errorf("variables-pruned, pruned-keys = %q, %q, want %q, %q", got["variables-pruned"], got["pruned-keys"], tt.wantCount, tt.wantKeys)
+			}
+			if left := len(store.snapshot()); left != tt.wantLeft {
+				t.Errorf("variables left = %d, want %d", left, tt.wantLeft)
+			}
+		})
+	}
+}
+
+func TestValidateVarKeys(t *testing.T) {
+	env := "env"
+	tests := []struct {
+		name    string
+		vars    []workspaceVar
+		wantErr string
+	}{
+		{name: "valid keys", vars: []workspaceVar{{Key: "region"}, {Key: "_private"}, {Key: "instance-count_2"}}},
+		{name: "leading digit", vars: []workspaceVar{{Key: "region"}, {Key: "2fast"}}, wantErr: `invalid variable key "2fast"`},
+		{name: "dot", vars: []workspaceVar{{Key: "db.password"}}, wantErr: `invalid variable key "db.password"`},
+		{name: "environment variables are not identifiers", vars: []workspaceVar{{Key: "TF_LOG.LEVEL", Category: &env}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateVarKeys(tt.vars)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunValidatesKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate string
+		wantErr  string
+	}{
+		{name: "on by default", wantErr: `invalid variable key "db.password"`},
+		{name: "disabled", validate: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			store := stub.serveVariables("ws-1")
+			setInput(t, &jsonVars, `[{"key":"db.password","value":"x"}]`)
+			setInput(t, &validateKeys, tt.validate)
+
+			err := run(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if n := stub.count("GET", "/api/v2/workspaces/ws-1/vars"); n != 0 {
+					t.Errorf("variables listed %d times before failing", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(store.snapshot()) != 1 {
+				t.Error("the variable was not created")
+			}
+		})
+	}
+}
+
+func TestRunSummarizesVariables(t *testing.T) {
+	tests := []struct {
+		name      string
+		summarize string
+		debug     bool
+		wantLines []string
+		absent    []string
+	}{
+		{
+			name:      "per-variable lines by default",
+			wantLines: []string{`Created variable "b"`, `Updated variable "a"`, `Deleted variable "old"`},
+			absent:    []string{"Variables: "},
+		},
+		{
+			name:      "summary line",
+			summarize: "true",
+			wantLines: []string{"Variables: 1 created, 1 updated, 1 pruned, 0 unchanged"},
+			absent:    []string{`Created variable "b"`, `Updated variable "a"`, `Deleted variable "old"`},
+		},
+		{
+			name:      "per-variable lines kept at the debug level",
+			summarize: "true",
+			debug:     true,
+			wantLines: []string{"Variables: 1 created, 1 updated, 1 pruned, 0 unchanged", `Created variable "b"`, `Deleted variable "old"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveVariables("ws-1",
+				fakeVariable{ID: "var-1", Key: "a", Value: "1", Category: "terraform"},
+				fakeVariable{ID: "var-2", Key: "old", Value: "2", Category: "terraform"},
+			)
+			setInput(t, &jsonVars, `[{"key":"a","value":"changed"},{"key":"b","value":"new"}]`)
+			setInput(t, &prune, "true")
+			setInput(t, &varsSummary, tt.summarize)
+			if tt.debug {
+				setInput(t, &logLevelIn, "debug")
+			}
+
+			var err error
+			stdout := captureStdout(t, func() { err = run(context.Background(), nil) })
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			lines := strings.Split(stdout, "\n")
+			for _, want := range tt.wantLines {
+				if !slices.Contains(lines, want) {
+					t.Errorf("log misses %q:\n%s", want, stdout)
+				}
+			}
+			for _, absent := range tt.absent {
+				if strings.Contains(stdout, absent) {
+					t.Errorf("log contains %q:\n%s", absent, stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncResultSummary(t *testing.T) {
+	r := &syncResult{created: 12, updated: 3, unchanged: 40}
+	if got := r.summary([]string{"a", "b"}); got != "12 created, 3 updated, 2 pruned, 40 unchanged" {
+		t.Errorf("summary = %q", got)
+	}
+	if got := r.summary(nil); got != "12 created, 3 updated, 40 unchanged" {
+		t.Errorf("summary without prune = %q", got)
+	}
+	r.skipped = 1
+	if got := r.summary(nil); got != "12 created, 3 updated, 40 unchanged, 1 skipped" {
+		t.Errorf("summary with skipped = %q", got)
+	}
+}
+
+func TestSyncVariablesIgnoresUpdates(t *testing.T) {
+	stub, client := newTFEStub(t)
+	store := stub.serveVariables("ws-1",
+		fakeVariable{ID: "var-1", Key: "replicas", Value: "7", Category: "terraform"},
+		fakeVariable{ID: "var-2", Key: "region", Value: "eu-west-1", Category: "terraform"},
+	)
+	setInput(t, &ignoredKeys, "replicas, budget")
+	vars := []workspaceVar{
+		{Key: "replicas", Value: "3"},
+		{Key: "budget", Value: "100"},
+		{Key: "region", Value: "eu-central-1"},
+	}
+
+	result, err := syncVariables(context.Background(), client, newVariableCache(client), &tfe.Workspace{ID: "ws-1"}, vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, v := range store.snapshot() {
+		got[v.Key] = v.Value
+	}
+	want := map[string]string{"replicas": "7", "budget": "100", "region": "eu-central-1"}
+	if !maps.Equal(got, want) {
+		t.Errorf("variables = %v, want %v", got, want)
+	}
+	if result.created != 1 || result.updated != 1 || result.skipped != 1 {
+		t.Errorf("created, updated, skipped = %d, %d, %d, want 1 each", result.created, result.updated, result.skipped)
+	}
+}
+
+func TestRunSkipsNoOpUpdates(t *testing.T) {
+	tests := []struct {
+		name          string
+		skip          string
+		wantUpdated   []string
+		wantUnchanged string
+	}{
+		{name: "every variable updated by default", wantUpdated: []string{"var-1", "var-2", "var-3"}},
+		{name: "no-op updates skipped", skip: "true", wantUpdated: []string{"var-2", "var-3"}, wantUnchanged: `["region"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.serveVariables("ws-1",
+				fakeVariable{ID: "var-1", Key: "region", Value: "eu-west-1", Category: "terraform"},
+				fakeVariable{ID: "var-2", Key: "replicas", Value: "7", Category: "terraform"},
+				fakeVariable{ID: "var-3", Key: "token", Value: "s3cret", Category: "terraform", Sensitive: true},
+			)
+			outputs := captureOutputs(t)
+			setInput(t, &jsonVars, `[{"key":"region","value":"eu-west-1"},{"key":"replicas","value":"3"},{"key":"token","value":"s3cret","sensitive":true}]`)
+			setInput(t, &skipNoOp, tt.skip)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var updated []string
+			for _, id := range []string{"var-1", "var-2", "var-3"} {
+				if stub.count("PATCH", "/api/v2/workspaces/ws-1/vars/"+id) > 0 {
+					updated = append(updated, id)
+				}
+			}
+			if !slices.Equal(updated, tt.wantUpdated) {
+				t.Errorf("updated = %v, want %v", updated, tt.wantUpdated)
+			}
+			if got := outputs()["unchanged-keys"]; got != tt.wantUnchanged {
+				t.Errorf("unchanged-keys = %q, want %q", got, tt.wantUnchanged)
+			}
+		})
+	}
+}
+
+func TestSyncVariablesConcurrently(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+	}{
+		{name: "payload order"},
+		{name: "sensitive last", policy: "last"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			store := stub.serveVariables("ws-1")
+			var flight inFlight
+			var mu sync.Mutex
+			var order []bool
+			stub.handle("POST", "/api/v2/workspaces/ws-1/vars", flight.wrap(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				r.Body = io.NopCloser(strings.NewReader(string(body)))
+				mu.Lock()
+				order = append(order, strings.Contains(string(body), `"sensitive":true`))
+				mu.Unlock()
+				store.create(w, r)
+			}))
+			setInput(t, &concurrency, "3")
+			setInput(t, &sensOrder, tt.policy)
+
+			yes := true
+			var vars []workspaceVar
+			for i := 0; i < 9; i++ {
+				v := workspaceVar{Key: fmt.Sprintf("v%d", i), Value: "x"}
+				if i%3 == 0 {
+					v.Sensitive = &yes
+				}
+				vars = append(vars, v)
+			}
+			vars, err := orderVars(vars, tt.policy)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			result, err := syncVariables(context.Background(), client, newVariableCache(client), &tfe.Workspace{ID: "ws-1"}, vars)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result.created != 9 || len(store.snapshot()) != 9 {
+				t.Errorf("created = %d, stored = %d, want 9", result.created, len(store.snapshot()))
+			}
+			if flight.peak < 2 || flight.peak > 3 {
+				t.Errorf("peak creates in flight = %d, want 2 or 3", flight.peak)
+			}
+			if tt.policy == "last" {
+				for i, sensitive := range order {
+					if !sensitive && slices.Contains(order[:i], true) {
+						t.Fatalf("a non-sensitive variable was created after a sensitive one: %v", order)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSyncVariablesStopsAtFailure(t *testing.T) {
+	stub, client := newTFEStub(t)
+	store := stub.serveVariables("ws-1")
+	store.fail = func(method, key string) bool { return key == "v0" }
+	setInput(t, &concurrency, "1")
+
+	vars := []workspaceVar{{Key: "v0", Value: "x"}, {Key: "v1", Value: "x"}, {Key: "v2", Value: "x"}}
+	_, err := syncVariables(context.Background(), client, newVariableCache(client), &tfe.Workspace{ID: "ws-1"}, vars)
+	if err == nil || !strings.Contains(err.Error(), `could not create variable "v0"`) {
+		t.Fatalf("error = %v, want the create of v0 to fail", err)
+	}
+	if n := len(store.snapshot()); n != 0 {
+		t.Errorf("%d variables were created after the failure", n)
+	}
+}
+
+func TestPruneVariables(t *testing.T) {
+	tests := []struct {
+		name        string
+		keepSecrets string
+		maxPrune    string
+		wantErr     string
+		wantPruned  int
+		wantKept    []string
+		wantLeft    int
+	}{
+		{name: "sensitive variables are kept", wantPruned: 8, wantKept: []string{"secret"}, wantLeft: 2},
+		{name: "sensitive variables are pruned on opt-in", keepSecrets: "false", wantPruned: 9, wantLeft: 1},
+		{name: "kept variables do not count against max-prune", maxPrune: "8", wantPruned: 8, wantKept: []string{"secret"}, wantLeft: 2},
+		{name: "max-prune", maxPrune: "7", wantErr: "more than max-prune 7", wantKept: []string{"secret"}, wantLeft: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			initial := []fakeVariable{
+				{ID: "var-declared", Key: "declared", Category: "terraform"},
+				{ID: "var-secret", Key: "secret", Category: "terraform", Sensitive: true},
+			}
+			for i := 0; i < 8; i++ {
+				initial = append(initial, fakeVariable{ID: fmt.Sprintf("var-%d", i), Key: fmt.Sprintf("stale%d", i), Category: "terraform"})
+			}
+			store := stub.serveVariables("ws-1", initial...)
+			var flight inFlight
+			stub.handlePrefix("DELETE", "/api/v2/workspaces/ws-1/vars/", flight.wrap(store.delete))
+			setInput(t, &concurrency, "3")
+			setInput(t, &noPruneSens, tt.keepSecrets)
+			setInput(t, &maxPrune, tt.maxPrune)
+
+			vars := []workspaceVar{{Key: "declared", Value: "x"}}
+			pruned, kept, err := pruneVariables(context.Background(), client, newVariableCache(client), &tfe.Workspace{ID: "ws-1"}, vars)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			if len(pruned) != tt.wantPruned {
+				t.Errorf("pruned = %d, want %d", len(pruned), tt.wantPruned)
+			}
+			var keptKeys []string
+			for _, ev := range kept {
+				keptKeys = append(keptKeys, ev.Key)
+			}
+			if !slices.Equal(keptKeys, tt.wantKept) {
+				t.Errorf("kept = %v, want %v", keptKeys, tt.wantKept)
+			}
+			if n := len(store.snapshot()); n != tt.wantLeft {
+				t.Errorf("variables left = %d, want %d", n, tt.wantLeft)
+			}
+			if tt.wantPruned > 0 && (flight.peak < 2 || flight.peak > 3) {
+				t.Errorf("peak deletes in flight = %d, want 2 or 3", flight.peak)
+			}
+		})
+	}
+}
+
+func TestVariableCacheIsPerWorkspace(t *testing.T) {
+	stub, client := newTFEStub(t)
+	storeA := stub.serveVariables("ws-a", fakeVariable{ID: "var-a", Key: "region", Value: "eu-west-1", Category: "terraform"})
+	storeB := stub.serveVariables("ws-b")
+	cache := newVariableCache(client)
+
+	vars := []workspaceVar{{Key: "region", Value: "us-east-1"}}
+	for _, id := range []string{"ws-a", "ws-b"} {
+		if _, err := syncVariables(context.Background(), client, cache, &tfe.Workspace{ID: id}, vars); err != nil {
+			t.Fatalf("could not sync %s: %v", id, err)
+		}
+	}
+
+	// The variable of ws-a must not be found when syncing ws-b
+	if n := stub.count("PATCH", "/api/v2/workspaces/ws-b/vars/var-a"); n != 0 {
+		t.Errorf("ws-b updated the variable of ws-a %d times", n)
+	}
+	if a := storeA.snapshot(); len(a) != 1 || a[0].Value != "us-east-1" {
+		t.Errorf("ws-a variables = %+v, want region updated", a)
+	}
+	if b := storeB.snapshot(); len(b) != 1 || b[0].Key != "region" || b[0].ID == "var-a" {
+		t.Errorf("ws-b variables = %+v, want region created", b)
+	}
+	if n := stub.count("GET", "/api/v2/workspaces/ws-a/vars") + stub.count("GET", "/api/v2/workspaces/ws-b/vars"); n != 2 {
+		t.Errorf("listings = %d, want one per workspace", n)
+	}
+}
+
+func TestOrderVars(t *testing.T) {
+	yes, no := true, false
+	vars := []workspaceVar{
+		{Key: "a", Sensitive: &yes},
+		{Key: "b"},
+		{Key: "c", Sensitive: &yes},
+		{Key: "d", Sensitive: &no},
+	}
+	tests := []struct {
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{policy: "", want: "a b c d"},
+		{policy: "last", want: "b d a c"},
+		{policy: "first", want: "a c b d"},
+		{policy: "middle", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ordered, err := orderVars(vars, tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var keys []string
+			for _, v := range ordered {
+				keys = append(keys, v.Key)
+			}
+			if got := strings.Join(keys, " "); got != tt.want {
+				t.Errorf("order = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncVariablesIsIdempotent(t *testing.T) {
+	env := "env"
+	tests := []struct {
+		name     string
+		existing []fakeVariable
+		vars     []workspaceVar
+	}{
+		{name: "without category", vars: []workspaceVar{{Key: "region", Value: "eu-west-1"}}},
+		{name: "with category", vars: []workspaceVar{{Key: "REGION", Value: "eu-west-1", Category: &env}}},
+		{
+			name:     "env variable of the same key",
+			existing: []fakeVariable{{ID: "var-env", Key: "region", Value: "us-east-1", Category: "env"}},
+			vars:     []workspaceVar{{Key: "region", Value: "eu-west-1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			store := stub.serveVariables("ws-1", tt.existing...)
+			w := &tfe.Workspace{ID: "ws-1"}
+
+			// Every run lists the variables anew, like separate jobs do
+			first, err := syncVariables(context.Background(), client, newVariableCache(client), w, tt.vars)
+			if err != nil {
+				t.Fatalf("first sync: %v", err)
+			}
+			second, err := syncVariables(context.Background(), client, newVariableCache(client), w, tt.vars)
+			if err != nil {
+				t.Fatalf("second sync: %v", err)
+			}
+
+			if first.created != 1 || first.updated != 0 {
+				t.Errorf("first sync created, updated = %d, %d, want 1, 0", first.created, first.updated)
+			}
+			if second.created != 0 || second.updated != 1 {
+				t.Errorf("second sync created, updated = %d, %d, want 0, 1", second.created, second.updated)
+			}
+			if n := len(store.snapshot()); n != len(tt.existing)+1 {
+				t.Errorf("variables = %d, want %d", n, len(tt.existing)+1)
+			}
+			if n := stub.count("PATCH", "/api/v2/workspaces/ws-1/vars/var-env"); n != 0 {
+				t.Errorf("the env variable was updated %d times", n)
+			}
+		})
+	}
+}
+
+func TestDedupeVars(t *testing.T) {
+	env, terraform := "env", "terraform"
+	tests := []struct {
+		name    string
+		mode    string
+		vars    []workspaceVar
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "no duplicates",
+			vars: []workspaceVar{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}},
+			want: []string{"terraform/a=1", "terraform/b=2"},
+		},
+		{
+			name: "last entry wins",
+			vars: []workspaceVar{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "a", Value: "3"}},
+			want: []string{"terraform/b=2", "terraform/a=3"},
+		},
+		{
+			name: "entries without a category are terraform",
+			vars: []workspaceVar{{Key: "a", Value: "1", Category: &terraform}, {Key: "a", Value: "2"}},
+			want: []string{"terraform/a=2"},
+		},
+		{
+			name: "same key in another category",
+			vars: []workspaceVar{{Key: "a", Value: "1"}, {Key: "a", Value: "2", Category: &env}},
+			want: []string{"terraform/a=1", "env/a=2"},
+		},
+		{
+			name:    "error",
+			mode:    "error",
+			vars:    []workspaceVar{{Key: "a", Value: "1"}, {Key: "a", Value: "2"}},
+			wantErr: `duplicate terraform variable "a" in json-vars`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deduped, err := dedupeVars(tt.vars, tt.mode)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var got []string
+			for _, v := range deduped {
+				got = append(got, string(varCategory(v))+"/"+v.Key+"="+v.Value.(string))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("deduped = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNoOpUpdate(t *testing.T) {
+	yes, no := true, false
+	env := "env"
+	description := "the region"
+	existing := &tfe.Variable{Key: "region", Value: "eu-west-1", Category: tfe.CategoryTerraform, Description: description}
+	tests := []struct {
+		name     string
+		existing *tfe.Variable
+		v        workspaceVar
+		want     bool
+	}{
+		{name: "identical", existing: existing, v: workspaceVar{Key: "region", Value: "eu-west-1"}, want: true},
+		{name: "same attributes spelled out", existing: existing, v: workspaceVar{Key: "region", Value: "eu-west-1", HCL: &no, Description: &description}, want: true},
+		{name: "other value", existing: existing, v: workspaceVar{Key: "region", Value: "eu-central-1"}},
+		{name: "other hcl flag", existing: existing, v: workspaceVar{Key: "region", Value: "eu-west-1", HCL: &yes}},
+		{name: "other category", existing: existing, v: workspaceVar{Key: "region", Value: "eu-west-1", Category: &env}},
+		{name: "sensitive", existing: &tfe.Variable{Key: "token", Sensitive: true}, v: workspaceVar{Key: "token", Value: ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNoOpUpdate(tt.existing, tt.v); got != tt.want {
+				t.Errorf("isNoOpUpdate() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariableDescription(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	const line = "Changed by terraform-cloud-action from acme/infra@abc123 at 2024-05-01T12:00:00Z"
+	declared := "the region"
+	tests := []struct {
+		name       string
+		provenance string
+		v          workspaceVar
+		existing   *tfe.Variable
+		want       string
+	}{
+		{name: "declared description without provenance", v: workspaceVar{Description: &declared}, want: "the region"},
+		{name: "declared description", provenance: "true", v: workspaceVar{Description: &declared}, want: "the region\n" + line},
+		{name: "no description", provenance: "true", want: line},
+		{
+			name:       "existing description kept and its line replaced",
+			provenance: "true",
+			existing:   &tfe.Variable{Description: "set by hand\nChanged by terraform-cloud-action from acme/infra@old at 2024-01-01T00:00:00Z"},
+			want:       "set by hand\n" + line,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("GITHUB_SHA", "abc123")
+			t.Setenv("GITHUB_REPOSITORY", "acme/infra")
+			setInput(t, &provenance, tt.provenance)
+
+			got := variableDescription(tt.v, tt.existing, now)
+			if got == nil || *got != tt.want {
+				t.Errorf("variableDescription() = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsNoOpUpdateIgnoresProvenance(t *testing.T) {
+	setInput(t, &provenance, "true")
+	description := "the region"
+	existing := &tfe.Variable{Key: "region", Value: "eu-west-1", Category: tfe.CategoryTerraform,
+		Description: "the region\nChanged by terraform-cloud-action from acme/infra@old at 2024-01-01T00:00:00Z"}
+
+	if !isNoOpUpdate(existing, workspaceVar{Key: "region", Value: "eu-west-1", Description: &description}) {
+		t.Error("an older provenance line alone made the variable need an update")
+	}
+}
+
+func TestRunForbidsSensitiveHCL(t *testing.T) {
+	tests := []struct {
+		name    string
+		vars    string
+		forbid  string
+		wantErr string
+	}{
+		{name: "allowed by default", vars: `[{"key":"db","value":{"user":"admin"},"sensitive":true}]`},
+		{name: "detected HCL", vars: `[{"key":"db","value":{"user":"admin"},"sensitive":true}]`, forbid: "true", wantErr: `variable "db" is both sensitive and HCL`},
+		{name: "explicit hcl flag", vars: `[{"key":"db","value":"x","hcl":true,"sensitive":true}]`, forbid: "true", wantErr: `variable "db" is both sensitive and HCL`},
+		{name: "hcl turned off", vars: `[{"key":"db","value":{"user":"admin"},"hcl":false,"sensitive":true}]`, forbid: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			store := stub.serveVariables("ws-1")
+			setInput(t, &jsonVars, tt.vars)
+			setInput(t, &noSensHCL, tt.forbid)
+
+			err := run(context.Background(), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if n := len(store.snapshot()); n != 0 {
+					t.Errorf("%d variables were created", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := len(store.snapshot()); n != 1 {
+				t.Errorf("variables created = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestParseVarsKeepsNumbers(t *testing.T) {
+	vars, err := parseVars(`[
+		{"key":"id","value":9007199254740993},
+		{"key":"ratio","value":0.1},
+		{"key":"limits","value":{"max":9007199254740993}},
+		{"key":"sizes","value":[1,2.5],"format":"json"}
+	]`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := map[string]string{}
+	for _, v := range vars {
+		got[v.Key] = varValue(v)
+	}
+	want := map[string]string{
+		"id":     "9007199254740993",
+		"ratio":  "0.1",
+		"limits": "{ max = 9007199254740993 }",
+		"sizes":  "[1,2.5]",
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("values = %v, want %v", got, want)
+	}
+}
+
+func TestRunRecreatesOnSensitivityChange(t *testing.T) {
+	tests := []struct {
+		name     string
+		recreate string
+		wantID   string
+	}{
+		{name: "updated in place by default", wantID: "var-1"},
+		{name: "recreated", recreate: "true", wantID: "var-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			store := stub.serveVariables("ws-1",
+				fakeVariable{ID: "var-1", Key: "token", Value: "s3cret", Description: "API token", Category: "terraform"},
+			)
+			store.next = 1
+			outputs := captureOutputs(t)
+			setInput(t, &jsonVars, `[{"key":"token","value":"s3cret","sensitive":true}]`)
+			setInput(t, &recreateSens, tt.recreate)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			vars := store.snapshot()
+			if len(vars) != 1 || vars[0].ID != tt.wantID || !vars[0].Sensitive || vars[0].Description != "API token" {
+				t.Errorf("variables = %+v, want %s sensitive with its description", vars, tt.wantID)
+			}
+			if got := outputs()["variable-ids"]; got != `{"terraform/token":"`+tt.wantID+`"}` {
+				t.Errorf("variable-ids = %s, want %s", got, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestRunWritesVariableIDs(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	store := stub.serveVariables("ws-1",
+		fakeVariable{ID: "var-1", Key: "FOO", Value: "old", Category: "terraform"},
+	)
+	store.next = 1
+	outputs := captureOutputs(t)
+	setInput(t, &jsonVars, `[{"key":"FOO","value":"new"},{"key":"FOO","value":"bar","category":"env"}]`)
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := outputs()["variable-ids"], `{"env/FOO":"var-2","terraform/FOO":"var-1"}`; got != want {
+		t.Errorf("variable-ids = %s, want %s", got, want)
+	}
+}
+
+func TestRunWritesCategories(t *testing.T) {
+	tests := []struct {
+		name     string
+		vars     string
+		prune    string
+		skipNoOp string
+		want     string
+	}{
+		{name: "terraform only", vars: `[{"key":"FOO","value":"new"}]`, want: `["terraform"]`},
+		{name: "same key in both categories", vars: `[{"key":"FOO","value":"new"},{"key":"FOO","value":"bar","category":"env"}]`, want: `["env","terraform"]`},
+		{name: "pruned env variable", vars: `[{"key":"FOO","value":"new"}]`, prune: "true", want: `["env","terraform"]`},
+		{name: "nothing touched", vars: `[{"key":"FOO","value":"old"}]`, skipNoOp: "true", want: `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			initial := []fakeVariable{{ID: "var-1", Key: "FOO", Value: "old", Category: "terraform"}}
+			if tt.prune != "" {
+				initial = append(initial, fakeVariable{ID: "var-2", Key: "STALE", Value: "x", Category: "env"})
+			}
+			store := stub.serveVariables("ws-1", initial...)
+			store.next = len(initial)
+			outputs := captureOutputs(t)
+			setInput(t, &jsonVars, tt.vars)
+			setInput(t, &prune, tt.prune)
+			setInput(t, &skipNoOp, tt.skipNoOp)
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := outputs()["categories"]; got != tt.want {
+				t.Errorf("categories = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWritesVariableCounts(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	store := stub.serveVariables("ws-1",
+		fakeVariable{ID: "var-1", Key: "a", Value: "old", Category: "terraform"},
+		fakeVariable{ID: "var-2", Key: "c", Value: "same", Category: "terraform"},
+		fakeVariable{ID: "var-3", Key: "old", Value: "x", Category: "terraform"},
+	)
+	store.next = 3
+	outputs := captureOutputs(t)
+	setInput(t, &jsonVars, `[{"key":"a","value":"new"},{"key":"b","value":"added"},{"key":"c","value":"same"}]`)
+	setInput(t, &skipNoOp, "true")
+	setInput(t, &prune, "true")
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := outputs()
+	want := map[string]string{
+		"variables-created": "1",
+		"variables-updated": "1",
+		"variables-pruned":  "1",
+		"variables-skipped": "1",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func TestRunCopiesSourceWorkspace(t *testing.T) {
+	tests := []struct {
+		name      string
+		canUpdate bool
+		wantErr   string
+	}{
+		{name: "copied", canUpdate: true},
+		// Copying writes variables even without json-vars
+		{name: "token may not write variables", wantErr: "can-update-variable (to write variables)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusOK, fmt.Sprintf(`{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws",
+				"permissions":{"can-update":true,"can-update-variable":%t,"can-queue-run":true,"can-queue-apply":true}}}}`, tt.canUpdate))
+			stub.reply("GET", "/api/v2/organizations/org/workspaces/template", http.StatusOK,
+				`{"data":{"id":"ws-2","type":"workspaces","attributes":{"name":"template"}}}`)
+			stub.serveVariables("ws-2",
+				fakeVariable{ID: "var-1", Key: "region", Value: "us-east-1", Category: "terraform"},
+				fakeVariable{ID: "var-2", Key: "TF_LOG", Value: "info", Description: "log level", Category: "env"},
+				fakeVariable{ID: "var-3", Key: "token", Value: "s3cret", Category: "terraform", Sensitive: true},
+			)
+			target := stub.serveVariables("ws-1")
+			setInput(t, &sourceWS, "template")
+			if tt.wantErr == "" {
+				// json-vars wins over the copied region
+				setInput(t, &jsonVars, `[{"key":"region","value":"eu-west-1"}]`)
+			}
+
+			var err error
+			log := captureStdout(t, func() {
+				err = run(context.Background(), nil)
+			})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				if len(target.snapshot()) != 0 || stub.count("GET", "/api/v2/workspaces/ws-2/vars") != 0 {
+					t.Error("the source workspace was copied before the permissions were checked")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := map[string]fakeVariable{}
+			for _, v := range target.snapshot() {
+				got[v.Category+"/"+v.Key] = v
+			}
+			if len(got) != 2 || got["terraform/region"].Value != "eu-west-1" ||
+				got["env/TF_LOG"].Value != "info" || got["env/TF_LOG"].Description != "log level" {
+				t.Errorf("target variables = %+v, want region from json-vars and TF_LOG copied", got)
+			}
+			if !strings.Contains(log, `skipped 1 sensitive variables of workspace "template" that cannot be read: token`) {
+				t.Errorf("log = %q, want the skipped sensitive variable reported", log)
+			}
+		})
+	}
+}
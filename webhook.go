@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// webhookPayload is the JSON body posted to webhook-url once the run settled
+type webhookPayload struct {
+	Organization string          `json:"organization"`
+	Workspace    string          `json:"workspace"`
+	RunID        string          `json:"run_id"`
+	RunURL       string          `json:"run_url"`
+	Status       string          `json:"status"`
+	Error        string          `json:"error,omitempty"`
+	Changes      *webhookChanges `json:"changes,omitempty"`
+}
+
+// webhookChanges are the resource counts of the run's plan
+type webhookChanges struct {
+	Add     int `json:"add"`
+	Change  int `json:"change"`
+	Destroy int `json:"destroy"`
+}
+
+// notifyWebhook posts the results of the run to webhook-url. When
+// webhook-secret is set the body is signed with HMAC-SHA256 in the
+// X-Signature-256 header. Failures are only logged, as notifications must
+// not fail the action
+func notifyWebhook(ctx context.Context, client *tfe.Client, runID, runURL string, runErr error, timeout time.Duration) {
+	// The run settles on cancellation too, which is worth notifying
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	payload := webhookPayload{Organization: organization, Workspace: workspace, RunID: runID, RunURL: runURL}
+	if runErr != nil {
+		payload.Error = runErr.Error()
+	}
+	r, err := client.Runs.Read(ctx, runID)
+	if err != nil {
+		logWarn("could not read run %q for the webhook: %v", runID, err)
+		payload.Status = "unknown"
+	} else {
+		payload.Status = string(r.Status)
+		if r.Plan != nil {
+			if plan, err := client.Plans.Read(ctx, r.Plan.ID); err == nil {
+				payload.Changes = &webhookChanges{plan.ResourceAdditions, plan.ResourceChanges, plan.ResourceDestructions}
+			}
+		}
+	}
+
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		logWarn("invalid webhook-url: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhookKey != "" {
+		mac := hmac.New(sha256.New, []byte(webhookKey))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logWarn("could not notify webhook: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logWarn("could not notify webhook: unexpected status %s", resp.Status)
+		return
+	}
+	logInfo("Notified webhook of run status %s", payload.Status)
+}
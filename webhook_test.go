@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	const doneRun = `{"data":{"id":"run-1","type":"runs","attributes":{"status":"applied"},"relationships":{"plan":{"data":{"id":"plan-1","type":"plans"}}}}}`
+	const plan = `{"data":{"id":"plan-1","type":"plans","attributes":{"resource-additions":1,"resource-changes":2,"resource-destructions":3}}}`
+
+	tests := []struct {
+		name        string
+		runMissing  bool
+		runErr      error
+		secret      string
+		status      int
+		wantPayload webhookPayload
+		wantWarning string
+	}{
+		{
+			name:        "applied run",
+			status:      http.StatusOK,
+			wantPayload: webhookPayload{Organization: "org", Workspace: "ws", RunID: "run-1", RunURL: "https://app/runs/run-1", Status: "applied", Changes: &webhookChanges{1, 2, 3}},
+		},
+		{
+			name:        "signed",
+			secret:      "s3cr3t",
+			status:      http.StatusNoContent,
+			wantPayload: webhookPayload{Organization: "org", Workspace: "ws", RunID: "run-1", RunURL: "https://app/runs/run-1", Status: "applied", Changes: &webhookChanges{1, 2, 3}},
+		},
+		{
+			name:        "failed run",
+			runErr:      errors.New("run errored"),
+			status:      http.StatusOK,
+			wantPayload: webhookPayload{Organization: "org", Workspace: "ws", RunID: "run-1", RunURL: "https://app/runs/run-1", Status: "applied", Error: "run errored", Changes: &webhookChanges{1, 2, 3}},
+		},
+		{
+			name:        "unreadable run",
+			runMissing:  true,
+			status:      http.StatusOK,
+			wantPayload: webhookPayload{Organization: "org", Workspace: "ws", RunID: "run-1", RunURL: "https://app/runs/run-1", Status: "unknown"},
+			wantWarning: `could not read run "run-1" for the webhook`,
+		},
+		{
+			name:        "webhook failure is only a warning",
+			status:      http.StatusInternalServerError,
+			wantPayload: webhookPayload{Organization: "org", Workspace: "ws", RunID: "run-1", RunURL: "https://app/runs/run-1", Status: "applied", Changes: &webhookChanges{1, 2, 3}},
+			wantWarning: "could not notify webhook: unexpected status 500",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			if !tt.runMissing {
+				stub.reply("GET", "/api/v2/runs/run-1", http.StatusOK, doneRun)
+			}
+			stub.reply("GET", "/api/v2/plans/plan-1", http.StatusOK, plan)
+
+			var body []byte
+			var header http.Header
+			hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+				header = r.Header
+				w.WriteHeader(tt.status)
+			}))
+			defer hook.Close()
+			setInput(t, &webhookURL, hook.URL)
+			setInput(t, &webhookKey, tt.secret)
+			setInput(t, &organization, "org")
+			setInput(t, &workspace, "ws")
+			var logs bytes.Buffer
+			prev := logOutput
+			logOutput = &logs
+			t.Cleanup(func() { logOutput = prev })
+
+			notifyWebhook(context.Background(), client, "run-1", "https://app/runs/run-1", tt.runErr, 5*time.Second)
+
+			var got webhookPayload
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("invalid payload %s: %v", body, err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.wantPayload)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("payload = %s, want %s", gotJSON, wantJSON)
+			}
+			if ct := header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			wantSignature := ""
+			if tt.secret != "" {
+				mac := hmac.New(sha256.New, []byte(tt.secret))
+				mac.Write(body)
+				wantSignature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			}
+			if sig := header.Get("X-Signature-256"); sig != wantSignature {
+				t.Errorf("X-Signature-256 = %q, want %q", sig, wantSignature)
+			}
+			if tt.wantWarning != "" && !strings.Contains(logs.String(), tt.wantWarning) {
+				t.Errorf("logs %q do not warn %q", logs.String(), tt.wantWarning)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+// splitList splits a comma or newline separated input, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// createdReadRetries bounds the reads retried while a newly created
+// workspace is not yet visible
+const createdReadRetries = 5
+
+// createWorkspace creates the workspace and reads it back. Right after
+// creation the read may briefly 404 until the API is consistent, so not found
+// errors are retried with a short backoff
+func createWorkspace(ctx context.Context, client *tfe.Client) (*tfe.Workspace, error) {
+	created, err := client.Workspaces.Create(ctx, organization, tfe.WorkspaceCreateOptions{
+		Name: tfe.String(workspace),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not create workspace: %w", err)
+	}
+	logInfo("Created workspace %q", workspace)
+
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		w, err := client.Workspaces.ReadByID(ctx, created.ID)
+		if err == nil || !errors.Is(err, tfe.ErrResourceNotFound) || attempt == createdReadRetries {
+			return w, err
+		}
+		logDebug("Workspace %q not readable yet, retrying in %s", workspace, backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// reconcileRemoteState applies the global-remote-state and
+// remote-state-consumers inputs to the workspace
+func reconcileRemoteState(ctx context.Context, client *tfe.Client, w *tfe.Workspace) error {
+	if globalState != "" {
+		enabled := globalState == "true"
+		if w.GlobalRemoteState != enabled {
+			_, err := client.Workspaces.UpdateByID(ctx, w.ID, tfe.WorkspaceUpdateOptions{
+				GlobalRemoteState: tfe.Bool(enabled),
+			})
+			if err != nil {
+				return fmt.Errorf("could not update global remote state sharing: %w", err)
+			}
+			w.GlobalRemoteState = enabled
+			logInfo("Set global remote state sharing to %t", enabled)
+		}
+	}
+
+	if consumers == "" {
+		return nil
+	}
+	if w.GlobalRemoteState {
+		logWarn("workspace shares its state globally, remote-state-consumers has no effect until global-remote-state is disabled")
+	}
+
+	// "none" removes every consumer, an empty input leaves them unmanaged
+	var names []string
+	if consumers != "none" {
+		names = splitList(consumers)
+	}
+
+	desired := map[string]*tfe.Workspace{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "ws-") {
+			desired[name] = &tfe.Workspace{ID: name}
+			continue
+		}
+		consumer, err := client.Workspaces.Read(ctx, organization, name)
+		if err != nil {
+			return fmt.Errorf("could not read remote state consumer workspace %q: %w", name, err)
+		}
+		desired[consumer.ID] = consumer
+	}
+
+	current := map[string]*tfe.Workspace{}
+	opts := &tfe.RemoteStateConsumersListOptions{ListOptions: tfe.ListOptions{PageSize: 100}}
+	for {
+		page, err := client.Workspaces.ListRemoteStateConsumers(ctx, w.ID, opts)
+		if err != nil {
+			return fmt.Errorf("could not list remote state consumers: %w", err)
+		}
+		for _, consumer := range page.Items {
+			current[consumer.ID] = consumer
+		}
+		if page.Pagination == nil || page.Pagination.NextPage == 0 {
+			break
+		}
+		opts.PageNumber = page.Pagination.NextPage
+	}
+
+	var add, remove []*tfe.Workspace
+	for id, consumer := range desired {
+		if current[id] == nil {
+			add = append(add, consumer)
+		}
+	}
+	for id, consumer := range current {
+		if desired[id] == nil {
+			remove = append(remove, consumer)
+		}
+	}
+
+	if len(add) > 0 {
+		err := client.Workspaces.AddRemoteStateConsumers(ctx, w.ID, tfe.WorkspaceAddRemoteStateConsumersOptions{Workspaces: add})
+		if err != nil {
+			return fmt.Errorf("could not add remote state consumers: %w", err)
+		}
+		logInfo("Added %d remote state consumers", len(add))
+	}
+	if len(remove) > 0 {
+		err := client.Workspaces.RemoveRemoteStateConsumers(ctx, w.ID, tfe.WorkspaceRemoveRemoteStateConsumersOptions{Workspaces: remove})
+		if err != nil {
+			return fmt.Errorf("could not remove remote state consumers: %w", err)
+		}
+		logInfo("Removed %d remote state consumers", len(remove))
+	}
+
+	return nil
+}
+
+// reconcileVCSRepo applies the vcs-repo, vcs-branch and vcs-oauth-token-id
+// inputs to the workspace's VCS connection, updating it only when it differs
+func reconcileVCSRepo(ctx context.Context, client *tfe.Client, w *tfe.Workspace) error {
+	if vcsRepo == "none" {
+		if w.VCSRepo == nil {
+			return nil
+		}
+		updated, err := client.Workspaces.RemoveVCSConnectionByID(ctx, w.ID)
+		if err != nil {
+			return fmt.Errorf("could not remove VCS connection: %w", err)
+		}
+		w.VCSRepo = updated.VCSRepo
+		logInfo("Disconnected workspace from VCS")
+		return nil
+	}
+	if vcsRepo == "" && vcsBranch == "" && vcsOAuth == "" {
+		return nil
+	}
+
+	current := w.VCSRepo
+	if current == nil {
+		if vcsRepo == "" {
+			return fmt.Errorf("workspace is not connected to VCS, vcs-repo is required to connect it")
+		}
+		if vcsOAuth == "" {
+			return fmt.Errorf("workspace is not connected to VCS, vcs-oauth-token-id is required to connect it")
+		}
+		current = &tfe.VCSRepo{}
+	}
+
+	opts := &tfe.VCSRepoOptions{}
+	changed := false
+	if vcsRepo != "" && vcsRepo != current.Identifier {
+		opts.Identifier = tfe.String(vcsRepo)
+		changed = true
+	}
+	if vcsBranch != "" && vcsBranch != current.Branch {
+		opts.Branch = tfe.String(vcsBranch)
+		changed = true
+	}
+	if vcsOAuth != "" && vcsOAuth != current.OAuthTokenID {
+		opts.OAuthTokenID = tfe.String(vcsOAuth)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	// The API replaces the whole connection, unchanged attributes are sent
+	// along so that they are kept
+	if opts.Identifier == nil {
+		opts.Identifier = tfe.String(current.Identifier)
+	}
+	if opts.OAuthTokenID == nil && current.OAuthTokenID != "" {
+		opts.OAuthTokenID = tfe.String(current.OAuthTokenID)
+	}
+	if opts.Branch == nil && current.Branch != "" {
+		opts.Branch = tfe.String(current.Branch)
+	}
+
+	updated, err := client.Workspaces.UpdateByID(ctx, w.ID, tfe.WorkspaceUpdateOptions{VCSRepo: opts})
+	if err != nil {
+		return fmt.Errorf("could not update VCS connection: %w", err)
+	}
+	w.VCSRepo = updated.VCSRepo
+	logInfo("Connected workspace to %s (branch %q)", *opts.Identifier, updated.VCSRepo.Branch)
+	return nil
+}
+
+// reconcileVariableSets applies the variable sets listed in variable-sets
+// that the workspace lacks. With variable-sets-exclusive, sets applied to the
+// workspace but not listed are removed too, except global sets, which apply
+// to every workspace of the organization
+func reconcileVariableSets(ctx context.Context, client *tfe.Client, w *tfe.Workspace) error {
+	if varSets == "" {
+		return nil
+	}
+
+	// "none" declares no set, which only removes sets when exclusive
+	var names []string
+	if varSets != "none" {
+		names = splitList(varSets)
+	}
+
+	desired := map[string]string{}
+	for _, name := range names {
+		if strings.HasPrefix(name, "varset-") {
+			desired[name] = name
+			continue
+		}
+		set, err := findVariableSet(ctx, client, name)
+		if err != nil {
+			return err
+		}
+		desired[set.ID] = set.Name
+	}
+
+	sets, err := listWorkspaceVariableSets(ctx, client, w.ID, "")
+	if err != nil {
+		return err
+	}
+	current := map[string]*tfe.VariableSet{}
+	for _, set := range sets {
+		current[set.ID] = set
+	}
+
+	target := []*tfe.Workspace{{ID: w.ID}}
+	for id, name := range desired {
+		if current[id] != nil {
+			continue
+		}
+		err := client.VariableSets.ApplyToWorkspaces(ctx, id, &tfe.VariableSetApplyToWorkspacesOptions{Workspaces: target})
+		if err != nil {
+			return fmt.Errorf("could not apply variable set %q: %w", name, err)
+		}
+		logInfo("Applied variable set %q", name)
+	}
+	if varSetsExcl != "true" {
+		return nil
+	}
+	for id, set := range current {
+		if _, ok := desired[id]; ok || set.Global {
+			continue
+		}
+		err := client.VariableSets.RemoveFromWorkspaces(ctx, id, &tfe.VariableSetRemoveFromWorkspacesOptions{Workspaces: target})
+		if err != nil {
+			return fmt.Errorf("could not remove variable set %q: %w", set.Name, err)
+		}
+		logInfo("Removed variable set %q", set.Name)
+	}
+	return nil
+}
+
+// listWorkspaceVariableSets lists the variable sets applied to the
+// workspace, with the related resources of include
+func listWorkspaceVariableSets(ctx context.Context, client *tfe.Client, workspaceID, include string) ([]*tfe.VariableSet, error) {
+	var all []*tfe.VariableSet
+	opts := &tfe.VariableSetListOptions{ListOptions: tfe.ListOptions{PageSize: 100}, Include: include}
+	for {
+		page, err := client.VariableSets.ListForWorkspace(ctx, workspaceID, opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not list variable sets of the workspace: %w", err)
+		}
+		all = append(all, page.Items...)
+		if page.Pagination == nil || page.Pagination.NextPage == 0 {
+			return all, nil
+		}
+		opts.PageNumber = page.Pagination.NextPage
+	}
+}
+
+// findVariableSet returns the variable set of the organization named name
+func findVariableSet(ctx context.Context, client *tfe.Client, name string) (*tfe.VariableSet, error) {
+	opts := &tfe.VariableSetListOptions{ListOptions: tfe.ListOptions{PageSize: 100}, Query: name}
+	for {
+		page, err := client.VariableSets.List(ctx, organization, opts)
+		if err != nil {
+			return nil, fmt.Errorf("could not list variable sets: %w", err)
+		}
+		// The query matches partially, look for the exact name
+		for _, set := range page.Items {
+			if set.Name == name {
+				return set, nil
+			}
+		}
+		if page.Pagination == nil || page.Pagination.NextPage == 0 {
+			return nil, fmt.Errorf("variable set %q not found in organization %q", name, organization)
+		}
+		opts.PageNumber = page.Pagination.NextPage
+	}
+}
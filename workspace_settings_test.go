@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-tfe"
+)
+
+func TestReconcileRemoteState(t *testing.T) {
+	const consumersPath = "/api/v2/workspaces/ws-1/relationships/remote-state-consumers"
+	workspaceDoc := func(id string) string {
+		return `{"id":"` + id + `","type":"workspaces"}`
+	}
+
+	tests := []struct {
+		name        string
+		global      string
+		enabled     bool
+		consumers   string
+		current     []string
+		wantUpdate  bool
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{name: "enable global sharing", global: "true", wantUpdate: true},
+		{name: "global sharing already enabled", global: "true", enabled: true},
+		{name: "disable global sharing", global: "false", enabled: true, wantUpdate: true},
+		{
+			name:        "reconcile consumers",
+			consumers:   "app, ws-keep",
+			current:     []string{"ws-keep", "ws-old"},
+			wantAdded:   []string{"ws-app"},
+			wantRemoved: []string{"ws-old"},
+		},
+		{name: "consumers already in place", consumers: "ws-keep", current: []string{"ws-keep"}},
+		{name: "remove every consumer", consumers: "none", current: []string{"ws-old"}, wantRemoved: []string{"ws-old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("PATCH", "/api/v2/workspaces/ws-1", http.StatusOK, `{"data":`+workspaceDoc("ws-1")+`}`)
+			stub.reply("GET", "/api/v2/organizations/org/workspaces/app", http.StatusOK, `{"data":`+workspaceDoc("ws-app")+`}`)
+			var current []string
+			for _, id := range tt.current {
+				current = append(current, workspaceDoc(id))
+			}
+			stub.reply("GET", consumersPath, http.StatusOK, listDoc(current...))
+			stub.reply("POST", consumersPath, http.StatusNoContent, "")
+			stub.reply("DELETE", consumersPath, http.StatusNoContent, "")
+			setInput(t, &organization, "org")
+			setInput(t, &globalState, tt.global)
+			setInput(t, &consumers, tt.consumers)
+
+			w := &tfe.Workspace{ID: "ws-1", GlobalRemoteState: tt.enabled}
+			if err := reconcileRemoteState(context.Background(), client, w); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			updates := stub.requestBodies("PATCH", "/api/v2/workspaces/ws-1")
+			if (len(updates) > 0) != tt.wantUpdate {
+				t.Fatalf("workspace updates = %d, want update %t", len(updates), tt.wantUpdate)
+			}
+			if tt.wantUpdate && !strings.Contains(updates[0], `"global-remote-state":`+tt.global) {
+				t.Errorf("update = %s, want global-remote-state %s", updates[0], tt.global)
+			}
+			if tt.global != "" && w.GlobalRemoteState != (tt.global == "true") {
+				t.Errorf("workspace GlobalRemoteState = %t", w.GlobalRemoteState)
+			}
+			checkConsumers(t, "added", stub.requestBodies("POST", consumersPath), tt.wantAdded)
+			checkConsumers(t, "removed", stub.requestBodies("DELETE", consumersPath), tt.wantRemoved)
+		})
+	}
+}
+
+// checkConsumers checks that bodies is a single request naming the want
+// workspaces, or no request at all when want is empty
+func checkConsumers(t *testing.T, what string, bodies, want []string) {
+	t.Helper()
+	if len(want) == 0 {
+		if len(bodies) != 0 {
+			t.Errorf("%s consumers = %v, want none", what, bodies)
+		}
+		return
+	}
+	if len(bodies) != 1 {
+		t.Fatalf("%s consumer requests = %d, want 1", what, len(bodies))
+	}
+	for _, id := range want {
+		if !strings.Contains(bodies[0], `"id":"`+id+`"`) {
+			t.Errorf("%s consumers = %s, want %s", what, bodies[0], id)
+		}
+	}
+	if n := strings.Count(bodies[0], `"type":"workspaces"`); n != len(want) {
+		t.Errorf("%s consumers = %s, want %d workspaces", what, bodies[0], len(want))
+	}
+}
+
+func TestReconcileVariableSets(t *testing.T) {
+	varsetDoc := func(id, name string, global bool) string {
+		return fmt.Sprintf(`{"id":%q,"type":"varsets","attributes":{"name":%q,"global":%t}}`, id, name, global)
+	}
+	tests := []struct {
+		name        string
+		sets        string
+		exclusive   string
+		wantApplied []string
+		wantRemoved []string
+	}{
+		{name: "unset", wantApplied: nil},
+		{name: "missing sets applied", sets: "shared, varset-3", wantApplied: []string{"varset-1"}},
+		{name: "exclusive", sets: "shared, varset-3", exclusive: "true", wantApplied: []string{"varset-1"}, wantRemoved: []string{"varset-old"}},
+		{name: "exclusive without sets", sets: "none", exclusive: "true", wantRemoved: []string{"varset-3", "varset-old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("GET", "/api/v2/organizations/org/varsets", http.StatusOK, listDoc(
+				varsetDoc("varset-2", "shared-dev", false),
+				varsetDoc("varset-1", "shared", false),
+			))
+			stub.reply("GET", "/api/v2/workspaces/ws-1/varsets", http.StatusOK, listDoc(
+				varsetDoc("varset-3", "network", false),
+				varsetDoc("varset-old", "legacy", false),
+				varsetDoc("varset-global", "defaults", true),
+			))
+			for _, id := range []string{"varset-1", "varset-2", "varset-3", "varset-old", "varset-global"} {
+				stub.reply("POST", "/api/v2/varsets/"+id+"/relationships/workspaces", http.StatusNoContent, "")
+				stub.reply("DELETE", "/api/v2/varsets/"+id+"/relationships/workspaces", http.StatusNoContent, "")
+			}
+			setInput(t, &organization, "org")
+			setInput(t, &varSets, tt.sets)
+			setInput(t, &varSetsExcl, tt.exclusive)
+
+			if err := reconcileVariableSets(context.Background(), client, &tfe.Workspace{ID: "ws-1"}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var applied, removed []string
+			for _, id := range []string{"varset-1", "varset-2", "varset-3", "varset-old", "varset-global"} {
+				path := "/api/v2/varsets/" + id + "/relationships/workspaces"
+				if stub.count("POST", path) > 0 {
+					applied = append(applied, id)
+				}
+				if stub.count("DELETE", path) > 0 {
+					removed = append(removed, id)
+				}
+			}
+			if !slices.Equal(applied, tt.wantApplied) || !slices.Equal(removed, tt.wantRemoved) {
+				t.Errorf("applied, removed = %v, %v, want %v, %v", applied, removed, tt.wantApplied, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestRunWritesWorkspaceCreated(t *testing.T) {
+	const workspaceDoc = `{"data":{"id":"ws-1","type":"workspaces","attributes":{"name":"ws"}}}`
+	tests := []struct {
+		name        string
+		missing     bool
+		wantCreated string
+	}{
+		{name: "existing workspace", wantCreated: "false"},
+		{name: "created workspace", missing: true, wantCreated: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, _ := newTFEStub(t)
+			stub.serveWorkspace(t)
+			if tt.missing {
+				stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+			}
+			stub.reply("POST", "/api/v2/organizations/org/workspaces", http.StatusCreated, workspaceDoc)
+			stub.reply("GET", "/api/v2/workspaces/ws-1", http.StatusOK, workspaceDoc)
+			outputs := captureOutputs(t)
+			setInput(t, &createWS, "true")
+
+			if err := run(context.Background(), nil); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := outputs()["workspace-created"]; got != tt.wantCreated {
+				t.Errorf("workspace-created = %q, want %q", got, tt.wantCreated)
+			}
+			if n := stub.count("POST", "/api/v2/organizations/org/workspaces"); (n > 0) != tt.missing {
+				t.Errorf("workspace creations = %d", n)
+			}
+		})
+	}
+}
+
+func TestReconcileVCSRepo(t *testing.T) {
+	connected := func() *tfe.VCSRepo {
+		return &tfe.VCSRepo{Identifier: "acme/infra", Branch: "main", OAuthTokenID: "ot-1"}
+	}
+	tests := []struct {
+		name       string
+		current    *tfe.VCSRepo
+		repo       string
+		branch     string
+		oauth      string
+		wantErr    string
+		wantUpdate []string
+	}{
+		{name: "unset", current: connected()},
+		{name: "already connected", current: connected(), repo: "acme/infra", branch: "main"},
+		{
+			name:       "branch changed",
+			current:    connected(),
+			branch:     "release",
+			wantUpdate: []string{`"identifier":"acme/infra"`, `"branch":"release"`, `"oauth-token-id":"ot-1"`},
+		},
+		{
+			name:       "connect",
+			repo:       "acme/infra",
+			oauth:      "ot-1",
+			wantUpdate: []string{`"identifier":"acme/infra"`, `"oauth-token-id":"ot-1"`},
+		},
+		{name: "connect without oauth token", repo: "acme/infra", wantErr: "vcs-oauth-token-id is required"},
+		{name: "disconnect", current: connected(), repo: "none", wantUpdate: []string{`"vcs-repo":null`}},
+		{name: "already disconnected", repo: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub, client := newTFEStub(t)
+			stub.reply("PATCH", "/api/v2/workspaces/ws-1", http.StatusOK,
+				`{"data":{"id":"ws-1","type":"workspaces","attributes":{"vcs-repo":{"identifier":"acme/infra","branch":"release","oauth-token-id":"ot-1"}}}}`)
+			setInput(t, &vcsRepo, tt.repo)
+			setInput(t, &vcsBranch, tt.branch)
+			setInput(t, &vcsOAuth, tt.oauth)
+
+			err := reconcileVCSRepo(context.Background(), client, &tfe.Workspace{ID: "ws-1", VCSRepo: tt.current})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+
+			updates := stub.requestBodies("PATCH", "/api/v2/workspaces/ws-1")
+			if (len(updates) > 0) != (tt.wantUpdate != nil) {
+				t.Fatalf("workspace updates = %v, want %v", updates, tt.wantUpdate)
+			}
+			for _, want := range tt.wantUpdate {
+				if !strings.Contains(updates[0], want) {
+					t.Errorf("update = %s, want %s", updates[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCreatesMissingWorkspace(t *testing.T) {
+	stub, _ := newTFEStub(t)
+	stub.serveWorkspace(t)
+	stub.reply("GET", "/api/v2/organizations/org/workspaces/ws", http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+	stub.reply("POST", "/api/v2/organizations/org/workspaces", http.StatusCreated,
+		`{"data":{"id":"ws-9","type":"workspaces","attributes":{"name":"ws"}}}`)
+	// The new workspace is not readable right away
+	var mu sync.Mutex
+	reads := 0
+	stub.handle("GET", "/api/v2/workspaces/ws-9", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reads++
+		first := reads == 1
+		mu.Unlock()
+		if first {
+			writeJSONAPI(w, http.StatusNotFound, `{"errors":[{"status":"404","title":"not found"}]}`)
+			return
+		}
+		writeJSONAPI(w, http.StatusOK, `{"data":{"id":"ws-9","type":"workspaces","attributes":{"name":"ws"}}}`)
+	})
+	store := stub.serveVariables("ws-9")
+	stub.reply("GET", "/api/v2/workspaces/ws-9/configuration-versions", http.StatusOK,
+		listDoc(`{"id":"cv-1","type":"configuration-versions","attributes":{"status":"uploaded"}}`))
+	outputs := captureOutputs(t)
+	setInput(t, &createWS, "true")
+	setInput(t, &jsonVars, `[{"key":"region","value":"eu-west-1"}]`)
+
+	if err := run(context.Background(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n := stub.count("GET", "/api/v2/workspaces/ws-9"); n < 2 {
+		t.Errorf("reads of the new workspace = %d, want the 404 retried", n)
+	}
+	if vars := store.snapshot(); len(vars) != 1 || vars[0].Key != "region" {
+		t.Errorf("variables of the new workspace = %+v, want region", vars)
+	}
+	var doc struct {
+		Data struct {
+			Relationships struct {
+				Workspace struct {
+					Data struct {
+						ID string `json:"id"`
+					} `json:"data"`
+				} `json:"workspace"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	bodies := stub.requestBodies("POST", "/api/v2/runs")
+	if len(bodies) != 1 {
+		t.Fatalf("runs created = %d, want 1", len(bodies))
+	}
+	if err := json.Unmarshal([]byte(bodies[0]), &doc); err != nil {
+		t.Fatalf("could not decode the run creation: %v", err)
+	}
+	if got := doc.Data.Relationships.Workspace.Data.ID; got != "ws-9" {
+		t.Errorf("run created on workspace %q, want ws-9", got)
+	}
+	if got := outputs()["workspace-created"]; got != "true" {
+		t.Errorf("workspace-created = %q, want true", got)
+	}
+}